@@ -0,0 +1,398 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// alertmanagerDefaultAlertName is the alertname label of every alert when
+	// one is not configured.
+	alertmanagerDefaultAlertName = "OgreCheckFailing"
+	// alertmanagerDefaultResend is how often active alerts are re-sent when
+	// no interval is configured, Alertmanager expects alerts to be re-sent
+	// for as long as they are firing.
+	alertmanagerDefaultResend = time.Minute
+	// alertmanagerAlertsPath is the v2 API endpoint alerts are posted to.
+	alertmanagerAlertsPath = "/api/v2/alerts"
+)
+
+// AlertmanagerBackend satisfies the Platform interface and is responsible for
+// raising alerts with a Prometheus Alertmanager. An alert fires when a check
+// starts failing and is resolved when it passes again or its container stops.
+// Firing alerts are re-sent on an interval, each time with an end a few
+// intervals out so Alertmanager resolves them on its own should ogred go away.
+type AlertmanagerBackend struct {
+	Client      *http.Client
+	URL         *url.URL
+	Header      http.Header
+	AlertName   string
+	Labels      map[string]string
+	ResendEvery time.Duration
+
+	states *stateTracker
+	// active holds the firing alerts, and the resolved alerts yet to be
+	// accepted, keyed by container ID and check name
+	active map[string]map[string]*alertmanagerAlert
+	mu     sync.Mutex
+}
+
+// alertmanagerAlert is a postable alert of the Alertmanager v2 API.
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// StartsAt is left out rather than sent as the zero time when unknown,
+	// Alertmanager then uses the time it received the alert
+	StartsAt *time.Time `json:"startsAt,omitempty"`
+	EndsAt   time.Time  `json:"endsAt"`
+
+	// resolved is set once the alert has ended, it stays active until the
+	// resolve is accepted so a failed post is retried with the next resend
+	resolved bool
+}
+
+// AlertmanagerConfig holds the values from the BackendConfig which are used to
+// establish an AlertmanagerBackend.
+type AlertmanagerConfig struct {
+	// Server is the address of the Alertmanager.
+	Server string
+	// Scheme is either 'http' (default) or 'https'.
+	Scheme string
+	// ResourcePath is prepended to the /api/v2/alerts path, i.e. when the
+	// Alertmanager is served behind a route prefix.
+	ResourcePath string
+	// AlertName is the alertname label, defaulting to 'OgreCheckFailing'.
+	AlertName string
+	// Labels are added to the labels of every alert.
+	Labels map[string]string
+	// ResendInterval is how often firing alerts are re-sent, defaulting to 1m.
+	ResendInterval time.Duration
+	// Timeout bounds each request, defaulting to 10s.
+	Timeout time.Duration
+	// The TLS, authentication and header options are those of the HTTPConfig.
+	TLSCA              string
+	TLSCert            string
+	TLSKey             string
+	InsecureSkipVerify bool
+	BearerToken        string
+	Username           string
+	Password           string
+	Headers            map[string]string
+}
+
+// NewAlertmanagerBackend takes an AlertmanagerConfig and returns a pointer to
+// an AlertmanagerBackend which satisfies the Platform interface, or an error
+// should the config be invalid. Firing alerts are re-sent from a go routine
+// started here.
+func NewAlertmanagerBackend(conf AlertmanagerConfig) (Platform, error) {
+	ab := &AlertmanagerBackend{
+		Client:      &http.Client{Timeout: conf.Timeout},
+		Header:      make(http.Header),
+		AlertName:   conf.AlertName,
+		Labels:      conf.Labels,
+		ResendEvery: conf.ResendInterval,
+		states:      newStateTracker(),
+		active:      make(map[string]map[string]*alertmanagerAlert),
+	}
+	if ab.Client.Timeout == 0 {
+		ab.Client.Timeout = httpDefaultTimeout
+	}
+	if len(ab.AlertName) == 0 {
+		ab.AlertName = alertmanagerDefaultAlertName
+	}
+	if ab.ResendEvery == 0 {
+		ab.ResendEvery = alertmanagerDefaultResend
+	}
+
+	scheme := conf.Scheme
+	if len(scheme) == 0 {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("alertmanager scheme must be http or https, got %s", scheme)
+	}
+	addr, err := url.Parse(scheme + "://" + conf.Server + strings.TrimSuffix(conf.ResourcePath, "/") + alertmanagerAlertsPath)
+	if err != nil {
+		return nil, err
+	}
+	ab.URL = addr
+
+	tlsConf, err := newClientTLSConfig(conf.TLSCA, conf.TLSCert, conf.TLSKey, conf.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConf
+		ab.Client.Transport = transport
+	}
+
+	for k, v := range conf.Headers {
+		ab.Header.Set(k, v)
+	}
+	auth, err := authorization(conf.BearerToken, conf.Username, conf.Password)
+	if err != nil {
+		return nil, err
+	}
+	if len(auth) > 0 {
+		ab.Header.Set("Authorization", auth)
+	}
+
+	go ab.resendLoop()
+
+	return ab, nil
+}
+
+// Send is the AlertmanagerBackend implementation of the Platform interface
+// Send method. Send takes a Message and posts a firing alert should the check
+// have started failing, or a resolved alert should it have recovered. Results
+// which do not change the state of a check only update the annotations of a
+// firing alert, which are sent with the next resend. An error is returned
+// should the alert not be accepted.
+func (ab *AlertmanagerBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	check := bem.CompletedCheck.String()
+	var containerID string
+	if bem.Data != nil {
+		containerID = bem.Data.ContainerID
+	}
+	trans := ab.states.observe(containerID, check, bem.Passed())
+	now := time.Now()
+
+	ab.mu.Lock()
+	alert, ok := ab.active[containerID][check]
+	firing := ok && !alert.resolved
+	switch {
+	case trans.Current == stateFailing && !firing:
+		alert = &alertmanagerAlert{
+			Labels:   ab.labels(bem),
+			StartsAt: &now,
+		}
+		if _, ok := ab.active[containerID]; !ok {
+			ab.active[containerID] = make(map[string]*alertmanagerAlert)
+		}
+		ab.active[containerID][check] = alert
+	case trans.Current == stateFailing:
+		// still failing, the latest output goes out with the next resend
+		alert.Annotations = ab.annotations(bem)
+		ab.mu.Unlock()
+		return nil
+	case firing:
+		alert.resolved = true
+	default:
+		// passing and was not firing, there is nothing to tell
+		ab.mu.Unlock()
+		return nil
+	}
+
+	alert.Annotations = ab.annotations(bem)
+	if trans.Current == stateFailing {
+		alert.EndsAt = ab.firingEnd(now)
+	} else {
+		alert.EndsAt = now
+	}
+	post := *alert
+	ab.mu.Unlock()
+
+	if err := ab.post([]alertmanagerAlert{post}); err != nil {
+		return err
+	}
+	if post.resolved {
+		ab.mu.Lock()
+		ab.remove(containerID, check, alert)
+		ab.mu.Unlock()
+	}
+	return nil
+}
+
+// ContainerStopped is the AlertmanagerBackend implementation of the
+// ContainerStopper interface and resolves the firing alerts of the container
+// as its checks will no longer report.
+func (ab *AlertmanagerBackend) ContainerStopped(containerID string) {
+	ab.states.forget(containerID)
+
+	ab.mu.Lock()
+	now := time.Now()
+	var resolved []alertmanagerAlert
+	alerts := make(map[string]*alertmanagerAlert, len(ab.active[containerID]))
+	for check, alert := range ab.active[containerID] {
+		if !alert.resolved {
+			alert.resolved = true
+			alert.EndsAt = now
+		}
+		resolved = append(resolved, *alert)
+		alerts[check] = alert
+	}
+	ab.mu.Unlock()
+
+	if len(resolved) == 0 {
+		return
+	}
+	if err := ab.post(resolved); err != nil {
+		log.Daemon.Errorf("could not resolve alerts of stopped container %s: %s", containerID, err)
+		return
+	}
+	ab.mu.Lock()
+	for check, alert := range alerts {
+		ab.remove(containerID, check, alert)
+	}
+	ab.mu.Unlock()
+}
+
+// Type is the AlertmanagerBackend implementation of the Platform interface
+// Type and returns a PlatformType of type AlertmanagerBackend.
+func (ab *AlertmanagerBackend) Type() types.PlatformType {
+	return types.AlertmanagerBackend
+}
+
+// labels returns the labels identifying the alert of a check.
+func (ab *AlertmanagerBackend) labels(bem msg.BackendMessage) map[string]string {
+	labels := make(map[string]string, len(ab.Labels)+4)
+	for k, v := range ab.Labels {
+		labels[k] = v
+	}
+	labels["alertname"] = ab.AlertName
+	labels["check"] = bem.CompletedCheck.String()
+	if bem.Data != nil {
+		if container := strings.TrimPrefix(bem.Data.Container, "/"); len(container) > 0 {
+			labels["container"] = container
+		}
+		if len(bem.Data.Hostname) > 0 {
+			labels["host"] = bem.Data.Hostname
+		}
+	}
+	return labels
+}
+
+// annotations returns the annotations describing the latest result of a check.
+func (ab *AlertmanagerBackend) annotations(bem msg.BackendMessage) map[string]string {
+	exit := bem.Exit()
+	annotations := map[string]string{
+		"exit_code": strconv.Itoa(exit),
+		"summary":   fmt.Sprintf("check %s exited %d", bem.CompletedCheck.String(), exit),
+	}
+	if bem.Data != nil {
+		if container := strings.TrimPrefix(bem.Data.Container, "/"); len(container) > 0 {
+			annotations["summary"] = fmt.Sprintf("check %s of %s exited %d", bem.CompletedCheck.String(), container, exit)
+		}
+		if len(bem.Data.StdOut) > 0 {
+			annotations["stdout"] = bem.Data.StdOut
+		}
+		if len(bem.Data.StdErr) > 0 {
+			annotations["stderr"] = bem.Data.StdErr
+		}
+	}
+	return annotations
+}
+
+// firingEnd is the end sent with a firing alert, far enough out that it is
+// only reached should several resends in a row be missed.
+func (ab *AlertmanagerBackend) firingEnd(now time.Time) time.Time {
+	return now.Add(4 * ab.ResendEvery)
+}
+
+// remove drops an alert from the active alerts, unless it has been replaced
+// since, i.e. by the check failing again. The caller must hold the lock.
+func (ab *AlertmanagerBackend) remove(containerID, check string, alert *alertmanagerAlert) {
+	if ab.active[containerID][check] != alert {
+		return
+	}
+	delete(ab.active[containerID], check)
+	if len(ab.active[containerID]) == 0 {
+		delete(ab.active, containerID)
+	}
+}
+
+// resendLoop re-sends every firing alert on each tick of the resend interval,
+// along with any resolved alert which was not accepted when it ended.
+func (ab *AlertmanagerBackend) resendLoop() {
+	tick := time.NewTicker(ab.ResendEvery)
+	defer tick.Stop()
+
+	for range tick.C {
+		ab.resend()
+	}
+}
+
+// resend posts the active alerts once, removing the resolved ones when they
+// are accepted.
+func (ab *AlertmanagerBackend) resend() {
+	type activeAlert struct {
+		containerID, check string
+		alert              *alertmanagerAlert
+	}
+
+	ab.mu.Lock()
+	end := ab.firingEnd(time.Now())
+	var posts []alertmanagerAlert
+	var resolved []activeAlert
+	for containerID, alerts := range ab.active {
+		for check, alert := range alerts {
+			if alert.resolved {
+				resolved = append(resolved, activeAlert{containerID, check, alert})
+			} else {
+				alert.EndsAt = end
+			}
+			posts = append(posts, *alert)
+		}
+	}
+	ab.mu.Unlock()
+
+	if len(posts) == 0 {
+		return
+	}
+	if err := ab.post(posts); err != nil {
+		log.Daemon.Errorf("could not resend %d alerts to alertmanager: %s", len(posts), err)
+		return
+	}
+	ab.mu.Lock()
+	for _, a := range resolved {
+		ab.remove(a.containerID, a.check, a.alert)
+	}
+	ab.mu.Unlock()
+}
+
+// post sends alerts to the Alertmanager, returning an error should they not
+// be accepted.
+func (ab *AlertmanagerBackend) post(alerts []alertmanagerAlert) error {
+	data, err := json.Marshal(alerts)
+	if err != nil {
+		return fmt.Errorf("could not serialize alerts for alertmanager: %s", err)
+	}
+	log.Daemon.Tracef("alertmanager backend sending %s", data)
+
+	req, err := http.NewRequest(http.MethodPost, ab.URL.String(), bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("could not create request for alertmanager: %s", err)
+	}
+	for k, v := range ab.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ab.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send alerts to alertmanager: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("alertmanager returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	return nil
+}
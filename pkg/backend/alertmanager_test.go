@@ -0,0 +1,265 @@
+package backend
+
+import (
+	"encoding/json"
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// alertmanagerStandIn records the alerts posted to /api/v2/alerts, rejecting
+// the posts whose index is in reject.
+type alertmanagerStandIn struct {
+	posts  [][]alertmanagerAlert
+	bodies []string
+	reject map[int]bool
+	mu     sync.Mutex
+}
+
+func (as *alertmanagerStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != alertmanagerAlertsPath || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var alerts []alertmanagerAlert
+	if err := json.Unmarshal(body, &alerts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	rejected := as.reject[len(as.posts)]
+	as.posts = append(as.posts, alerts)
+	as.bodies = append(as.bodies, string(body))
+	if rejected {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+func (as *alertmanagerStandIn) received() [][]alertmanagerAlert {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.posts
+}
+
+func alertmanagerResult(exit int) msg.Message {
+	res := &health.ExecResult{
+		Container:   "/web",
+		ContainerID: "abc123",
+		Hostname:    "daae3a5a717f",
+		Exit:        exit,
+		StdErr:      "connection refused",
+	}
+	hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+	return msg.NewBackendMessage(hc, nil, res)
+}
+
+func TestAlertmanagerBackend_Send(t *testing.T) {
+	testIO := []struct {
+		name    string
+		exits   []int
+		stop    bool
+		firing  []bool
+		expLast map[string]string
+	}{
+		{
+			name:   "should not post while a check passes",
+			exits:  []int{0, 0},
+			firing: nil,
+		},
+		{
+			name:   "should post a firing alert once when a check starts failing",
+			exits:  []int{0, 1, 1},
+			firing: []bool{true},
+			expLast: map[string]string{
+				"alertname": alertmanagerDefaultAlertName,
+				"check":     "https_open",
+				"container": "web",
+				"host":      "daae3a5a717f",
+			},
+		},
+		{
+			name:   "should resolve the alert when the check recovers",
+			exits:  []int{1, 0},
+			firing: []bool{true, false},
+		},
+		{
+			name:   "should resolve the alert when the container stops",
+			exits:  []int{2},
+			stop:   true,
+			firing: []bool{true, false},
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			standIn := &alertmanagerStandIn{}
+			srv := httptest.NewServer(standIn)
+			defer srv.Close()
+
+			p, err := NewAlertmanagerBackend(AlertmanagerConfig{
+				Server:         strings.TrimPrefix(srv.URL, "http://"),
+				ResendInterval: time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, exit := range io.exits {
+				assert.NoError(t, p.Send(alertmanagerResult(exit)))
+			}
+			if io.stop {
+				p.(ContainerStopper).ContainerStopped("abc123")
+			}
+
+			posts := standIn.received()
+			if !assert.Len(t, posts, len(io.firing)) {
+				return
+			}
+			now := time.Now()
+			for i, firing := range io.firing {
+				if !assert.Len(t, posts[i], 1) {
+					continue
+				}
+				alert := posts[i][0]
+				assert.Equal(t, firing, alert.EndsAt.After(now), "post %d firing", i)
+				assert.Equal(t, "connection refused", alert.Annotations["stderr"])
+			}
+			if io.expLast != nil {
+				assert.Equal(t, io.expLast, posts[len(posts)-1][0].Labels)
+			}
+		})
+	}
+}
+
+func TestAlertmanagerBackend_payload(t *testing.T) {
+	standIn := &alertmanagerStandIn{}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	p, err := NewAlertmanagerBackend(AlertmanagerConfig{
+		Server:         strings.TrimPrefix(srv.URL, "http://"),
+		AlertName:      "ContainerUnhealthy",
+		Labels:         map[string]string{"severity": "page", "check": "overridden"},
+		ResendInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, p.Send(alertmanagerResult(2)))
+	assert.NoError(t, p.Send(alertmanagerResult(0)))
+
+	// the times are those of the sends so only their format is checked
+	times := regexp.MustCompile(`"(startsAt|endsAt)":"\d{4}-\d\d-\d\dT[^"]+"`)
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	var got []string
+	for _, body := range standIn.bodies {
+		got = append(got, times.ReplaceAllString(body, `"$1":"<time>"`))
+	}
+	assert.Equal(t, []string{
+		`[{"labels":{"alertname":"ContainerUnhealthy","check":"https_open","container":"web","host":"daae3a5a717f","severity":"page"},` +
+			`"annotations":{"exit_code":"2","stderr":"connection refused","summary":"check https_open of web exited 2"},` +
+			`"startsAt":"<time>","endsAt":"<time>"}]`,
+		`[{"labels":{"alertname":"ContainerUnhealthy","check":"https_open","container":"web","host":"daae3a5a717f","severity":"page"},` +
+			`"annotations":{"exit_code":"0","stderr":"connection refused","summary":"check https_open of web exited 0"},` +
+			`"startsAt":"<time>","endsAt":"<time>"}]`,
+	}, got)
+}
+
+func TestAlertmanagerBackend_resend(t *testing.T) {
+	standIn := &alertmanagerStandIn{}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	p, err := NewAlertmanagerBackend(AlertmanagerConfig{
+		Server:         strings.TrimPrefix(srv.URL, "http://"),
+		ResendInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, p.Send(alertmanagerResult(1)))
+	// long enough for at least a couple of resends
+	time.Sleep(175 * time.Millisecond)
+
+	posts := standIn.received()
+	assert.True(t, len(posts) >= 3, "expected the firing alert to be re-sent, got %d posts", len(posts))
+	for _, post := range posts {
+		assert.Equal(t, "https_open", post[0].Labels["check"])
+	}
+}
+
+func TestAlertmanagerBackend_resendResolved(t *testing.T) {
+	// the resolve, the second post, is rejected
+	standIn := &alertmanagerStandIn{reject: map[int]bool{1: true}}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	p, err := NewAlertmanagerBackend(AlertmanagerConfig{
+		Server:         strings.TrimPrefix(srv.URL, "http://"),
+		ResendInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab := p.(*AlertmanagerBackend)
+	assert.NoError(t, ab.Send(alertmanagerResult(1)))
+	assert.Error(t, ab.Send(alertmanagerResult(0)))
+	// the resolve is retried, and then forgotten once accepted
+	ab.resend()
+	ab.resend()
+
+	posts := standIn.received()
+	if !assert.Len(t, posts, 3) {
+		return
+	}
+	now := time.Now()
+	for i, post := range posts[1:] {
+		if assert.Len(t, post, 1) {
+			assert.False(t, post[0].EndsAt.After(now), "post %d firing", i+1)
+		}
+	}
+}
+
+func TestAlertmanagerAlert_json(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	testIO := []struct {
+		name  string
+		alert alertmanagerAlert
+		exp   string
+	}{
+		{
+			name: "should send the start of the alert",
+			alert: alertmanagerAlert{
+				Labels:   map[string]string{"alertname": "OgreCheckFailing"},
+				StartsAt: &start,
+				EndsAt:   start.Add(4 * time.Minute),
+			},
+			exp: `{"labels":{"alertname":"OgreCheckFailing"},"startsAt":"2020-06-01T12:00:00Z","endsAt":"2020-06-01T12:04:00Z"}`,
+		},
+		{
+			name: "should leave out an unknown start",
+			alert: alertmanagerAlert{
+				Labels: map[string]string{"alertname": "OgreCheckFailing"},
+				EndsAt: start,
+			},
+			exp: `{"labels":{"alertname":"OgreCheckFailing"},"endsAt":"2020-06-01T12:00:00Z"}`,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			data, err := json.Marshal(io.alert)
+			if assert.NoError(t, err) {
+				assert.Equal(t, io.exp, string(data))
+			}
+		})
+	}
+}
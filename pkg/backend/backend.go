@@ -6,6 +6,8 @@ import (
 	"github.com/ideal-co/ogre/pkg/log"
 	msg "github.com/ideal-co/ogre/pkg/message"
 	"github.com/ideal-co/ogre/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
 )
 
 type Platform interface {
@@ -17,17 +19,208 @@ type BackendClient interface {
 	Send(msg.Message) error
 }
 
+// ContainerStopper is implemented by Platforms which hold state for each
+// container, i.e. the prometheus series of its checks, which must be cleaned
+// up once the container stops and its checks will no longer report.
+type ContainerStopper interface {
+	ContainerStopped(containerID string)
+}
+
+// BatchClient is implemented by Platforms which can deliver many messages in a
+// single request, i.e. many points in one write to influx, and is used in place
+// of Send when batching is configured for the backend.
+type BatchClient interface {
+	SendBatch([]msg.Message) error
+}
+
+// deliveryFailures counts the results which a backend gave up delivering by
+// the name of the backend, it is exposed by every prometheus backend alongside
+// the check metrics.
+var deliveryFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ogre_backend_delivery_failures_total",
+	Help: "Number of health check results a backend failed to deliver.",
+}, []string{"backend"})
+
 // NewBackendClient takes a types.PlatformType and an address and returns a
 // typed backend.Platform interface and an error which will be nil upon
 // successful initialization of the Platform.
 func NewBackendClient(pType types.PlatformType, conf config.BackendConfig) (Platform, error) {
 	switch pType {
 	case types.StatsdBackend:
-		return NewStatsdClient(conf.Server, conf.Prefix)
+		return NewStatsdClient(StatsdConfig{
+			Server:       conf.Server,
+			Prefix:       conf.Prefix,
+			NameTemplate: conf.NameTemplate,
+			Metrics:      conf.Metrics,
+			Tags:         conf.Tags,
+		})
 	case types.HTTPBackend:
-		return NewHTTPBackend(conf.Server, conf.ResourcePath, conf.Format)
+		timeout, err := parseDuration("timeout", conf.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		backoff, err := parseDuration("retry_backoff", conf.RetryBackoff)
+		if err != nil {
+			return nil, err
+		}
+		maxBackoff, err := parseDuration("retry_max_backoff", conf.RetryMaxBackoff)
+		if err != nil {
+			return nil, err
+		}
+		return NewHTTPBackend(HTTPConfig{
+			Name:               conf.Name,
+			Server:             conf.Server,
+			ResourcePath:       conf.ResourcePath,
+			Format:             conf.Format,
+			Timeout:            timeout,
+			Retries:            conf.Retries,
+			Backoff:            backoff,
+			MaxBackoff:         maxBackoff,
+			Scheme:             conf.Scheme,
+			TLSCA:              conf.TLSCA,
+			TLSCert:            conf.TLSCert,
+			TLSKey:             conf.TLSKey,
+			BearerToken:        conf.BearerToken,
+			Username:           conf.Username,
+			Password:           conf.Password,
+			Headers:            conf.Headers,
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+			Template:           conf.Template,
+			TemplateFile:       conf.TemplateFile,
+			ContentType:        conf.ContentType,
+		})
 	case types.PrometheusBackend:
-		return NewPrometheusBackend(conf.Server, conf.Metric, conf.ResourcePath)
+		interval, err := parseDuration("push_interval", conf.PushInterval)
+		if err != nil {
+			return nil, err
+		}
+		return NewPrometheusBackend(PrometheusConfig{
+			Server:       conf.Server,
+			Metric:       conf.Metric,
+			Label:        conf.Label,
+			ResourcePath: conf.ResourcePath,
+			TLSCert:      conf.TLSCert,
+			TLSKey:       conf.TLSKey,
+			Username:     conf.Username,
+			Password:     conf.Password,
+			PushGateway:  conf.PushGateway,
+			PushInterval: interval,
+		})
+	case types.GraphiteBackend:
+		return NewGraphiteBackend(conf.Server, conf.Prefix, conf.Protocol)
+	case types.CollectdBackend:
+		return NewCollectdBackend(conf.Server, conf.Protocol)
+	case types.InfluxBackend:
+		return NewInfluxBackend(InfluxConfig{
+			Server:       conf.Server,
+			Protocol:     conf.Protocol,
+			Measurement:  conf.Metric,
+			Database:     conf.Database,
+			Org:          conf.Org,
+			Bucket:       conf.Bucket,
+			Token:        conf.Token,
+			ResourcePath: conf.ResourcePath,
+		})
+	case types.OTLPBackend:
+		return NewOTLPBackend(conf.Server, conf.Scheme, conf.ResourcePath, conf.Format)
+	case types.SyslogBackend:
+		return NewSyslogBackend(SyslogConfig{
+			Server:             conf.Server,
+			Protocol:           conf.Protocol,
+			Facility:           conf.Facility,
+			AppName:            conf.AppName,
+			TLSCA:              conf.TLSCA,
+			TLSCert:            conf.TLSCert,
+			TLSKey:             conf.TLSKey,
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+		})
+	case types.AlertmanagerBackend:
+		timeout, err := parseDuration("timeout", conf.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		resend, err := parseDuration("resend_interval", conf.ResendInterval)
+		if err != nil {
+			return nil, err
+		}
+		return NewAlertmanagerBackend(AlertmanagerConfig{
+			Server:             conf.Server,
+			Scheme:             conf.Scheme,
+			ResourcePath:       conf.ResourcePath,
+			AlertName:          conf.AlertName,
+			Labels:             conf.AlertLabels,
+			ResendInterval:     resend,
+			Timeout:            timeout,
+			TLSCA:              conf.TLSCA,
+			TLSCert:            conf.TLSCert,
+			TLSKey:             conf.TLSKey,
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+			BearerToken:        conf.BearerToken,
+			Username:           conf.Username,
+			Password:           conf.Password,
+			Headers:            conf.Headers,
+		})
+	case types.FileBackend:
+		interval, err := parseDuration("rotate_interval", conf.RotateInterval)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileBackend(FileConfig{
+			Path:           conf.Path,
+			Format:         conf.Format,
+			MaxBytes:       conf.MaxBytes,
+			RotateInterval: interval,
+			MaxFiles:       conf.MaxFiles,
+			Compress:       conf.Compress,
+		})
+	case types.NATSBackend:
+		return NewNATSBackend(NATSConfig{
+			Server:             conf.Server,
+			Protocol:           conf.Protocol,
+			Topic:              conf.Topic,
+			Username:           conf.Username,
+			Password:           conf.Password,
+			Token:              conf.Token,
+			TLSCA:              conf.TLSCA,
+			TLSCert:            conf.TLSCert,
+			TLSKey:             conf.TLSKey,
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+		})
+	case types.MQTTBackend:
+		return NewMQTTBackend(MQTTConfig{
+			Server:             conf.Server,
+			Protocol:           conf.Protocol,
+			Topic:              conf.Topic,
+			QoS:                conf.QoS,
+			Retain:             conf.Retain,
+			ClientID:           conf.ClientID,
+			Username:           conf.Username,
+			Password:           conf.Password,
+			TLSCA:              conf.TLSCA,
+			TLSCert:            conf.TLSCert,
+			TLSKey:             conf.TLSKey,
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+		})
+	case types.ExecBackend:
+		timeout, err := parseDuration("timeout", conf.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		backoff, err := parseDuration("retry_backoff", conf.RetryBackoff)
+		if err != nil {
+			return nil, err
+		}
+		maxBackoff, err := parseDuration("retry_max_backoff", conf.RetryMaxBackoff)
+		if err != nil {
+			return nil, err
+		}
+		return NewExecBackend(ExecConfig{
+			Command:    conf.Command,
+			Args:       conf.Args,
+			Timeout:    timeout,
+			Backoff:    backoff,
+			MaxBackoff: maxBackoff,
+		})
 	case types.DefaultBackend:
 		// our default backend should be the service log but without the logrus
 		// formatting when messages are written.
@@ -37,3 +230,16 @@ func NewBackendClient(pType types.PlatformType, conf config.BackendConfig) (Plat
 		return nil, fmt.Errorf("could not establish a backend for address: %s", conf.Server)
 	}
 }
+
+// parseDuration parses the duration of a BackendConfig field, an empty value is
+// a zero duration leaving the backend to use its default.
+func parseDuration(field, value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s: %s", field, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,225 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/health"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collectd binary network protocol part types, see
+// https://collectd.org/wiki/index.php/Binary_protocol
+const (
+	collectdPartHost           uint16 = 0x0000
+	collectdPartTime           uint16 = 0x0001
+	collectdPartPlugin         uint16 = 0x0002
+	collectdPartPluginInstance uint16 = 0x0003
+	collectdPartType           uint16 = 0x0004
+	collectdPartTypeInstance   uint16 = 0x0005
+	collectdPartValues         uint16 = 0x0006
+	collectdPartInterval       uint16 = 0x0007
+
+	collectdValueGauge byte = 1
+
+	collectdPlugin = "ogre"
+	collectdType   = "gauge"
+)
+
+// CollectdBackend satisfies the Platform interface and is responsible for the
+// sending of health check results to a collectd instance. Results are sent as
+// a gauge, either over the binary network protocol to a collectd network plugin
+// listening on UDP, or as a PUTVAL command to the unixsock plugin.
+type CollectdBackend struct {
+	Network string
+	Address string
+
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// NewCollectdBackend takes two strings, an address and a protocol, and returns
+// a pointer to CollectdBackend which satisfies the Platform interface, or an
+// error. The protocol can be 'udp' (the default) in which case the address is
+// that of the collectd network plugin, i.e. 127.0.0.1:25826, or 'unix' in which
+// case the address is the path to the socket of the unixsock plugin.
+func NewCollectdBackend(addr, protocol string) (Platform, error) {
+	cb := &CollectdBackend{
+		Network: protocol,
+		Address: addr,
+	}
+	if len(cb.Network) == 0 {
+		cb.Network = "udp"
+	}
+	if cb.Network != "udp" && cb.Network != "unix" {
+		return nil, fmt.Errorf("collectd protocol must be udp or unix, got %s", cb.Network)
+	}
+
+	if err := cb.connect(); err != nil {
+		return nil, err
+	}
+
+	return cb, nil
+}
+
+// Send is the CollectdBackend implementation of the Platform interface Send
+// method. Send takes a Message and sends a gauge equal to that of the exit code
+// of the health check, identified by the container hostname, the 'ogre' plugin
+// with the container name as instance and the check name as type instance.
+func (cb *CollectdBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.conn == nil {
+		if err := cb.connect(); err != nil {
+			return fmt.Errorf("could not reconnect to collectd: %s", err)
+		}
+	}
+
+	var err error
+	if cb.Network == "unix" {
+		err = cb.putVal(bem, bem.Time())
+	} else {
+		_, err = cb.conn.Write(collectdPacket(bem, bem.Time()))
+	}
+	if err != nil {
+		// drop the connection so the next message will reconnect
+		cb.close()
+		return fmt.Errorf("could not send message for collectd: %s", err)
+	}
+
+	return nil
+}
+
+// Type is the CollectdBackend implementation of the Platform interface Type
+// and returns a PlatformType of type CollectdBackend.
+func (cb *CollectdBackend) Type() types.PlatformType {
+	return types.CollectdBackend
+}
+
+// putVal writes a single PUTVAL command to the unixsock plugin and reads the
+// status line which is returned, a negative status is returned as an error.
+func (cb *CollectdBackend) putVal(bem msg.BackendMessage, ts time.Time) error {
+	host, instance, check := collectdIdentity(bem)
+	cmd := fmt.Sprintf("PUTVAL %q interval=%d %d:%d\n",
+		fmt.Sprintf("%s/%s-%s/%s-%s", host, collectdPlugin, instance, collectdType, check),
+		int64(collectdInterval(bem).Seconds()),
+		ts.Unix(),
+		bem.Exit(),
+	)
+	log.Daemon.Tracef("collectd backend sending %q", cmd)
+
+	if _, err := cb.conn.Write([]byte(cmd)); err != nil {
+		return err
+	}
+
+	cb.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	status, err := bufio.NewReader(cb.conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	// responses take the form '0 Success: 1 value has been dispatched.'
+	fields := strings.SplitN(strings.TrimSpace(status), " ", 2)
+	if code, err := strconv.Atoi(fields[0]); err != nil || code < 0 {
+		return fmt.Errorf("collectd rejected value: %s", strings.TrimSpace(status))
+	}
+
+	return nil
+}
+
+// connect closes any existing connection and dials the configured address.
+// Callers are expected to hold the mutex.
+func (cb *CollectdBackend) connect() error {
+	cb.close()
+	conn, err := net.Dial(cb.Network, cb.Address)
+	if err != nil {
+		return err
+	}
+	cb.conn = conn
+	return nil
+}
+
+// close tears down the connection if there is one. Callers are expected to
+// hold the mutex.
+func (cb *CollectdBackend) close() {
+	if cb.conn != nil {
+		cb.conn.Close()
+		cb.conn = nil
+	}
+}
+
+// collectdPacket encodes a BackendMessage as a single value list in the
+// collectd binary network protocol.
+func collectdPacket(bem msg.BackendMessage, ts time.Time) []byte {
+	host, instance, check := collectdIdentity(bem)
+
+	var buf bytes.Buffer
+	writeCollectdString(&buf, collectdPartHost, host)
+	writeCollectdNumber(&buf, collectdPartTime, uint64(ts.Unix()))
+	writeCollectdNumber(&buf, collectdPartInterval, uint64(collectdInterval(bem).Seconds()))
+	writeCollectdString(&buf, collectdPartPlugin, collectdPlugin)
+	writeCollectdString(&buf, collectdPartPluginInstance, instance)
+	writeCollectdString(&buf, collectdPartType, collectdType)
+	writeCollectdString(&buf, collectdPartTypeInstance, check)
+
+	// values part: header, number of values, the data source types and then
+	// the values themselves, gauges are the only type sent in little endian
+	binary.Write(&buf, binary.BigEndian, collectdPartValues)
+	binary.Write(&buf, binary.BigEndian, uint16(4+2+1+8))
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	buf.WriteByte(collectdValueGauge)
+	binary.Write(&buf, binary.LittleEndian, math.Float64bits(float64(bem.Exit())))
+
+	return buf.Bytes()
+}
+
+// writeCollectdString writes a null terminated string part.
+func writeCollectdString(buf *bytes.Buffer, part uint16, s string) {
+	binary.Write(buf, binary.BigEndian, part)
+	binary.Write(buf, binary.BigEndian, uint16(4+len(s)+1))
+	buf.WriteString(s)
+	buf.WriteByte(0)
+}
+
+// writeCollectdNumber writes a 64 bit unsigned integer part.
+func writeCollectdNumber(buf *bytes.Buffer, part uint16, n uint64) {
+	binary.Write(buf, binary.BigEndian, part)
+	binary.Write(buf, binary.BigEndian, uint16(4+8))
+	binary.Write(buf, binary.BigEndian, n)
+}
+
+// collectdIdentity returns the host, plugin instance and type instance used to
+// identify a health check result. Collectd uses '/' and '-' to separate parts
+// of an identifier so those are replaced in the container and check names.
+func collectdIdentity(bem msg.BackendMessage) (string, string, string) {
+	r := strings.NewReplacer("/", "_", "-", "_", " ", "_")
+	var host, container string
+	if bem.Data != nil {
+		host = bem.Data.Hostname
+		container = strings.TrimPrefix(bem.Data.Container, "/")
+	}
+	if len(host) == 0 {
+		host = "localhost"
+	}
+	return r.Replace(host), r.Replace(container), r.Replace(bem.CompletedCheck.String())
+}
+
+// collectdInterval returns the interval of the health check if it is known
+// so collectd can judge when a value has gone missing, defaulting to 5s.
+func collectdInterval(bem msg.BackendMessage) time.Duration {
+	if dhc, ok := bem.CompletedCheck.(*health.DockerHealthCheck); ok && dhc.Interval >= time.Second {
+		return dhc.Interval
+	}
+	return 5 * time.Second
+}
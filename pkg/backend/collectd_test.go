@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func collectdResult(hc *health.DockerHealthCheck, res *health.ExecResult) msg.BackendMessage {
+	hc.Result = res
+	return msg.NewBackendMessage(hc, nil, res).(msg.BackendMessage)
+}
+
+func TestCollectdPacket(t *testing.T) {
+	ts := time.Unix(1591026304, 0)
+	testIO := []struct {
+		name string
+		bem  msg.BackendMessage
+		exp  []byte
+	}{
+		{
+			name: "should encode every part of the value list",
+			bem: collectdResult(
+				&health.DockerHealthCheck{Name: "https_open", Interval: 30 * time.Second},
+				&health.ExecResult{Container: "/web", Hostname: "daae3a5a717f", Exit: 1},
+			),
+			exp: []byte("" +
+				// host
+				"\x00\x00\x00\x11daae3a5a717f\x00" +
+				// time
+				"\x00\x01\x00\x0c\x00\x00\x00\x00\x5e\xd5\x22\x80" +
+				// interval
+				"\x00\x07\x00\x0c\x00\x00\x00\x00\x00\x00\x00\x1e" +
+				// plugin, plugin instance, type and type instance
+				"\x00\x02\x00\x09ogre\x00" +
+				"\x00\x03\x00\x08web\x00" +
+				"\x00\x04\x00\x0agauge\x00" +
+				"\x00\x05\x00\x0fhttps_open\x00" +
+				// values, one gauge of 1.0 in little endian
+				"\x00\x06\x00\x0f\x00\x01\x01\x00\x00\x00\x00\x00\x00\xf0\x3f"),
+		},
+		{
+			name: "should default the host and interval and replace separators",
+			bem: collectdResult(
+				&health.DockerHealthCheck{Name: "db-replica lag"},
+				&health.ExecResult{Container: "/pg-main", Exit: 0},
+			),
+			exp: []byte("" +
+				"\x00\x00\x00\x0elocalhost\x00" +
+				"\x00\x01\x00\x0c\x00\x00\x00\x00\x5e\xd5\x22\x80" +
+				"\x00\x07\x00\x0c\x00\x00\x00\x00\x00\x00\x00\x05" +
+				"\x00\x02\x00\x09ogre\x00" +
+				"\x00\x03\x00\x0cpg_main\x00" +
+				"\x00\x04\x00\x0agauge\x00" +
+				"\x00\x05\x00\x13db_replica_lag\x00" +
+				"\x00\x06\x00\x0f\x00\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00"),
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			assert.Equal(t, io.exp, collectdPacket(io.bem, ts))
+		})
+	}
+}
+
+func TestCollectdBackend_putVal(t *testing.T) {
+	testIO := []struct {
+		name   string
+		status string
+		expErr bool
+	}{
+		{
+			name:   "should succeed when the value is dispatched",
+			status: "0 Success: 1 value has been dispatched.\n",
+		},
+		{
+			name:   "should fail when the value is rejected",
+			status: "-1 No such dataset registered: gauge\n",
+			expErr: true,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			got := make(chan string, 1)
+			go func() {
+				buf := make([]byte, 512)
+				n, _ := server.Read(buf)
+				got <- string(buf[:n])
+				server.Write([]byte(io.status))
+			}()
+
+			cb := &CollectdBackend{Network: "unix", conn: client}
+			bem := collectdResult(
+				&health.DockerHealthCheck{Name: "https_open", Interval: 30 * time.Second},
+				&health.ExecResult{Container: "/web", Hostname: "daae3a5a717f", Exit: 1},
+			)
+			err := cb.putVal(bem, time.Unix(1591026304, 0))
+			assert.Equal(t, io.expErr, err != nil, "unexpected error %v", err)
+			assert.Equal(t, "PUTVAL \"daae3a5a717f/ogre-web/gauge-https_open\" interval=30 1591026304:1\n", <-got)
+		})
+	}
+}
+
+func TestCollectdBackend_Send(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p, err := NewCollectdBackend(conn.LocalAddr().String(), "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a result replayed from a spool is sent as of its run
+	ts := time.Unix(1591026304, 0)
+	bem := collectdResult(
+		&health.DockerHealthCheck{Name: "https_open", Interval: 30 * time.Second},
+		&health.ExecResult{Container: "/web", Hostname: "daae3a5a717f", Exit: 1, Time: ts},
+	)
+	assert.NoError(t, p.Send(bem))
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, collectdPacket(bem, ts), buf[:n])
+}
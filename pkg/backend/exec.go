@@ -0,0 +1,359 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	// execDefaultTimeout is how long a plugin has to acknowledge a message
+	// when no timeout is configured.
+	execDefaultTimeout = 10 * time.Second
+	// execDefaultBackoff is the wait before the first restart of a plugin
+	// which exited, doubling for each restart in a row up to the max.
+	execDefaultBackoff    = time.Second
+	execDefaultMaxBackoff = time.Minute
+	// execStopAction is the action of the message sent to a plugin when a
+	// container stops.
+	execStopAction = "stop-health"
+)
+
+// ExecBackend satisfies the Platform interface and is responsible for handing
+// health check results to a plugin, an executable of the user's own which is
+// started once and kept running. Each message is written to the stdin of the
+// plugin as a single JSON line carrying an id, and the plugin acknowledges it
+// by writing a JSON line with the same id to its stdout, along with an error
+// should it have failed to deliver the message. The plugin is restarted with a
+// backoff should it exit, and its stderr is written to the daemon log.
+type ExecBackend struct {
+	Command    string
+	Args       []string
+	Timeout    time.Duration
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	proc    *execProcess
+	nextID  uint64
+	pending map[uint64]chan execAck
+	// closed is set by Close, stop is then closed to end the supervision,
+	// which closes supervised once it has
+	closed     bool
+	stop       chan struct{}
+	supervised chan struct{}
+	mu         sync.Mutex
+}
+
+// ExecConfig holds the values from the BackendConfig which are used to
+// establish an ExecBackend.
+type ExecConfig struct {
+	// Command is the path of the plugin and Args its arguments.
+	Command string
+	Args    []string
+	// Timeout is how long the plugin has to acknowledge a message, defaulting
+	// to 10s.
+	Timeout time.Duration
+	// Backoff is the wait before the plugin is restarted, doubling for each
+	// restart in a row up to MaxBackoff. The defaults are 1s and 1m.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// execProcess is a running plugin, done is closed once it has exited.
+type execProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	readers sync.WaitGroup
+	done    chan struct{}
+}
+
+// execMessage is a single line written to the stdin of a plugin. Results carry
+// the same fields as the lines of the file backend, the stop-health action
+// only the ID of the container which stopped.
+type execMessage struct {
+	ID          uint64        `json:"id"`
+	Action      string        `json:"action,omitempty"`
+	ContainerID string        `json:"container_id,omitempty"`
+	Result      *resultRecord `json:"result,omitempty"`
+}
+
+// execAck is a single line read from the stdout of a plugin.
+type execAck struct {
+	ID    uint64 `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewExecBackend takes an ExecConfig and returns a pointer to ExecBackend which
+// satisfies the Platform interface, or an error should the plugin not start.
+// The plugin is supervised by a go routine started here which restarts it
+// whenever it exits.
+func NewExecBackend(conf ExecConfig) (Platform, error) {
+	eb := &ExecBackend{
+		Command:    conf.Command,
+		Args:       conf.Args,
+		Timeout:    conf.Timeout,
+		Backoff:    conf.Backoff,
+		MaxBackoff: conf.MaxBackoff,
+		pending:    make(map[uint64]chan execAck),
+		stop:       make(chan struct{}),
+		supervised: make(chan struct{}),
+	}
+	if len(eb.Command) == 0 {
+		return nil, fmt.Errorf("exec backend requires a command")
+	}
+	if eb.Timeout == 0 {
+		eb.Timeout = execDefaultTimeout
+	}
+	if eb.Backoff == 0 {
+		eb.Backoff = execDefaultBackoff
+	}
+	if eb.MaxBackoff == 0 {
+		eb.MaxBackoff = execDefaultMaxBackoff
+	}
+	if eb.MaxBackoff < eb.Backoff {
+		eb.MaxBackoff = eb.Backoff
+	}
+
+	proc, err := eb.start()
+	if err != nil {
+		return nil, err
+	}
+	go eb.supervise(proc)
+
+	return eb, nil
+}
+
+// Send is the ExecBackend implementation of the Platform interface Send
+// method. Send takes a Message, writes it to the plugin and waits on its
+// acknowledgement. An error is returned should the plugin not be running, not
+// acknowledge the message in time or report that it failed to deliver it.
+func (eb *ExecBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	rec := newResultRecord(bem)
+	return eb.deliver(execMessage{Result: &rec})
+}
+
+// ContainerStopped is the ExecBackend implementation of the ContainerStopper
+// interface and tells the plugin the container stopped, should it hold state
+// for the checks of the container.
+func (eb *ExecBackend) ContainerStopped(containerID string) {
+	if err := eb.deliver(execMessage{Action: execStopAction, ContainerID: containerID}); err != nil {
+		log.Daemon.Errorf("could not tell exec plugin %s container %s stopped: %s", eb.Command, containerID, err)
+	}
+}
+
+// Close stops the plugin, which is no longer restarted. The stdin of the plugin
+// is closed for it to exit on its own, should it not within the timeout of the
+// backend it is killed.
+func (eb *ExecBackend) Close() error {
+	eb.mu.Lock()
+	if eb.closed {
+		eb.mu.Unlock()
+		return nil
+	}
+	eb.closed = true
+	proc := eb.proc
+	eb.mu.Unlock()
+
+	close(eb.stop)
+	if proc != nil {
+		proc.stdin.Close()
+	}
+	select {
+	case <-eb.supervised:
+	case <-time.After(eb.Timeout):
+		eb.mu.Lock()
+		proc = eb.proc
+		eb.mu.Unlock()
+		if proc != nil {
+			proc.cmd.Process.Kill()
+		}
+		<-eb.supervised
+	}
+	return nil
+}
+
+// Type is the ExecBackend implementation of the Platform interface Type
+// and returns a PlatformType of type ExecBackend.
+func (eb *ExecBackend) Type() types.PlatformType {
+	return types.ExecBackend
+}
+
+// deliver assigns the message an id, writes it to the plugin and waits on the
+// acknowledgement of that id.
+func (eb *ExecBackend) deliver(em execMessage) error {
+	eb.mu.Lock()
+	proc := eb.proc
+	if proc == nil {
+		eb.mu.Unlock()
+		return fmt.Errorf("exec plugin %s is not running", eb.Command)
+	}
+	eb.nextID++
+	em.ID = eb.nextID
+	line, err := json.Marshal(em)
+	if err != nil {
+		eb.mu.Unlock()
+		return fmt.Errorf("could not serialize message for exec plugin: %s", err)
+	}
+	log.Daemon.Tracef("exec backend sending %s", line)
+
+	ack := make(chan execAck, 1)
+	eb.pending[em.ID] = ack
+	if _, err := proc.stdin.Write(append(line, '\n')); err != nil {
+		delete(eb.pending, em.ID)
+		eb.mu.Unlock()
+		return fmt.Errorf("could not write message to exec plugin %s: %s", eb.Command, err)
+	}
+	eb.mu.Unlock()
+
+	timeout := time.NewTimer(eb.Timeout)
+	defer timeout.Stop()
+
+	select {
+	case a := <-ack:
+		if len(a.Error) > 0 {
+			return fmt.Errorf("exec plugin %s failed to deliver message: %s", eb.Command, a.Error)
+		}
+		return nil
+	case <-proc.done:
+		eb.forget(em.ID)
+		return fmt.Errorf("exec plugin %s exited before acknowledging message", eb.Command)
+	case <-timeout.C:
+		eb.forget(em.ID)
+		return fmt.Errorf("exec plugin %s did not acknowledge message within %s", eb.Command, eb.Timeout)
+	}
+}
+
+// forget stops waiting on the acknowledgement of a message.
+func (eb *ExecBackend) forget(id uint64) {
+	eb.mu.Lock()
+	delete(eb.pending, id)
+	eb.mu.Unlock()
+}
+
+// start launches the plugin along with the go routines reading its stdout and
+// stderr, and makes it the running process.
+func (eb *ExecBackend) start() (*execProcess, error) {
+	cmd := exec.Command(eb.Command, eb.Args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not create stdin of exec plugin: %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not create stdout of exec plugin: %s", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not create stderr of exec plugin: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not start exec plugin %s: %s", eb.Command, err)
+	}
+
+	proc := &execProcess{cmd: cmd, stdin: stdin, done: make(chan struct{})}
+	proc.readers.Add(2)
+	go func() {
+		defer proc.readers.Done()
+		eb.readAcks(stdout)
+	}()
+	go func() {
+		defer proc.readers.Done()
+		eb.readStderr(stderr)
+	}()
+
+	eb.mu.Lock()
+	eb.proc = proc
+	eb.mu.Unlock()
+	return proc, nil
+}
+
+// supervise waits on the plugin to exit and restarts it, waiting longer
+// between each restart in a row, until the backend is closed. The backoff is
+// reset once a plugin has run for longer than the max backoff.
+func (eb *ExecBackend) supervise(proc *execProcess) {
+	defer close(eb.supervised)
+
+	backoff := eb.Backoff
+	for {
+		started := time.Now()
+		// the pipes are closed by Wait, so the last of the output is read
+		// before it is called
+		proc.readers.Wait()
+		err := proc.cmd.Wait()
+
+		eb.mu.Lock()
+		eb.proc = nil
+		closed := eb.closed
+		eb.mu.Unlock()
+		close(proc.done)
+
+		if closed {
+			return
+		}
+		if time.Since(started) > eb.MaxBackoff {
+			backoff = eb.Backoff
+		}
+		log.Daemon.Errorf("exec plugin %s exited, restarting in %s: %v", eb.Command, backoff, err)
+
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-eb.stop:
+				return
+			}
+			if backoff *= 2; backoff > eb.MaxBackoff {
+				backoff = eb.MaxBackoff
+			}
+
+			proc, err = eb.start()
+			if err == nil {
+				break
+			}
+			log.Daemon.Errorf("%s, retrying in %s", err, backoff)
+		}
+
+		// the backend may have been closed while the plugin was starting
+		select {
+		case <-eb.stop:
+			proc.stdin.Close()
+		default:
+		}
+	}
+}
+
+// readAcks reads the acknowledgements a plugin writes to its stdout until it
+// exits, handing each to the delivery waiting on it.
+func (eb *ExecBackend) readAcks(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var a execAck
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			log.Daemon.Warnf("exec plugin %s wrote an invalid acknowledgement %q: %s", eb.Command, scanner.Text(), err)
+			continue
+		}
+
+		eb.mu.Lock()
+		ack, ok := eb.pending[a.ID]
+		delete(eb.pending, a.ID)
+		eb.mu.Unlock()
+		if ok {
+			ack <- a
+		}
+	}
+}
+
+// readStderr writes each line a plugin writes to its stderr to the daemon log.
+func (eb *ExecBackend) readStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Daemon.Infof("exec plugin %s: %s", eb.Command, scanner.Text())
+	}
+}
@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// execPlugins are shell scripts standing in for plugins, each reads the id at
+// the start of every line it is sent.
+var execPlugins = map[string]string{
+	"ack": `while read -r line; do
+  id=$(echo "$line" | sed 's/^{"id":\([0-9]*\).*/\1/')
+  echo "{\"id\":$id}"
+done`,
+	"nack": `while read -r line; do
+  id=$(echo "$line" | sed 's/^{"id":\([0-9]*\).*/\1/')
+  echo "{\"id\":$id,\"error\":\"destination unavailable\"}"
+done`,
+	"silent": `while read -r line; do :; done`,
+	// deaf does not read its stdin at all, so never exits on its own
+	"deaf": `exec sleep 10`,
+	// crash exits on the first message of its first run, every later run
+	// acknowledges each message
+	"crash": `if [ ! -f "$0.ran" ]; then touch "$0.ran"; read -r line; exit 1; fi
+while read -r line; do
+  id=$(echo "$line" | sed 's/^{"id":\([0-9]*\).*/\1/')
+  echo "{\"id\":$id}"
+done`,
+}
+
+func TestExecBackend_Send(t *testing.T) {
+	testIO := []struct {
+		name    string
+		plugin  string
+		expErrs []bool
+	}{
+		{
+			name:    "should succeed once the plugin acknowledges",
+			plugin:  "ack",
+			expErrs: []bool{false, false},
+		},
+		{
+			name:    "should fail when the plugin reports an error",
+			plugin:  "nack",
+			expErrs: []bool{true},
+		},
+		{
+			name:    "should fail when the plugin does not acknowledge in time",
+			plugin:  "silent",
+			expErrs: []bool{true},
+		},
+		{
+			name:    "should restart the plugin after it exits",
+			plugin:  "crash",
+			expErrs: []bool{true, false},
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ogre-exec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			plugin := filepath.Join(dir, io.plugin)
+			if err := ioutil.WriteFile(plugin, []byte("#!/bin/sh\n"+execPlugins[io.plugin]+"\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			p, err := NewExecBackend(ExecConfig{
+				Command: plugin,
+				Timeout: 200 * time.Millisecond,
+				Backoff: 10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.(*ExecBackend).Close()
+
+			res := &health.ExecResult{Container: "/web", Exit: 1}
+			hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+			for i, expErr := range io.expErrs {
+				if i > 0 && !expErr {
+					// allow for a restart before a send expected to succeed
+					time.Sleep(100 * time.Millisecond)
+				}
+				err := p.Send(msg.NewBackendMessage(hc, nil, res))
+				assert.Equal(t, expErr, err != nil, "send %d: %v", i, err)
+			}
+		})
+	}
+}
+
+func TestExecBackend_Close(t *testing.T) {
+	testIO := []struct {
+		name   string
+		plugin string
+	}{
+		{
+			name:   "should stop a plugin once its stdin is closed",
+			plugin: "ack",
+		},
+		{
+			name:   "should kill a plugin which does not exit",
+			plugin: "deaf",
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ogre-exec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			plugin := filepath.Join(dir, io.plugin)
+			if err := ioutil.WriteFile(plugin, []byte("#!/bin/sh\n"+execPlugins[io.plugin]+"\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			p, err := NewExecBackend(ExecConfig{
+				Command: plugin,
+				Timeout: 200 * time.Millisecond,
+				Backoff: 10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			eb := p.(*ExecBackend)
+
+			start := time.Now()
+			assert.NoError(t, eb.Close())
+			assert.True(t, time.Since(start) < time.Second, "close took %s", time.Since(start))
+			// long enough for a restart, should there be one
+			time.Sleep(50 * time.Millisecond)
+
+			res := &health.ExecResult{Container: "/web", Exit: 1}
+			hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+			assert.Error(t, p.Send(msg.NewBackendMessage(hc, nil, res)))
+			assert.NoError(t, eb.Close())
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fileRotatedTimeFormat is appended to the path of rotated files, it sorts
+	// in the order the files were rotated.
+	fileRotatedTimeFormat = "20060102T150405.000000000"
+	// fileGzipExt is the extension of rotated files which were compressed.
+	fileGzipExt = ".gz"
+)
+
+// fileCSVHeader are the columns of every csv file, in the order of the values
+// of resultRecord.csv.
+var fileCSVHeader = []string{
+	"time", "check", "container", "container_id", "image", "host",
+	"exit", "passed", "duration_ms", "stdout", "stderr",
+}
+
+// FileBackend satisfies the Platform interface and is responsible for writing
+// health check results to a file of their own, one result per line as either
+// newline delimited JSON or CSV. The file is rotated once it reaches a size or
+// age, and the oldest rotated files are removed beyond a retention count.
+type FileBackend struct {
+	Path           string
+	Format         string
+	MaxBytes       int64
+	RotateInterval time.Duration
+	MaxFiles       int
+	Compress       bool
+
+	file   *os.File
+	size   int64
+	opened time.Time
+	mu     sync.Mutex
+}
+
+// FileConfig holds the values from the BackendConfig which are used to
+// establish a FileBackend.
+type FileConfig struct {
+	// Path is the file results are written to.
+	Path string
+	// Format is either 'json' (default) for newline delimited JSON or 'csv'.
+	Format string
+	// MaxBytes is the size the file is rotated at, RotateInterval is the age
+	// it is rotated at. The file is never rotated when both are zero.
+	MaxBytes       int64
+	RotateInterval time.Duration
+	// MaxFiles is the number of rotated files which are kept, all are kept
+	// when it is zero.
+	MaxFiles int
+	// Compress gzips files as they are rotated.
+	Compress bool
+}
+
+// resultRecord is a single result as it is written to the file, it is also
+// the payload published by the nats and mqtt backends.
+type resultRecord struct {
+	Time        time.Time `json:"time"`
+	Check       string    `json:"check"`
+	Container   string    `json:"container,omitempty"`
+	ContainerID string    `json:"container_id,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	Host        string    `json:"host,omitempty"`
+	Exit        int       `json:"exit"`
+	Passed      bool      `json:"passed"`
+	DurationMS  float64   `json:"duration_ms"`
+	StdOut      string    `json:"stdout,omitempty"`
+	StdErr      string    `json:"stderr,omitempty"`
+	TimedOut    bool      `json:"timed_out,omitempty"`
+}
+
+// NewFileBackend takes a FileConfig and returns a pointer to FileBackend which
+// satisfies the Platform interface, or an error should the file not be opened.
+func NewFileBackend(conf FileConfig) (Platform, error) {
+	fb := &FileBackend{
+		Path:           conf.Path,
+		Format:         conf.Format,
+		MaxBytes:       conf.MaxBytes,
+		RotateInterval: conf.RotateInterval,
+		MaxFiles:       conf.MaxFiles,
+		Compress:       conf.Compress,
+	}
+	if len(fb.Path) == 0 {
+		return nil, fmt.Errorf("file backend requires a path")
+	}
+	if len(fb.Format) == 0 {
+		fb.Format = "json"
+	}
+	if fb.Format != "json" && fb.Format != "csv" {
+		return nil, fmt.Errorf("file format must be json or csv, got %s", fb.Format)
+	}
+	if fb.MaxBytes < 0 || fb.RotateInterval < 0 || fb.MaxFiles < 0 {
+		return nil, fmt.Errorf("file max_bytes, rotate_interval and max_files cannot be negative")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fb.Path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory for file backend: %s", err)
+	}
+	if err := fb.open(); err != nil {
+		return nil, err
+	}
+
+	return fb, nil
+}
+
+// Send is the FileBackend implementation of the Platform interface Send
+// method. Send takes a Message and appends it to the file as a single line,
+// rotating the file first should it be due. An error is returned should the
+// line not be written.
+func (fb *FileBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	line, err := fb.format(newResultRecord(bem))
+	if err != nil {
+		return fmt.Errorf("could not format result for file: %s", err)
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.due(int64(len(line))) {
+		if err := fb.rotate(); err != nil {
+			log.Daemon.Errorf("could not rotate %s: %s", fb.Path, err)
+		}
+	}
+	if fb.file == nil {
+		if err := fb.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := fb.file.Write(line)
+	fb.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write result to %s: %s", fb.Path, err)
+	}
+	return nil
+}
+
+// Type is the FileBackend implementation of the Platform interface Type
+// and returns a PlatformType of type FileBackend.
+func (fb *FileBackend) Type() types.PlatformType {
+	return types.FileBackend
+}
+
+// newResultRecord returns the resultRecord of a BackendMessage.
+func newResultRecord(bem msg.BackendMessage) resultRecord {
+	rec := resultRecord{
+		Time:   time.Now(),
+		Check:  bem.CompletedCheck.String(),
+		Exit:   bem.Exit(),
+		Passed: bem.Passed(),
+	}
+	if bem.Data != nil {
+		if !bem.Data.Time.IsZero() {
+			rec.Time = bem.Data.Time
+		}
+		rec.Container = strings.TrimPrefix(bem.Data.Container, "/")
+		rec.ContainerID = bem.Data.ContainerID
+		rec.Image = bem.Data.Image
+		rec.Host = bem.Data.Hostname
+		rec.DurationMS = float64(bem.Data.Duration) / float64(time.Millisecond)
+		rec.StdOut = bem.Data.StdOut
+		rec.StdErr = bem.Data.StdErr
+		rec.TimedOut = bem.Data.TimedOut
+	}
+	return rec
+}
+
+// csv returns the values of the record in the order of fileCSVHeader.
+func (rec resultRecord) csv() []string {
+	return []string{
+		rec.Time.UTC().Format(time.RFC3339Nano),
+		rec.Check,
+		rec.Container,
+		rec.ContainerID,
+		rec.Image,
+		rec.Host,
+		strconv.Itoa(rec.Exit),
+		strconv.FormatBool(rec.Passed),
+		strconv.FormatFloat(rec.DurationMS, 'f', -1, 64),
+		rec.StdOut,
+		rec.StdErr,
+	}
+}
+
+// format returns the line of a record, terminated by a newline.
+func (fb *FileBackend) format(rec resultRecord) ([]byte, error) {
+	if fb.Format == "csv" {
+		return csvLine(rec.csv())
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// due reports whether the file must be rotated before a line of the size
+// passed is written. Callers are expected to hold the mutex.
+func (fb *FileBackend) due(next int64) bool {
+	if fb.file == nil {
+		return false
+	}
+	if fb.MaxBytes > 0 && fb.size > 0 && fb.size+next > fb.MaxBytes {
+		return true
+	}
+	return fb.RotateInterval > 0 && time.Since(fb.opened) >= fb.RotateInterval
+}
+
+// open opens the file for appending, writing the csv header should the file be
+// new. Callers are expected to hold the mutex once the backend is established.
+func (fb *FileBackend) open() error {
+	f, err := os.OpenFile(fb.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", fb.Path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not open %s: %s", fb.Path, err)
+	}
+	fb.file = f
+	fb.size = info.Size()
+	fb.opened = time.Now()
+
+	if fb.Format == "csv" && fb.size == 0 {
+		header, _ := csvLine(fileCSVHeader)
+		n, err := fb.file.Write(header)
+		fb.size += int64(n)
+		if err != nil {
+			return fmt.Errorf("could not write csv header to %s: %s", fb.Path, err)
+		}
+	}
+	return nil
+}
+
+// rotate moves the file aside, compressing it if configured, opens a new file
+// and removes the oldest rotated files beyond the retention count. Callers are
+// expected to hold the mutex.
+func (fb *FileBackend) rotate() error {
+	fb.file.Close()
+	fb.file = nil
+
+	rotated := fb.Path + "." + time.Now().UTC().Format(fileRotatedTimeFormat)
+	if err := os.Rename(fb.Path, rotated); err != nil {
+		return err
+	}
+	if err := fb.open(); err != nil {
+		return err
+	}
+
+	if fb.Compress {
+		if err := gzipFile(rotated); err != nil {
+			log.Daemon.Errorf("could not compress %s: %s", rotated, err)
+		}
+	}
+	return fb.prune()
+}
+
+// prune removes the oldest rotated files beyond the retention count.
+func (fb *FileBackend) prune() error {
+	if fb.MaxFiles <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(fb.Path + ".*")
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, fb.Path+"."), fileGzipExt)
+		if _, err := time.Parse(fileRotatedTimeFormat, stamp); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	if len(rotated) <= fb.MaxFiles {
+		return nil
+	}
+
+	sort.Strings(rotated)
+	for _, old := range rotated[:len(rotated)-fb.MaxFiles] {
+		if err := os.Remove(old); err != nil {
+			log.Daemon.Errorf("could not remove rotated file %s: %s", old, err)
+		}
+	}
+	return nil
+}
+
+// csvLine encodes a single csv record terminated by a newline.
+func csvLine(values []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(values); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// gzipFile compresses a file alongside itself with the gzip extension and
+// removes the original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+fileGzipExt, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		zw.Close()
+		out.Close()
+		os.Remove(path + fileGzipExt)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + fileGzipExt)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + fileGzipExt)
+		return err
+	}
+	return os.Remove(path)
+}
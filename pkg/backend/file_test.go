@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileBackend_Send(t *testing.T) {
+	testIO := []struct {
+		name     string
+		conf     FileConfig
+		sends    int
+		expFiles int
+		expExt   string
+		expFirst string
+	}{
+		{
+			name:     "should write a json line per result",
+			conf:     FileConfig{},
+			sends:    3,
+			expFiles: 1,
+			expFirst: `{"time":`,
+		},
+		{
+			name:     "should write a csv header before the results",
+			conf:     FileConfig{Format: "csv"},
+			sends:    3,
+			expFiles: 1,
+			expFirst: strings.Join(fileCSVHeader, ","),
+		},
+		{
+			name:     "should rotate at the max size and keep max files",
+			conf:     FileConfig{MaxBytes: 1, MaxFiles: 2},
+			sends:    5,
+			expFiles: 3,
+			expFirst: `{"time":`,
+		},
+		{
+			name:     "should compress rotated files",
+			conf:     FileConfig{MaxBytes: 1, Compress: true},
+			sends:    2,
+			expFiles: 2,
+			expExt:   fileGzipExt,
+			expFirst: `{"time":`,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ogre-file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			io.conf.Path = filepath.Join(dir, "results.log")
+			p, err := NewFileBackend(io.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < io.sends; i++ {
+				res := &health.ExecResult{Container: "/web", Exit: i}
+				hc := &health.DockerHealthCheck{Name: "foo", Result: res}
+				assert.NoError(t, p.Send(msg.NewBackendMessage(hc, nil, res)))
+			}
+
+			files, _ := filepath.Glob(io.conf.Path + "*")
+			assert.Len(t, files, io.expFiles)
+			if len(io.expExt) > 0 {
+				for _, f := range files {
+					if f != io.conf.Path {
+						assert.True(t, strings.HasSuffix(f, io.expExt), f)
+					}
+				}
+			}
+
+			data, err := ioutil.ReadFile(io.conf.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, strings.HasPrefix(string(data), io.expFirst), string(data))
+		})
+	}
+}
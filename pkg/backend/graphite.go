@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// graphiteDialTimeout is the amount of time we are willing to wait on a carbon
+// relay or cache to accept a connection before giving up on a send.
+const graphiteDialTimeout = 5 * time.Second
+
+// GraphiteBackend satisfies the Platform interface and is responsible for the
+// sending of health check results to a carbon relay or cache using the graphite
+// plaintext protocol, i.e. 'prefix.container.check value timestamp'.
+type GraphiteBackend struct {
+	Network string
+	Address string
+	Prefix  string
+
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// NewGraphiteBackend takes three strings, an address, a prefix and a protocol
+// which can be either 'tcp' or 'udp', and returns a pointer to GraphiteBackend
+// which satisfies the Platform interface, or an error. Should no protocol be
+// provided the default is tcp as that is what carbon listens on out of the box.
+// The connection is established here so a misconfigured address is reported
+// when the daemon starts rather than on the first health check.
+func NewGraphiteBackend(addr, prefix, protocol string) (Platform, error) {
+	gb := &GraphiteBackend{
+		Network: protocol,
+		Address: addr,
+		Prefix:  strings.Trim(prefix, "."),
+	}
+	if len(gb.Network) == 0 {
+		gb.Network = "tcp"
+	}
+	if gb.Network != "tcp" && gb.Network != "udp" {
+		return nil, fmt.Errorf("graphite protocol must be tcp or udp, got %s", gb.Network)
+	}
+
+	if err := gb.connect(); err != nil {
+		return nil, err
+	}
+
+	return gb, nil
+}
+
+// Send is the GraphiteBackend implementation of the Platform interface Send
+// method. Send takes a Message and writes a single plaintext line with the exit
+// code of the health check as the value. Should the write fail, the connection
+// is re-established and the write is attempted once more before an error is
+// returned.
+func (gb *GraphiteBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	line := gb.format(bem, bem.Time())
+	log.Daemon.Tracef("graphite backend sending %q", line)
+
+	gb.mu.Lock()
+	defer gb.mu.Unlock()
+
+	if gb.conn != nil {
+		_, err := gb.conn.Write([]byte(line))
+		if err == nil {
+			return nil
+		}
+		log.Daemon.Infof("graphite write to %s failed, reconnecting: %s", gb.Address, err)
+	}
+
+	// the connection was either never established or has gone away, carbon
+	// restarts are common enough that we always try again before giving up
+	if err := gb.connect(); err != nil {
+		return fmt.Errorf("could not reconnect to graphite: %s", err)
+	}
+	if _, err := gb.conn.Write([]byte(line)); err != nil {
+		gb.close()
+		return fmt.Errorf("could not send message for graphite: %s", err)
+	}
+
+	return nil
+}
+
+// Type is the GraphiteBackend implementation of the Platform interface Type
+// and returns a PlatformType of type GraphiteBackend.
+func (gb *GraphiteBackend) Type() types.PlatformType {
+	return types.GraphiteBackend
+}
+
+// format builds the plaintext protocol line for a BackendMessage. The metric
+// path is made up of the optional prefix, the container name and the check
+// name, the value is the exit code and the timestamp is in epoch seconds.
+func (gb *GraphiteBackend) format(bem msg.BackendMessage, ts time.Time) string {
+	var path []string
+	if len(gb.Prefix) > 0 {
+		path = append(path, gb.Prefix)
+	}
+	if bem.Data != nil && len(bem.Data.Container) > 0 {
+		path = append(path, graphiteNode(bem.Data.Container))
+	}
+	path = append(path, graphiteCheck(bem.CompletedCheck.String()))
+
+	return fmt.Sprintf("%s %d %d\n", strings.Join(path, "."), bem.Exit(), ts.Unix())
+}
+
+// connect closes any existing connection and dials the configured address.
+// Callers are expected to hold the mutex.
+func (gb *GraphiteBackend) connect() error {
+	gb.close()
+	conn, err := net.DialTimeout(gb.Network, gb.Address, graphiteDialTimeout)
+	if err != nil {
+		return err
+	}
+	gb.conn = conn
+	return nil
+}
+
+// close tears down the connection if there is one. Callers are expected to
+// hold the mutex.
+func (gb *GraphiteBackend) close() {
+	if gb.conn != nil {
+		gb.conn.Close()
+		gb.conn = nil
+	}
+}
+
+// graphiteNode replaces the characters which have meaning in a graphite metric
+// path so that a value, i.e. a Docker container name '/foo.bar', makes up only
+// a single node of the path.
+func graphiteNode(s string) string {
+	s = strings.TrimPrefix(s, "/")
+	return strings.NewReplacer(".", "_", " ", "_", "/", "_").Replace(s)
+}
+
+// graphiteCheck is like graphiteNode but preserves the dots of a check name
+// as those are the separators used when a check is formatted for graphite.
+func graphiteCheck(s string) string {
+	return strings.NewReplacer(" ", "_", "/", "_").Replace(s)
+}
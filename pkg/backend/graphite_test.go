@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func graphiteResult(name string, res *health.ExecResult) msg.BackendMessage {
+	hc := &health.DockerHealthCheck{Name: name, Result: res}
+	return msg.NewBackendMessage(hc, nil, res).(msg.BackendMessage)
+}
+
+func TestGraphiteBackend_format(t *testing.T) {
+	ts := time.Unix(1591026304, 0)
+	testIO := []struct {
+		name   string
+		prefix string
+		bem    msg.BackendMessage
+		exp    string
+	}{
+		{
+			name:   "should write the prefix, container and check",
+			prefix: "ogre",
+			bem:    graphiteResult("https_open", &health.ExecResult{Container: "/web", Exit: 1}),
+			exp:    "ogre.web.https_open 1 1591026304\n",
+		},
+		{
+			name: "should leave out an empty prefix",
+			bem:  graphiteResult("https_open", &health.ExecResult{Container: "/web", Exit: 0}),
+			exp:  "web.https_open 0 1591026304\n",
+		},
+		{
+			name: "should leave out a missing container",
+			bem:  graphiteResult("https_open", &health.ExecResult{Exit: 2}),
+			exp:  "https_open 2 1591026304\n",
+		},
+		{
+			name:   "should keep the container to a single node",
+			prefix: "ogre",
+			bem:    graphiteResult("https_open", &health.ExecResult{Container: "/web.v2 blue/green", Exit: 0}),
+			exp:    "ogre.web_v2_blue_green.https_open 0 1591026304\n",
+		},
+		{
+			name:   "should keep the dots of the check",
+			prefix: "ogre",
+			bem:    graphiteResult("db.replica lag/sec", &health.ExecResult{Container: "/pg", Exit: 0}),
+			exp:    "ogre.pg.db.replica_lag_sec 0 1591026304\n",
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			gb := &GraphiteBackend{Prefix: io.prefix}
+			assert.Equal(t, io.exp, gb.format(io.bem, ts))
+		})
+	}
+}
+
+func TestGraphiteBackend_Send(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p, err := NewGraphiteBackend(conn.LocalAddr().String(), ".ogre.", "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a result replayed from a spool is sent as of its run
+	res := &health.ExecResult{Container: "/web", Exit: 1, Time: time.Unix(1591026304, 0)}
+	assert.NoError(t, p.Send(graphiteResult("https_open", res)))
+
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ogre.web.https_open 1 1591026304\n", string(buf[:n]))
+}
@@ -2,61 +2,294 @@ package backend
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/ideal-co/ogre/pkg/log"
 	msg "github.com/ideal-co/ogre/pkg/message"
 	"github.com/ideal-co/ogre/pkg/types"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
+	"text/template"
+	"time"
 )
 
+const (
+	// httpDefaultTimeout bounds each request when no timeout is configured.
+	httpDefaultTimeout = 10 * time.Second
+	// httpDefaultRetries is how many times a failed request is retried when
+	// the number of retries is not configured.
+	httpDefaultRetries = 3
+	// httpDefaultBackoff is the wait before the first retry, doubling for
+	// each retry after it.
+	httpDefaultBackoff = 500 * time.Millisecond
+	// httpDefaultMaxBackoff caps the wait between retries.
+	httpDefaultMaxBackoff = 30 * time.Second
+	// httpDefaultContentType is the content type of the serialized message
+	// and of rendered templates when no content type is configured.
+	httpDefaultContentType = "application/json"
+)
+
+// templateFuncs are the functions available to payload templates, json
+// encodes a value so output can be safely embedded in a JSON payload.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
 // HTTPBackend satisfies the Platform interface and is responsible for sending
 // health check results to an arbitrary HTTP endpoint capable of handling POST
-// requests.
+// requests. Requests which fail, or which are answered with a server error,
+// are retried with an exponential backoff.
 type HTTPBackend struct {
-	Client *http.Client
-	URL    *url.URL
+	// Name is the name of the backend, which its delivery failures are
+	// counted under
+	Name       string
+	Client     *http.Client
+	URL        *url.URL
+	Format     string
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Header is sent with every request and holds any static headers as well
+	// as the Authorization header
+	Header http.Header
+
+	// Template renders the request body in place of the serialized message
+	// when set, states track the check states it may refer to
+	Template    *template.Template
+	ContentType string
+	states      *stateTracker
+}
+
+// templateData is what the payload template of an HTTPBackend is rendered
+// against.
+type templateData struct {
+	Check       string
+	Container   string
+	ContainerID string
+	Image       string
+	Host        string
+	Exit        int
+	Passed      bool
+	StdOut      string
+	StdErr      string
+	Duration    time.Duration
+	Time        time.Time
+	// TimedOut is true when the check was killed for running past its
+	// timeout, its exit is then 124
+	TimedOut bool
+	// State is either 'passing' or 'failing', PreviousState is empty for the
+	// first result of a check and Changed is true when the two differ
+	State         string
+	PreviousState string
+	Changed       bool
+}
+
+// newTemplateData returns the templateData of a BackendMessage, without the
+// state of the check which only backends tracking it can fill in.
+func newTemplateData(bem msg.BackendMessage) templateData {
+	td := templateData{
+		Check:  bem.CompletedCheck.String(),
+		Exit:   bem.Exit(),
+		Passed: bem.Passed(),
+		Time:   time.Now(),
+	}
+	if bem.Data != nil {
+		// a message replayed from a spool is rendered as of its check
+		if !bem.Data.Time.IsZero() {
+			td.Time = bem.Data.Time
+		}
+		td.Container = strings.TrimPrefix(bem.Data.Container, "/")
+		td.ContainerID = bem.Data.ContainerID
+		td.Image = bem.Data.Image
+		td.Host = bem.Data.Hostname
+		td.StdOut = bem.Data.StdOut
+		td.StdErr = bem.Data.StdErr
+		td.Duration = bem.Data.Duration
+		td.TimedOut = bem.Data.TimedOut
+	}
+	return td
+}
+
+// HTTPConfig holds the values from the BackendConfig which are used to
+// establish an HTTPBackend.
+type HTTPConfig struct {
+	// Name is the name the backend was configured with, defaulting to its
+	// type.
+	Name string
+	// Server is the address of either a local or remote HTTP server.
+	Server string
+	// Scheme is either 'http' (default) or 'https'.
+	Scheme string
+	// ResourcePath is the path requests are made to.
+	ResourcePath string
+	// Format can be used to set the content type of the request. At the
+	// moment, the only supported content type is in the form of
+	// application/json and is hard coded in the request.
 	Format string
+	// Timeout bounds each request, defaulting to 10s.
+	Timeout time.Duration
+	// Retries is how many times a failed request is retried, defaulting to 3.
+	// A negative value disables retries.
+	Retries int
+	// Backoff is the wait before the first retry, defaulting to 500ms, and
+	// MaxBackoff caps the wait between any two attempts, defaulting to 30s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// TLSCA is the path to a PEM encoded bundle of the CAs trusted to sign the
+	// server certificate, the system pool is used when empty.
+	TLSCA string
+	// TLSCert and TLSKey are the paths to a PEM encoded client certificate
+	// and key, presented to servers which require mutual TLS.
+	TLSCert string
+	TLSKey  string
+	// InsecureSkipVerify disables verification of the server certificate.
+	InsecureSkipVerify bool
+	// BearerToken is sent in the Authorization header, it may not be used with
+	// a Username and Password which are sent with basic auth.
+	BearerToken string
+	Username    string
+	Password    string
+	// Headers are added to every request.
+	Headers map[string]string
+	// Template is an inline text/template rendered as the request body, or
+	// TemplateFile the path to one. Only one of the two may be set.
+	Template     string
+	TemplateFile string
+	// ContentType of the request, defaulting to 'application/json'.
+	ContentType string
 }
 
-// NewHTTPBackend takes three strings, a server which is the address of either
-// a local or remote HTTP server. A path, representing the resource path by
-// which to address requests. And format, which can be used to set the content
-// type of the request. At the moment, the only supported content type is in
-// the form of application/json and is hard coded in the request. And error
-func NewHTTPBackend(server, path, format string) (Platform, error) {
+// NewHTTPBackend takes an HTTPConfig and returns a pointer to an HTTPBackend
+// which satisfies the Platform interface, or an error should the address not
+// be parsed or the TLS and authentication config be invalid.
+func NewHTTPBackend(conf HTTPConfig) (Platform, error) {
 	hb := &HTTPBackend{
-		Client: http.DefaultClient,
-		Format: format,
+		Name:       conf.Name,
+		Client:     &http.Client{Timeout: conf.Timeout},
+		Format:     conf.Format,
+		Retries:    conf.Retries,
+		Backoff:    conf.Backoff,
+		MaxBackoff: conf.MaxBackoff,
+		Header:     make(http.Header),
+
+		ContentType: conf.ContentType,
+		states:      newStateTracker(),
+	}
+	if len(hb.Name) == 0 {
+		hb.Name = string(types.HTTPBackend)
+	}
+	if len(hb.ContentType) == 0 {
+		hb.ContentType = httpDefaultContentType
+	}
+	if hb.Client.Timeout == 0 {
+		hb.Client.Timeout = httpDefaultTimeout
+	}
+	if hb.Retries == 0 {
+		hb.Retries = httpDefaultRetries
+	} else if hb.Retries < 0 {
+		hb.Retries = 0
+	}
+	if hb.Backoff == 0 {
+		hb.Backoff = httpDefaultBackoff
+	}
+	if hb.MaxBackoff == 0 {
+		hb.MaxBackoff = httpDefaultMaxBackoff
+	}
+
+	scheme := conf.Scheme
+	if len(scheme) == 0 {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("http scheme must be http or https, got %s", scheme)
 	}
 
 	// ensure the url is acceptable and can be parsed
-	addr, err := url.Parse("http://" + server + path)
+	addr, err := url.Parse(scheme + "://" + conf.Server + conf.ResourcePath)
 	if err != nil {
 		return nil, err
 	}
 	hb.URL = addr
 
+	tlsConf, err := newClientTLSConfig(conf.TLSCA, conf.TLSCert, conf.TLSKey, conf.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConf
+		hb.Client.Transport = transport
+	}
+
+	tmpl, err := parsePayloadTemplate(conf.Template, conf.TemplateFile)
+	if err != nil {
+		return nil, err
+	}
+	hb.Template = tmpl
+
+	for k, v := range conf.Headers {
+		hb.Header.Set(k, v)
+	}
+	auth, err := authorization(conf.BearerToken, conf.Username, conf.Password)
+	if err != nil {
+		return nil, err
+	}
+	if len(auth) > 0 {
+		hb.Header.Set("Authorization", auth)
+	}
+
 	return hb, nil
 }
 
 // Send HTTPBackend's implementation of the Platform interface Send method. Send
 // takes a Message, serializes it and makes a POST request to the configured HTTP
-// backend passed in the ogred config file. An error is returned if the Message
-// cannot be serialized or sent.
+// backend passed in the ogred config file, or renders the configured template
+// as the request body. Failed requests are retried and an error is returned if
+// the Message cannot be serialized, or could not be delivered once the retries
+// are exhausted.
 func (hb *HTTPBackend) Send(m msg.Message) error {
 	bem := m.(msg.BackendMessage)
-	data, err := bem.Serialize()
+	data, trans, err := hb.payload(bem)
 	if err != nil {
-		return fmt.Errorf("could not serialize message for http: %s", err)
+		return err
 	}
-	resp, err := hb.Client.Post(hb.URL.String(), "application/json", bytes.NewBuffer(data))
-	if err != nil {
-		return fmt.Errorf("could not send message for http: %s", err)
+
+	for attempt := 0; ; attempt++ {
+		retry, err := hb.post(data)
+		if err == nil {
+			// the state is only recorded once delivered so a message which
+			// is retried later is rendered with the same transition
+			if trans != nil {
+				hb.states.record(*trans)
+			}
+			return nil
+		}
+		if !retry || attempt >= hb.Retries {
+			deliveryFailures.WithLabelValues(hb.Name).Inc()
+			return fmt.Errorf("could not send message for http after %d attempt(s): %s", attempt+1, err)
+		}
+
+		wait := hb.backoff(attempt)
+		log.Daemon.Warnf("http backend attempt %d failed, retrying in %s: %s", attempt+1, wait, err)
+		time.Sleep(wait)
 	}
+}
 
-	log.Daemon.Tracef("HTTP backend response %v", resp)
-	return nil
+// ContainerStopped is the HTTPBackend implementation of the ContainerStopper
+// interface and forgets the states of the checks of the container.
+func (hb *HTTPBackend) ContainerStopped(containerID string) {
+	hb.states.forget(containerID)
 }
 
 // Type is the HTTPBackend implementation of the Platform interface Type
@@ -64,3 +297,153 @@ func (hb *HTTPBackend) Send(m msg.Message) error {
 func (hb *HTTPBackend) Type() types.PlatformType {
 	return types.HTTPBackend
 }
+
+// payload returns the request body for a BackendMessage, the serialized
+// message unless a template is configured. A rendered template also returns the
+// state transition of the check, which is to be recorded once it is delivered.
+func (hb *HTTPBackend) payload(bem msg.BackendMessage) ([]byte, *stateTransition, error) {
+	if hb.Template == nil {
+		data, err := bem.Serialize()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not serialize message for http: %s", err)
+		}
+		return data, nil, nil
+	}
+
+	td := newTemplateData(bem)
+	trans := hb.states.transition(td.ContainerID, td.Check, td.Passed)
+	td.State = trans.Current
+	td.PreviousState = trans.Previous
+	td.Changed = trans.Changed()
+
+	var buf bytes.Buffer
+	if err := hb.Template.Execute(&buf, td); err != nil {
+		return nil, nil, fmt.Errorf("could not render template for http: %s", err)
+	}
+	return buf.Bytes(), &trans, nil
+}
+
+// post makes a single request with the payload and reports whether a failure
+// is worth retrying. Transport errors, server errors and 429s are retried,
+// any other non 2xx response is not expected to succeed on a second attempt.
+func (hb *HTTPBackend) post(data []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, hb.URL.String(), bytes.NewBuffer(data))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range hb.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", hb.ContentType)
+
+	resp, err := hb.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	log.Daemon.Tracef("HTTP backend response %v", resp)
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		// drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		return false, nil
+	}
+
+	err = fmt.Errorf("http backend returned %s", resp.Status)
+	if body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512)); len(bytes.TrimSpace(body)) > 0 {
+		err = fmt.Errorf("%s: %s", err, strings.TrimSpace(string(body)))
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// backoff returns the wait before the retry following the attempt passed, the
+// wait doubles for each attempt up to the max with up to half of it jittered
+// so that many containers failing together do not retry in lockstep.
+func (hb *HTTPBackend) backoff(attempt int) time.Duration {
+	wait := hb.Backoff
+	for i := 0; i < attempt && wait < hb.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > hb.MaxBackoff {
+		wait = hb.MaxBackoff
+	}
+	half := int64(wait / 2)
+	if half <= 0 {
+		return wait
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// newClientTLSConfig returns the tls.Config of a client trusting the CAs in
+// the bundle passed and presenting the certificate and key passed, or nil if
+// there is nothing to configure and the defaults should be used.
+func newClientTLSConfig(ca, cert, key string, insecure bool) (*tls.Config, error) {
+	if len(ca) == 0 && len(cert) == 0 && len(key) == 0 && !insecure {
+		return nil, nil
+	}
+	if (len(cert) > 0) != (len(key) > 0) {
+		return nil, fmt.Errorf("tls_cert and tls_key must be provided together")
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: insecure}
+	if len(ca) > 0 {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("could not read tls_ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("could not find any certificates in tls_ca %s", ca)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if len(cert) > 0 {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load tls_cert and tls_key: %s", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{pair}
+	}
+
+	return tlsConf, nil
+}
+
+// parsePayloadTemplate parses either an inline template or the template file,
+// returning nil when neither is set.
+func parsePayloadTemplate(inline, file string) (*template.Template, error) {
+	switch {
+	case len(inline) > 0 && len(file) > 0:
+		return nil, fmt.Errorf("only one of template and template_file may be set")
+	case len(file) > 0:
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read template_file: %s", err)
+		}
+		inline = string(b)
+	case len(inline) == 0:
+		return nil, nil
+	}
+
+	tmpl, err := template.New("payload").Funcs(templateFuncs).Option("missingkey=error").Parse(inline)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse template: %s", err)
+	}
+	return tmpl, nil
+}
+
+// authorization returns the value of the Authorization header for either a
+// bearer token or basic auth credentials, or an empty string if neither is
+// set. An error is returned should both be set.
+func authorization(bearerToken, username, password string) (string, error) {
+	hasBasic := len(username) > 0 || len(password) > 0
+	switch {
+	case len(bearerToken) > 0 && hasBasic:
+		return "", fmt.Errorf("bearer_token cannot be used with username and password")
+	case len(bearerToken) > 0:
+		return "Bearer " + bearerToken, nil
+	case hasBasic:
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,405 @@
+package backend
+
+import (
+	"encoding/pem"
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewTemplateData(t *testing.T) {
+	checked := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	testIO := []struct {
+		name    string
+		res     *health.ExecResult
+		expTime func(time.Time) bool
+	}{
+		{
+			name: "should use the time of the check",
+			res:  &health.ExecResult{Container: "/web", Exit: 1, Time: checked},
+			expTime: func(tm time.Time) bool {
+				return tm.Equal(checked)
+			},
+		},
+		{
+			name: "should use the current time when the check has none",
+			res:  &health.ExecResult{Container: "/web", Exit: 1},
+			expTime: func(tm time.Time) bool {
+				return time.Since(tm) < time.Minute
+			},
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			hc := &health.DockerHealthCheck{Name: "https_open"}
+			td := newTemplateData(msg.NewBackendMessage(hc, nil, io.res).(msg.BackendMessage))
+			assert.True(t, io.expTime(td.Time), "unexpected time %s", td.Time)
+			assert.Equal(t, "web", td.Container)
+			assert.Equal(t, 1, td.Exit)
+			assert.False(t, td.Passed)
+		})
+	}
+}
+
+// httpStandIn answers each request with the next of its statuses, repeating
+// the last, and records the requests made to it.
+type httpStandIn struct {
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+	mu       sync.Mutex
+}
+
+func (hs *httpStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	status := http.StatusOK
+	if len(hs.statuses) > 0 {
+		status = hs.statuses[0]
+		if len(hs.statuses) > 1 {
+			hs.statuses = hs.statuses[1:]
+		}
+	}
+	hs.requests = append(hs.requests, r)
+	hs.bodies = append(hs.bodies, string(body))
+	w.WriteHeader(status)
+}
+
+func (hs *httpStandIn) received() ([]*http.Request, []string) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.requests, hs.bodies
+}
+
+func httpResult(exit int) msg.Message {
+	res := &health.ExecResult{Container: "/web", ContainerID: "abc123", Exit: exit, Time: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)}
+	hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+	return msg.NewBackendMessage(hc, nil, res)
+}
+
+func TestHTTPBackend_template(t *testing.T) {
+	standIn := &httpStandIn{}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	p, err := NewHTTPBackend(HTTPConfig{
+		Server:      strings.TrimPrefix(srv.URL, "http://"),
+		ContentType: "text/plain",
+		Template: `{"check":{{json .Check}},"container":{{json .Container}},"exit":{{.Exit}},` +
+			`"state":"{{.State}}","previous":"{{.PreviousState}}","changed":{{.Changed}},` +
+			`"time":"{{.Time.Format "2006-01-02T15:04:05Z07:00"}}"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, exit := range []int{0, 1, 1, 0} {
+		assert.NoError(t, p.Send(httpResult(exit)))
+	}
+
+	requests, bodies := standIn.received()
+	assert.Equal(t, []string{
+		`{"check":"https_open","container":"web","exit":0,"state":"passing","previous":"","changed":false,"time":"2020-06-01T12:00:00Z"}`,
+		`{"check":"https_open","container":"web","exit":1,"state":"failing","previous":"passing","changed":true,"time":"2020-06-01T12:00:00Z"}`,
+		`{"check":"https_open","container":"web","exit":1,"state":"failing","previous":"failing","changed":false,"time":"2020-06-01T12:00:00Z"}`,
+		`{"check":"https_open","container":"web","exit":0,"state":"passing","previous":"failing","changed":true,"time":"2020-06-01T12:00:00Z"}`,
+	}, bodies)
+	for _, r := range requests {
+		assert.Equal(t, "text/plain", r.Header.Get("Content-Type"))
+	}
+}
+
+func TestHTTPBackend_templateUndelivered(t *testing.T) {
+	// the change to failing is rejected the first time it is sent
+	standIn := &httpStandIn{statuses: []int{http.StatusOK, http.StatusBadRequest, http.StatusOK}}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	p, err := NewHTTPBackend(HTTPConfig{
+		Server:   strings.TrimPrefix(srv.URL, "http://"),
+		Template: `{"state":"{{.State}}","previous":"{{.PreviousState}}","changed":{{.Changed}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, p.Send(httpResult(0)))
+	failing := httpResult(1)
+	assert.Error(t, p.Send(failing))
+	// as the queue would, once the backend is back
+	assert.NoError(t, p.Send(failing))
+
+	_, bodies := standIn.received()
+	assert.Equal(t, []string{
+		`{"state":"passing","previous":"","changed":false}`,
+		`{"state":"failing","previous":"passing","changed":true}`,
+		`{"state":"failing","previous":"passing","changed":true}`,
+	}, bodies)
+}
+
+func TestParsePayloadTemplate(t *testing.T) {
+	testIO := []struct {
+		name   string
+		inline string
+		file   string
+		expNil bool
+		expErr bool
+	}{
+		{
+			name:   "should return no template when none is configured",
+			expNil: true,
+		},
+		{
+			name:   "should parse an inline template",
+			inline: `{{json .Check}}`,
+		},
+		{
+			name:   "should not allow both an inline template and a file",
+			inline: `{{json .Check}}`,
+			file:   "payload.tmpl",
+			expErr: true,
+		},
+		{
+			name:   "should fail on a template which does not parse",
+			inline: `{{json .Check}`,
+			expErr: true,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			tmpl, err := parsePayloadTemplate(io.inline, io.file)
+			assert.Equal(t, io.expErr, err != nil, "unexpected error %v", err)
+			assert.Equal(t, io.expNil || io.expErr, tmpl == nil)
+		})
+	}
+}
+
+func TestHTTPBackend_retries(t *testing.T) {
+	testIO := []struct {
+		name        string
+		statuses    []int
+		retries     int
+		expAttempts int
+		expErr      bool
+	}{
+		{
+			name:        "should not retry a success",
+			statuses:    []int{http.StatusNoContent},
+			expAttempts: 1,
+		},
+		{
+			name:        "should retry a server error",
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusOK},
+			expAttempts: 2,
+		},
+		{
+			name:        "should retry when rate limited",
+			statuses:    []int{http.StatusTooManyRequests, http.StatusOK},
+			expAttempts: 2,
+		},
+		{
+			name:        "should not retry a client error",
+			statuses:    []int{http.StatusBadRequest},
+			expAttempts: 1,
+			expErr:      true,
+		},
+		{
+			name:        "should give up once the retries are exhausted",
+			statuses:    []int{http.StatusInternalServerError},
+			retries:     2,
+			expAttempts: 3,
+			expErr:      true,
+		},
+		{
+			name:        "should not retry when retries are disabled",
+			statuses:    []int{http.StatusInternalServerError},
+			retries:     -1,
+			expAttempts: 1,
+			expErr:      true,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			standIn := &httpStandIn{statuses: io.statuses}
+			srv := httptest.NewServer(standIn)
+			defer srv.Close()
+
+			p, err := NewHTTPBackend(HTTPConfig{
+				Server:  strings.TrimPrefix(srv.URL, "http://"),
+				Retries: io.retries,
+				Backoff: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Send(httpResult(1))
+			assert.Equal(t, io.expErr, err != nil, "unexpected error %v", err)
+			requests, _ := standIn.received()
+			assert.Len(t, requests, io.expAttempts)
+		})
+	}
+}
+
+func TestHTTPBackend_backoff(t *testing.T) {
+	hb := &HTTPBackend{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	testIO := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{attempt: 0, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{attempt: 1, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{attempt: 2, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{attempt: 10, min: 500 * time.Millisecond, max: time.Second},
+	}
+	for _, io := range testIO {
+		for i := 0; i < 20; i++ {
+			wait := hb.backoff(io.attempt)
+			assert.True(t, wait >= io.min && wait <= io.max, "attempt %d waited %s", io.attempt, wait)
+		}
+	}
+}
+
+func TestHTTPBackend_headers(t *testing.T) {
+	testIO := []struct {
+		name    string
+		conf    HTTPConfig
+		expAuth string
+		expErr  bool
+	}{
+		{
+			name: "should send no authorization by default",
+		},
+		{
+			name:    "should send a bearer token",
+			conf:    HTTPConfig{BearerToken: "s3cr3t"},
+			expAuth: "Bearer s3cr3t",
+		},
+		{
+			name:    "should send basic auth",
+			conf:    HTTPConfig{Username: "ogre", Password: "p4ss"},
+			expAuth: "Basic b2dyZTpwNHNz",
+		},
+		{
+			name:    "should let the credentials win over a static authorization header",
+			conf:    HTTPConfig{BearerToken: "s3cr3t", Headers: map[string]string{"Authorization": "Bearer static"}},
+			expAuth: "Bearer s3cr3t",
+		},
+		{
+			name:   "should not allow a bearer token with basic auth",
+			conf:   HTTPConfig{BearerToken: "s3cr3t", Username: "ogre"},
+			expErr: true,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			standIn := &httpStandIn{}
+			srv := httptest.NewServer(standIn)
+			defer srv.Close()
+
+			conf := io.conf
+			conf.Server = strings.TrimPrefix(srv.URL, "http://")
+			conf.Headers = map[string]string{"x-tenant": "blue"}
+			for k, v := range io.conf.Headers {
+				conf.Headers[k] = v
+			}
+			p, err := NewHTTPBackend(conf)
+			if io.expErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, p.Send(httpResult(0)))
+
+			requests, _ := standIn.received()
+			if !assert.Len(t, requests, 1) {
+				return
+			}
+			assert.Equal(t, io.expAuth, requests[0].Header.Get("Authorization"))
+			assert.Equal(t, httpDefaultContentType, requests[0].Header.Get("Content-Type"))
+			assert.Equal(t, "blue", requests[0].Header.Get("X-Tenant"))
+		})
+	}
+}
+
+func TestHTTPBackend_tls(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "ogre-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testIO := []struct {
+		name   string
+		conf   HTTPConfig
+		expErr bool
+	}{
+		{
+			name:   "should not trust an unknown server certificate",
+			conf:   HTTPConfig{Scheme: "https"},
+			expErr: true,
+		},
+		{
+			name: "should trust a server certificate signed by the ca",
+			conf: HTTPConfig{Scheme: "https", TLSCA: ca},
+		},
+		{
+			name: "should skip verification when asked to",
+			conf: HTTPConfig{Scheme: "https", InsecureSkipVerify: true},
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			conf := io.conf
+			conf.Server = strings.TrimPrefix(srv.URL, "https://")
+			conf.Retries = -1
+			p, err := NewHTTPBackend(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Send(httpResult(0))
+			assert.Equal(t, io.expErr, err != nil, "unexpected error %v", err)
+		})
+	}
+}
+
+func TestHTTPBackend_deliveryFailures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	p, err := NewHTTPBackend(HTTPConfig{
+		Name:    "audit",
+		Server:  strings.TrimPrefix(srv.URL, "http://"),
+		Retries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(deliveryFailures.WithLabelValues("audit"))
+
+	res := &health.ExecResult{Container: "/web", Exit: 1}
+	hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+	assert.Error(t, p.Send(msg.NewBackendMessage(hc, nil, res)))
+	assert.Equal(t, before+1, testutil.ToFloat64(deliveryFailures.WithLabelValues("audit")))
+}
@@ -0,0 +1,229 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxDefaultMeasurement is the measurement name used for health check
+// results when one is not provided with the backend's metric config.
+const influxDefaultMeasurement = "ogre_check"
+
+// InfluxBackend satisfies the Platform interface and is responsible for the
+// sending of health check results to an InfluxDB instance in line protocol,
+// either to the v1 or v2 HTTP write endpoint or to a UDP listener. Unlike the
+// statsd backend, the container name, hostname and check name are written as
+// tags so results can be grouped by any of them.
+type InfluxBackend struct {
+	Measurement string
+
+	// http(s) writes
+	Client *http.Client
+	URL    *url.URL
+	Token  string
+
+	// udp writes
+	Conn net.Conn
+}
+
+// InfluxConfig holds the values from the BackendConfig which are used to
+// establish an InfluxBackend.
+type InfluxConfig struct {
+	// Server is the address of the InfluxDB instance or UDP listener.
+	Server string
+	// Protocol is one of 'http' (default), 'https' or 'udp'.
+	Protocol string
+	// Measurement is the line protocol measurement name.
+	Measurement string
+	// Database selects the v1 write endpoint, /write?db=database.
+	Database string
+	// Org and Bucket select the v2 write endpoint, /api/v2/write.
+	Org    string
+	Bucket string
+	// Token is sent in the Authorization header of v2 requests.
+	Token string
+	// ResourcePath overrides the write endpoint path.
+	ResourcePath string
+}
+
+// NewInfluxBackend takes an InfluxConfig and returns a pointer to InfluxBackend
+// which satisfies the Platform interface, or an error. Should a bucket be
+// configured the v2 API is used, otherwise writes go to the v1 API for the
+// configured database.
+func NewInfluxBackend(conf InfluxConfig) (Platform, error) {
+	ib := &InfluxBackend{
+		Measurement: conf.Measurement,
+		Token:       conf.Token,
+	}
+	if len(ib.Measurement) == 0 {
+		ib.Measurement = influxDefaultMeasurement
+	}
+
+	switch conf.Protocol {
+	case "udp":
+		conn, err := net.Dial("udp", conf.Server)
+		if err != nil {
+			return nil, err
+		}
+		ib.Conn = conn
+	case "", "http", "https":
+		scheme := conf.Protocol
+		if len(scheme) == 0 {
+			scheme = "http"
+		}
+		addr, err := influxWriteURL(scheme, conf)
+		if err != nil {
+			return nil, err
+		}
+		ib.URL = addr
+		ib.Client = &http.Client{Timeout: 10 * time.Second}
+	default:
+		return nil, fmt.Errorf("influx protocol must be http, https or udp, got %s", conf.Protocol)
+	}
+
+	return ib, nil
+}
+
+// Send is the InfluxBackend implementation of the Platform interface Send
+// method. Send takes a Message and writes a single point with the exit code
+// and duration of the health check as fields. An error is returned should the
+// point not be accepted.
+func (ib *InfluxBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	return ib.write(ib.format(bem, time.Now()))
+}
+
+// SendBatch is the InfluxBackend implementation of the BatchClient interface.
+// SendBatch takes many Messages and writes all of their points at once.
+func (ib *InfluxBackend) SendBatch(ms []msg.Message) error {
+	now := time.Now()
+	var b strings.Builder
+	for _, m := range ms {
+		b.WriteString(ib.format(m.(msg.BackendMessage), now))
+	}
+	return ib.write(b.String())
+}
+
+// write sends one or more newline terminated points to InfluxDB.
+func (ib *InfluxBackend) write(line string) error {
+	log.Daemon.Tracef("influx backend sending %q", line)
+
+	if ib.Conn != nil {
+		if _, err := ib.Conn.Write([]byte(line)); err != nil {
+			return fmt.Errorf("could not send message for influx: %s", err)
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ib.URL.String(), bytes.NewBufferString(line))
+	if err != nil {
+		return fmt.Errorf("could not create request for influx: %s", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(ib.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+ib.Token)
+	}
+
+	resp, err := ib.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send message for influx: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influx write returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// Type is the InfluxBackend implementation of the Platform interface Type
+// and returns a PlatformType of type InfluxBackend.
+func (ib *InfluxBackend) Type() types.PlatformType {
+	return types.InfluxBackend
+}
+
+// format builds the line protocol point for a BackendMessage, i.e.
+// ogre_check,check=foo,container=bar,host=baz exit=1i,duration_ms=12.5 <ns>
+func (ib *InfluxBackend) format(bem msg.BackendMessage, ts time.Time) string {
+	var container, host string
+	var duration time.Duration
+	if bem.Data != nil {
+		container = strings.TrimPrefix(bem.Data.Container, "/")
+		host = bem.Data.Hostname
+		duration = bem.Data.Duration
+		// results which waited in a batch keep the time they were taken
+		if !bem.Data.Time.IsZero() {
+			ts = bem.Data.Time
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(influxEscape(ib.Measurement, false))
+	// tags are written sorted by key as recommended for write performance,
+	// empty tag values are not permitted so those are omitted
+	for _, tag := range [][2]string{
+		{"check", bem.CompletedCheck.String()},
+		{"container", container},
+		{"host", host},
+	} {
+		if len(tag[1]) == 0 {
+			continue
+		}
+		b.WriteString("," + tag[0] + "=" + influxEscape(tag[1], true))
+	}
+	b.WriteString(" exit=" + strconv.Itoa(bem.Exit()) + "i")
+	b.WriteString(",duration_ms=" + strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', -1, 64))
+	b.WriteString(" " + strconv.FormatInt(ts.UnixNano(), 10) + "\n")
+
+	return b.String()
+}
+
+// influxWriteURL returns the v1 or v2 write endpoint for the configuration.
+func influxWriteURL(scheme string, conf InfluxConfig) (*url.URL, error) {
+	path := conf.ResourcePath
+	query := url.Values{}
+	if len(conf.Bucket) > 0 {
+		if len(path) == 0 {
+			path = "/api/v2/write"
+		}
+		query.Set("org", conf.Org)
+		query.Set("bucket", conf.Bucket)
+	} else {
+		if len(path) == 0 {
+			path = "/write"
+		}
+		query.Set("db", conf.Database)
+	}
+	query.Set("precision", "ns")
+
+	addr, err := url.Parse(scheme + "://" + conf.Server + path)
+	if err != nil {
+		return nil, err
+	}
+	addr.RawQuery = query.Encode()
+
+	return addr, nil
+}
+
+// influxEscape escapes the characters which are special in line protocol.
+// Measurements need commas and spaces escaped, tag keys and values also need
+// equal signs escaped.
+func influxEscape(s string, tag bool) string {
+	if tag {
+		return strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(s)
+	}
+	return strings.NewReplacer(",", `\,`, " ", `\ `).Replace(s)
+}
@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func influxResult(name string, res *health.ExecResult) msg.BackendMessage {
+	hc := &health.DockerHealthCheck{Name: name, Result: res}
+	return msg.NewBackendMessage(hc, nil, res).(msg.BackendMessage)
+}
+
+func TestInfluxBackend_format(t *testing.T) {
+	ts := time.Unix(1591026304, 0)
+	testIO := []struct {
+		name        string
+		measurement string
+		bem         msg.BackendMessage
+		exp         string
+	}{
+		{
+			name:        "should write the tags sorted by key and both fields",
+			measurement: "ogre_check",
+			bem:         influxResult("dns_connect", &health.ExecResult{Container: "/rev-prox", Hostname: "daae3a5a717f", Duration: 41300 * time.Microsecond}),
+			exp:         "ogre_check,check=dns_connect,container=rev-prox,host=daae3a5a717f exit=0i,duration_ms=41.3 1591026304000000000\n",
+		},
+		{
+			name:        "should leave out empty tags",
+			measurement: "ogre_check",
+			bem:         influxResult("dns_connect", &health.ExecResult{Exit: 2}),
+			exp:         "ogre_check,check=dns_connect exit=2i,duration_ms=0 1591026304000000000\n",
+		},
+		{
+			name:        "should escape commas, spaces and equal signs in tag values",
+			measurement: "ogre_check",
+			bem:         influxResult("a,b c=d", &health.ExecResult{Container: "/web", Exit: 1}),
+			exp:         `ogre_check,check=a\,b\ c\=d,container=web exit=1i,duration_ms=0 1591026304000000000` + "\n",
+		},
+		{
+			name:        "should escape commas and spaces but not equal signs in the measurement",
+			measurement: "ogre check,x=y",
+			bem:         influxResult("https_open", &health.ExecResult{Container: "/web", Exit: 0}),
+			exp:         `ogre\ check\,x=y,check=https_open,container=web exit=0i,duration_ms=0 1591026304000000000` + "\n",
+		},
+		{
+			name:        "should keep the time the result was taken",
+			measurement: "ogre_check",
+			bem:         influxResult("https_open", &health.ExecResult{Container: "/web", Time: time.Unix(1591026000, 500)}),
+			exp:         "ogre_check,check=https_open,container=web exit=0i,duration_ms=0 1591026000000000500\n",
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			ib := &InfluxBackend{Measurement: io.measurement}
+			assert.Equal(t, io.exp, ib.format(io.bem, ts))
+		})
+	}
+}
+
+func TestInfluxWriteURL(t *testing.T) {
+	testIO := []struct {
+		name string
+		conf InfluxConfig
+		exp  string
+	}{
+		{
+			name: "should write to the v1 endpoint of the database",
+			conf: InfluxConfig{Server: "influx:8086", Database: "ogre"},
+			exp:  "http://influx:8086/write?db=ogre&precision=ns",
+		},
+		{
+			name: "should write to the v2 endpoint of the bucket",
+			conf: InfluxConfig{Server: "influx:8086", Org: "ideal co", Bucket: "ogre"},
+			exp:  "http://influx:8086/api/v2/write?bucket=ogre&org=ideal+co&precision=ns",
+		},
+		{
+			name: "should write to the resource path",
+			conf: InfluxConfig{Server: "influx:8086", Database: "ogre", ResourcePath: "/influx/write"},
+			exp:  "http://influx:8086/influx/write?db=ogre&precision=ns",
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			addr, err := influxWriteURL("http", io.conf)
+			if assert.NoError(t, err) {
+				assert.Equal(t, io.exp, addr.String())
+			}
+		})
+	}
+}
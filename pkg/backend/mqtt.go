@@ -0,0 +1,391 @@
+package backend
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// mqttDialTimeout is the amount of time we are willing to wait on a broker
+	// to accept a connection and acknowledge it.
+	mqttDialTimeout = 5 * time.Second
+	// mqttAckTimeout is the amount of time we are willing to wait on a broker
+	// to acknowledge a publish of QoS 1 or 2.
+	mqttAckTimeout = 10 * time.Second
+	// mqttDefaultTopic is the topic results are published to when no topic
+	// template is configured.
+	mqttDefaultTopic = "ogre/{{.Host}}/{{.Container}}/{{.Check}}"
+	// mqttSpecial are the characters separating the levels of a topic and its
+	// wildcards, which are escaped in the values of a check.
+	mqttSpecial = "/+#"
+
+	// the MQTT 3.1.1 control packet types we send or expect to receive
+	mqttConnect = 1
+	mqttConnack = 2
+	mqttPublish = 3
+	mqttPuback  = 4
+	mqttPubrec  = 5
+	mqttPubrel  = 6
+	mqttPubcomp = 7
+)
+
+// mqttConnackCodes describes the return codes of a refused connection.
+var mqttConnackCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad username or password",
+	5: "not authorized",
+}
+
+// MQTTBackend satisfies the Platform interface and is responsible for
+// publishing health check results to a topic of an MQTT broker. Each result is
+// published as a JSON object in the same shape as the lines of the file
+// backend, to a topic rendered from the check i.e. ogre/<host>/<container>/<check>.
+// Publishes of QoS 1 and 2 wait on the acknowledgement of the broker, and
+// retained publishes leave the latest result of each check with the broker for
+// subscribers which connect later.
+type MQTTBackend struct {
+	Address  string
+	ClientID string
+	Username string
+	Password string
+	QoS      byte
+	Retain   bool
+	Topic    *topicTemplate
+
+	tlsConf  *tls.Config
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+	mu       sync.Mutex
+}
+
+// MQTTConfig holds the values from the BackendConfig which are used to
+// establish an MQTTBackend.
+type MQTTConfig struct {
+	// Server is the address of the MQTT broker.
+	Server string
+	// Protocol is either 'tcp' (default) or 'tls'.
+	Protocol string
+	// Topic is a text/template of the topic, defaulting to
+	// 'ogre/{{.Host}}/{{.Container}}/{{.Check}}'.
+	Topic string
+	// QoS is the quality of service of each publish, 0 (default), 1 or 2.
+	QoS int
+	// Retain asks the broker to keep the latest result of each topic.
+	Retain bool
+	// ClientID identifies the connection to the broker, defaulting to
+	// ogre-<hostname>.
+	ClientID string
+	// Username and Password authenticate the connection.
+	Username string
+	Password string
+	// TLSCA, TLSCert, TLSKey and InsecureSkipVerify configure the tls protocol
+	// in the same way as for the http backend.
+	TLSCA              string
+	TLSCert            string
+	TLSKey             string
+	InsecureSkipVerify bool
+}
+
+// NewMQTTBackend takes an MQTTConfig and returns a pointer to MQTTBackend which
+// satisfies the Platform interface, or an error. The connection is established
+// here so a misconfigured broker or credentials are reported when the daemon
+// starts rather than on the first health check.
+func NewMQTTBackend(conf MQTTConfig) (Platform, error) {
+	mb := &MQTTBackend{
+		Address:  conf.Server,
+		ClientID: conf.ClientID,
+		Username: conf.Username,
+		Password: conf.Password,
+		Retain:   conf.Retain,
+	}
+	if conf.QoS < 0 || conf.QoS > 2 {
+		return nil, fmt.Errorf("mqtt qos must be 0, 1 or 2, got %d", conf.QoS)
+	}
+	mb.QoS = byte(conf.QoS)
+	if len(mb.Password) > 0 && len(mb.Username) == 0 {
+		return nil, fmt.Errorf("mqtt password requires a username")
+	}
+	if len(mb.ClientID) == 0 {
+		host, err := os.Hostname()
+		if err != nil || len(host) == 0 {
+			host = "unknown"
+		}
+		mb.ClientID = "ogre-" + host
+	}
+
+	switch conf.Protocol {
+	case "", "tcp":
+	case "tls":
+		tlsConf, err := newClientTLSConfig(conf.TLSCA, conf.TLSCert, conf.TLSKey, conf.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConf == nil {
+			tlsConf = &tls.Config{}
+		}
+		mb.tlsConf = tlsConf
+	default:
+		return nil, fmt.Errorf("mqtt protocol must be tcp or tls, got %s", conf.Protocol)
+	}
+
+	topic, err := newTopicTemplate(conf.Topic, mqttDefaultTopic, topicEscaper(mqttSpecial))
+	if err != nil {
+		return nil, err
+	}
+	mb.Topic = topic
+
+	if err := mb.connect(); err != nil {
+		return nil, err
+	}
+
+	return mb, nil
+}
+
+// Send is the MQTTBackend implementation of the Platform interface Send
+// method. Send takes a Message and publishes it to the topic of the check,
+// waiting on the broker to acknowledge it for QoS 1 and 2. Should the publish
+// fail, the connection is re-established and the publish is attempted once
+// more before an error is returned.
+func (mb *MQTTBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	topic, err := mb.Topic.render(bem)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(newResultRecord(bem))
+	if err != nil {
+		return fmt.Errorf("could not serialize message for mqtt: %s", err)
+	}
+	log.Daemon.Tracef("mqtt backend publishing %s to %s", payload, topic)
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.conn != nil {
+		err := mb.publish(topic, payload)
+		if err == nil {
+			return nil
+		}
+		log.Daemon.Infof("mqtt publish to %s failed, reconnecting: %s", mb.Address, err)
+	}
+
+	if err := mb.connect(); err != nil {
+		return fmt.Errorf("could not reconnect to mqtt: %s", err)
+	}
+	if err := mb.publish(topic, payload); err != nil {
+		mb.close()
+		return fmt.Errorf("could not publish message for mqtt: %s", err)
+	}
+
+	return nil
+}
+
+// Type is the MQTTBackend implementation of the Platform interface Type
+// and returns a PlatformType of type MQTTBackend.
+func (mb *MQTTBackend) Type() types.PlatformType {
+	return types.MQTTBackend
+}
+
+// connect closes any existing connection, dials the broker and sends a
+// CONNECT, returning an error should the broker not accept it. The session is
+// clean and keep alive is disabled, a connection the broker has dropped is
+// re-established by the next publish. Callers are expected to hold the mutex
+// once the backend is established.
+func (mb *MQTTBackend) connect() error {
+	mb.close()
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	if mb.tlsConf != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", mb.Address, mb.tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", mb.Address)
+	}
+	if err != nil {
+		return err
+	}
+
+	// protocol name, level 4 (3.1.1), connect flags and a keep alive of zero
+	flags := byte(0x02)
+	if len(mb.Username) > 0 {
+		flags |= 0x80
+	}
+	if len(mb.Password) > 0 {
+		flags |= 0x40
+	}
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	body = append(body, mqttString(mb.ClientID)...)
+	if len(mb.Username) > 0 {
+		body = append(body, mqttString(mb.Username)...)
+	}
+	if len(mb.Password) > 0 {
+		body = append(body, mqttString(mb.Password)...)
+	}
+
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if _, err := conn.Write(mqttPacket(mqttConnect<<4, body)); err != nil {
+		conn.Close()
+		return fmt.Errorf("could not send mqtt connect: %s", err)
+	}
+	r := bufio.NewReader(conn)
+	kind, ack, err := mqttReadPacket(r)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("could not read mqtt connack: %s", err)
+	}
+	if kind>>4 != mqttConnack || len(ack) != 2 {
+		conn.Close()
+		return fmt.Errorf("unexpected packet of type %d from mqtt broker", kind>>4)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		reason, ok := mqttConnackCodes[ack[1]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", ack[1])
+		}
+		return fmt.Errorf("mqtt broker refused connection: %s", reason)
+	}
+	conn.SetDeadline(time.Time{})
+
+	mb.conn = conn
+	mb.r = r
+	return nil
+}
+
+// publish sends a PUBLISH and, for QoS 1 and 2, completes its acknowledgement
+// flow. Callers are expected to hold the mutex.
+func (mb *MQTTBackend) publish(topic string, payload []byte) error {
+	header := byte(mqttPublish<<4) | mb.QoS<<1
+	if mb.Retain {
+		header |= 0x01
+	}
+	body := mqttString(topic)
+	var id uint16
+	if mb.QoS > 0 {
+		mb.packetID++
+		if mb.packetID == 0 {
+			mb.packetID = 1
+		}
+		id = mb.packetID
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, payload...)
+
+	mb.conn.SetDeadline(time.Now().Add(mqttAckTimeout))
+	defer mb.conn.SetDeadline(time.Time{})
+
+	if _, err := mb.conn.Write(mqttPacket(header, body)); err != nil {
+		return err
+	}
+	switch mb.QoS {
+	case 1:
+		return mb.await(mqttPuback, id)
+	case 2:
+		if err := mb.await(mqttPubrec, id); err != nil {
+			return err
+		}
+		if _, err := mb.conn.Write(mqttPacket(mqttPubrel<<4|0x02, []byte{byte(id >> 8), byte(id)})); err != nil {
+			return err
+		}
+		return mb.await(mqttPubcomp, id)
+	}
+	return nil
+}
+
+// await reads packets until the acknowledgement of the type and packet id
+// passed is received. Acknowledgements of earlier publishes, which were
+// abandoned when a deadline passed, are skipped.
+func (mb *MQTTBackend) await(kind byte, id uint16) error {
+	for {
+		got, body, err := mqttReadPacket(mb.r)
+		if err != nil {
+			return err
+		}
+		if got>>4 != kind || len(body) < 2 {
+			continue
+		}
+		if binary.BigEndian.Uint16(body) == id {
+			return nil
+		}
+	}
+}
+
+// close tears down the connection if there is one. Callers are expected to
+// hold the mutex.
+func (mb *MQTTBackend) close() {
+	if mb.conn != nil {
+		mb.conn.Close()
+		mb.conn = nil
+		mb.r = nil
+	}
+}
+
+// mqttString encodes a string as it is in MQTT, prefixed by its length.
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket prefixes the body of a packet with its fixed header, i.e. the
+// first byte and the remaining length.
+func mqttPacket(first byte, body []byte) []byte {
+	packet := []byte{first}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttReadPacket reads a single packet, returning the first byte of its fixed
+// header and its body.
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift int
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 21 {
+			return 0, nil, fmt.Errorf("malformed mqtt remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return first, body, nil
+}
@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttStandIn is an MQTT broker speaking just enough of the protocol to accept
+// a publisher, recording each packet it is sent. It frames and answers packets
+// itself, from literal bytes, so it does not share the encoding of the backend.
+type mqttStandIn struct {
+	ln      net.Listener
+	refuse  bool
+	packets []mqttStandInPacket
+	mu      sync.Mutex
+}
+
+// mqttStandInPacket is the first byte of the fixed header of a packet and the
+// body following the remaining length.
+type mqttStandInPacket struct {
+	first byte
+	body  []byte
+}
+
+func newMQTTStandIn(t *testing.T, refuse bool) *mqttStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &mqttStandIn{ln: ln, refuse: refuse}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ms.serve(conn)
+		}
+	}()
+	return ms
+}
+
+func (ms *mqttStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		first, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		// every packet sent in the tests is shorter than 16384 bytes, so
+		// its remaining length is one or two bytes
+		length, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		size := int(length)
+		if length&0x80 != 0 {
+			next, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			size = int(length&0x7f) + int(next)*128
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		ms.mu.Lock()
+		ms.packets = append(ms.packets, mqttStandInPacket{first: first, body: body})
+		ms.mu.Unlock()
+
+		switch {
+		case first == 0x10 && ms.refuse:
+			// bad username or password
+			conn.Write([]byte{0x20, 0x02, 0x00, 0x04})
+			return
+		case first == 0x10:
+			conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		case first&0xf6 == 0x32:
+			// PUBLISH of QoS 1, retained or not, the packet id follows the
+			// topic
+			id := body[2+int(body[0])<<8+int(body[1]):][:2]
+			conn.Write(append([]byte{0x40, 0x02}, id...))
+		case first&0xf6 == 0x34:
+			id := body[2+int(body[0])<<8+int(body[1]):][:2]
+			conn.Write(append([]byte{0x50, 0x02}, id...))
+		case first == 0x62:
+			conn.Write(append([]byte{0x70, 0x02}, body...))
+		}
+	}
+}
+
+// received waits for the number of packets passed, publishes of QoS 0 are not
+// acknowledged so the stand-in may not have read them yet.
+func (ms *mqttStandIn) received(n int) []mqttStandInPacket {
+	deadline := time.Now().Add(time.Second)
+	for {
+		ms.mu.Lock()
+		packets := ms.packets
+		ms.mu.Unlock()
+		if len(packets) >= n || time.Now().After(deadline) {
+			return packets
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMQTTBackend_Send(t *testing.T) {
+	// CONNECT of MQTT 3.1.1 with a clean session, no keep alive and the client
+	// id ogre-test
+	connect := "\x10\x15\x00\x04MQTT\x04\x02\x00\x00\x00\x09ogre-test"
+	topic := "\x00\x20ogre/daae3a5a717f/web/https_open"
+	testIO := []struct {
+		name       string
+		conf       MQTTConfig
+		refuse     bool
+		exp        []mqttStandInPacket
+		expConnErr bool
+	}{
+		{
+			name: "should publish to the default topic",
+			exp: []mqttStandInPacket{
+				{first: 0x10, body: []byte(connect[2:])},
+				{first: 0x30, body: []byte(topic)},
+			},
+		},
+		{
+			name: "should publish retained with qos 1",
+			conf: MQTTConfig{QoS: 1, Retain: true},
+			exp: []mqttStandInPacket{
+				{first: 0x10, body: []byte(connect[2:])},
+				{first: 0x33, body: []byte(topic + "\x00\x01")},
+			},
+		},
+		{
+			name: "should publish with qos 2 and release it",
+			conf: MQTTConfig{QoS: 2},
+			exp: []mqttStandInPacket{
+				{first: 0x10, body: []byte(connect[2:])},
+				{first: 0x34, body: []byte(topic + "\x00\x01")},
+				{first: 0x62, body: []byte("\x00\x01")},
+			},
+		},
+		{
+			name: "should publish to a templated topic as a user",
+			conf: MQTTConfig{Topic: "health/{{.Container}}", Username: "ogre", Password: "s3cret"},
+			exp: []mqttStandInPacket{
+				{first: 0x10, body: []byte("\x00\x04MQTT\x04\xc2\x00\x00\x00\x09ogre-test\x00\x04ogre\x00\x06s3cret")},
+				{first: 0x30, body: []byte("\x00\x0ahealth/web")},
+			},
+		},
+		{
+			name:       "should fail when the broker refuses the connection",
+			refuse:     true,
+			expConnErr: true,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			standIn := newMQTTStandIn(t, io.refuse)
+			defer standIn.ln.Close()
+
+			io.conf.Server = standIn.ln.Addr().String()
+			io.conf.ClientID = "ogre-test"
+			p, err := NewMQTTBackend(io.conf)
+			if io.expConnErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := &health.ExecResult{Container: "/web", Hostname: "daae3a5a717f"}
+			hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+			assert.NoError(t, p.Send(msg.NewBackendMessage(hc, nil, res)))
+
+			packets := standIn.received(len(io.exp))
+			if !assert.Len(t, packets, len(io.exp)) {
+				return
+			}
+			for i, exp := range io.exp {
+				got := packets[i]
+				assert.Equal(t, exp.first, got.first, "packet %d type and flags", i)
+				if exp.first>>4 != 3 {
+					assert.Equal(t, exp.body, got.body, "packet %d body", i)
+					continue
+				}
+				// the payload of a publish follows the topic and packet id
+				if !assert.True(t, len(got.body) > len(exp.body), "publish %d has no payload", i) {
+					continue
+				}
+				assert.Equal(t, exp.body, got.body[:len(exp.body)], "publish %d topic and packet id", i)
+				var rec resultRecord
+				if assert.NoError(t, json.Unmarshal(got.body[len(exp.body):], &rec)) {
+					assert.Equal(t, "https_open", rec.Check)
+					assert.True(t, rec.Passed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package backend
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"github.com/ideal-co/ogre/pkg/version"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// natsDialTimeout is the amount of time we are willing to wait on a NATS
+	// server to accept a connection and answer the handshake.
+	natsDialTimeout = 5 * time.Second
+	// natsWriteTimeout is the amount of time we are willing to wait on a NATS
+	// server to take a publish, so one which stopped reading cannot hold up
+	// every send.
+	natsWriteTimeout = 10 * time.Second
+	// natsDefaultTopic is the subject results are published to when no topic
+	// template is configured.
+	natsDefaultTopic = "ogre.{{.Host}}.{{.Container}}.{{.Check}}"
+	// natsSpecial are the characters separating the tokens of a subject and
+	// its wildcards, which are escaped in the values of a check.
+	natsSpecial = ".*>"
+)
+
+// NATSBackend satisfies the Platform interface and is responsible for
+// publishing health check results to a subject of a NATS server. Each result
+// is published as a JSON object in the same shape as the lines of the file
+// backend, to a subject rendered from the check i.e. ogre.<host>.<container>.<check>.
+type NATSBackend struct {
+	Address  string
+	Username string
+	Password string
+	Token    string
+	Topic    *topicTemplate
+
+	tlsConf      *tls.Config
+	conn         net.Conn
+	maxPayload   int
+	writeTimeout time.Duration
+	mu           sync.Mutex
+}
+
+// NATSConfig holds the values from the BackendConfig which are used to
+// establish a NATSBackend.
+type NATSConfig struct {
+	// Server is the address of the NATS server.
+	Server string
+	// Protocol is either 'tcp' (default) or 'tls'.
+	Protocol string
+	// Topic is a text/template of the subject, defaulting to
+	// 'ogre.{{.Host}}.{{.Container}}.{{.Check}}'.
+	Topic string
+	// Username and Password, or Token, authenticate the connection.
+	Username string
+	Password string
+	Token    string
+	// TLSCA, TLSCert, TLSKey and InsecureSkipVerify configure the tls protocol
+	// in the same way as for the http backend.
+	TLSCA              string
+	TLSCert            string
+	TLSKey             string
+	InsecureSkipVerify bool
+}
+
+// natsInfo holds the fields of the INFO a server greets a client with which
+// we care about.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// natsConnect is the CONNECT sent to a server once it has greeted us.
+type natsConnect struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	AuthToken   string `json:"auth_token,omitempty"`
+}
+
+// NewNATSBackend takes a NATSConfig and returns a pointer to NATSBackend which
+// satisfies the Platform interface, or an error. The connection is established
+// here so a misconfigured server or credentials are reported when the daemon
+// starts rather than on the first health check.
+func NewNATSBackend(conf NATSConfig) (Platform, error) {
+	nb := &NATSBackend{
+		Address:  conf.Server,
+		Username: conf.Username,
+		Password: conf.Password,
+		Token:    conf.Token,
+
+		writeTimeout: natsWriteTimeout,
+	}
+	if len(nb.Token) > 0 && (len(nb.Username) > 0 || len(nb.Password) > 0) {
+		return nil, fmt.Errorf("only one of token and username/password may be set for nats")
+	}
+
+	switch conf.Protocol {
+	case "", "tcp":
+	case "tls":
+		tlsConf, err := newClientTLSConfig(conf.TLSCA, conf.TLSCert, conf.TLSKey, conf.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConf == nil {
+			tlsConf = &tls.Config{}
+		}
+		nb.tlsConf = tlsConf
+	default:
+		return nil, fmt.Errorf("nats protocol must be tcp or tls, got %s", conf.Protocol)
+	}
+
+	topic, err := newTopicTemplate(conf.Topic, natsDefaultTopic, topicEscaper(natsSpecial))
+	if err != nil {
+		return nil, err
+	}
+	nb.Topic = topic
+
+	if err := nb.connect(); err != nil {
+		return nil, err
+	}
+
+	return nb, nil
+}
+
+// Send is the NATSBackend implementation of the Platform interface Send
+// method. Send takes a Message and publishes it to the subject of the check.
+// Should the publish fail, the connection is re-established and the publish
+// is attempted once more before an error is returned.
+func (nb *NATSBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	subject, err := nb.Topic.render(bem)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(newResultRecord(bem))
+	if err != nil {
+		return fmt.Errorf("could not serialize message for nats: %s", err)
+	}
+	log.Daemon.Tracef("nats backend publishing %s to %s", payload, subject)
+
+	data := []byte("PUB " + subject + " " + strconv.Itoa(len(payload)) + "\r\n")
+	data = append(append(data, payload...), '\r', '\n')
+
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	if nb.maxPayload > 0 && len(payload) > nb.maxPayload {
+		return fmt.Errorf("result of %d bytes exceeds the nats max payload of %d", len(payload), nb.maxPayload)
+	}
+
+	if nb.conn != nil {
+		err := nb.write(nb.conn, data)
+		if err == nil {
+			return nil
+		}
+		log.Daemon.Infof("nats publish to %s failed, reconnecting: %s", nb.Address, err)
+	}
+
+	if err := nb.connect(); err != nil {
+		return fmt.Errorf("could not reconnect to nats: %s", err)
+	}
+	if err := nb.write(nb.conn, data); err != nil {
+		nb.close()
+		return fmt.Errorf("could not publish message for nats: %s", err)
+	}
+
+	return nil
+}
+
+// Type is the NATSBackend implementation of the Platform interface Type
+// and returns a PlatformType of type NATSBackend.
+func (nb *NATSBackend) Type() types.PlatformType {
+	return types.NATSBackend
+}
+
+// connect closes any existing connection, dials the server and completes the
+// handshake, i.e. reads the INFO, upgrades to tls if configured, sends our
+// CONNECT and waits on the PONG answering our PING, which is only sent once
+// the CONNECT is accepted. Server PINGs are answered from a go routine started
+// here. Callers are expected to hold the mutex once the backend is established.
+func (nb *NATSBackend) connect() error {
+	nb.close()
+
+	conn, err := net.DialTimeout("tcp", nb.Address, natsDialTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsDialTimeout))
+	r := bufio.NewReader(conn)
+
+	line, err := natsReadLine(r)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("could not read nats server info: %s", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from nats server: %s", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("could not parse nats server info: %s", err)
+	}
+
+	if info.TLSRequired && nb.tlsConf == nil {
+		conn.Close()
+		return fmt.Errorf("nats server requires tls, set the protocol to tls")
+	}
+	if nb.tlsConf != nil {
+		tlsConf := nb.tlsConf.Clone()
+		if len(tlsConf.ServerName) == 0 {
+			tlsConf.ServerName, _, _ = net.SplitHostPort(nb.Address)
+		}
+		tlsConn := tls.Client(conn, tlsConf)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return fmt.Errorf("could not establish tls with nats server: %s", err)
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	connect, _ := json.Marshal(natsConnect{
+		TLSRequired: nb.tlsConf != nil,
+		Name:        "ogre",
+		Lang:        "go",
+		Version:     version.Version,
+		Protocol:    1,
+		User:        nb.Username,
+		Pass:        nb.Password,
+		AuthToken:   nb.Token,
+	})
+	if _, err := conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		conn.Close()
+		return fmt.Errorf("could not send nats connect: %s", err)
+	}
+	for {
+		line, err := natsReadLine(r)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("could not complete nats handshake: %s", err)
+		}
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return fmt.Errorf("nats server refused connection: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	nb.conn = conn
+	nb.maxPayload = info.MaxPayload
+	go nb.readLoop(conn, r)
+	return nil
+}
+
+// readLoop reads what the server sends on a connection for as long as it is
+// open, answering PINGs and logging errors. The server sends nothing else as
+// we never subscribe.
+func (nb *NATSBackend) readLoop(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := natsReadLine(r)
+		if err != nil {
+			nb.mu.Lock()
+			if nb.conn == conn {
+				log.Daemon.Infof("nats connection to %s lost: %s", nb.Address, err)
+				nb.close()
+			}
+			nb.mu.Unlock()
+			return
+		}
+
+		switch {
+		case line == "PING":
+			nb.mu.Lock()
+			if nb.conn == conn {
+				if err := nb.write(conn, []byte("PONG\r\n")); err != nil {
+					log.Daemon.Warnf("could not answer nats ping: %s", err)
+				}
+			}
+			nb.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Daemon.Errorf("nats server %s returned an error: %s", nb.Address, strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// write writes data to a connection, giving up should the server not take it
+// within the write timeout. Callers are expected to hold the mutex.
+func (nb *NATSBackend) write(conn net.Conn, data []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(nb.writeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write(data)
+	return err
+}
+
+// close tears down the connection if there is one, which also ends its read
+// loop. Callers are expected to hold the mutex.
+func (nb *NATSBackend) close() {
+	if nb.conn != nil {
+		nb.conn.Close()
+		nb.conn = nil
+	}
+}
+
+// natsReadLine reads a single line of the protocol without its CRLF.
+func natsReadLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natsStandIn is a NATS server speaking just enough of the protocol to accept
+// a publisher, recording what is published and the CONNECT of each client.
+// Once deaf is closed it stops reading from the clients which connect, until
+// done is closed.
+type natsStandIn struct {
+	ln       net.Listener
+	token    string
+	connects []natsConnect
+	pubs     map[string][]byte
+	deaf     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+func newNATSStandIn(t *testing.T, token string) *natsStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := &natsStandIn{ln: ln, token: token, pubs: make(map[string][]byte), deaf: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ns.serve(conn)
+		}
+	}()
+	return ns
+}
+
+func (ns *natsStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte(`INFO {"server_id":"stand-in","max_payload":1048576}` + "\r\n"))
+	for {
+		line, err := natsReadLine(r)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			var c natsConnect
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &c)
+			ns.mu.Lock()
+			ns.connects = append(ns.connects, c)
+			ns.mu.Unlock()
+			if c.AuthToken != ns.token {
+				conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+				return
+			}
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+			select {
+			case <-ns.deaf:
+				<-ns.done
+				return
+			default:
+			}
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			ns.mu.Lock()
+			ns.pubs[fields[1]] = payload[:size]
+			ns.mu.Unlock()
+		}
+	}
+}
+
+func (ns *natsStandIn) published(subject string) []byte {
+	// publishes are not acknowledged, give the stand-in a moment to read them
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		ns.mu.Lock()
+		payload, ok := ns.pubs[subject]
+		ns.mu.Unlock()
+		if ok {
+			return payload
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestNATSBackend_Send(t *testing.T) {
+	testIO := []struct {
+		name       string
+		conf       NATSConfig
+		serverAuth string
+		container  string
+		expSubject string
+		expErr     bool
+	}{
+		{
+			name:       "should publish to the default subject",
+			container:  "/web",
+			expSubject: "ogre.daae3a5a717f.web.https_open",
+		},
+		{
+			name:       "should escape the tokens of the subject",
+			container:  "/web.1 a>b",
+			expSubject: "ogre.daae3a5a717f.web_1_a_b.https_open",
+		},
+		{
+			name:       "should publish to a templated subject",
+			conf:       NATSConfig{Topic: "health.{{.Check}}"},
+			container:  "/web",
+			expSubject: "health.https_open",
+		},
+		{
+			name:       "should authenticate with a token",
+			conf:       NATSConfig{Token: "s3cret"},
+			serverAuth: "s3cret",
+			container:  "/web",
+			expSubject: "ogre.daae3a5a717f.web.https_open",
+		},
+		{
+			name:       "should fail when the server refuses the connection",
+			serverAuth: "s3cret",
+			expErr:     true,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			standIn := newNATSStandIn(t, io.serverAuth)
+			defer standIn.ln.Close()
+
+			io.conf.Server = standIn.ln.Addr().String()
+			p, err := NewNATSBackend(io.conf)
+			if io.expErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := &health.ExecResult{Container: io.container, Hostname: "daae3a5a717f", Exit: 1}
+			hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+			assert.NoError(t, p.Send(msg.NewBackendMessage(hc, nil, res)))
+
+			var rec resultRecord
+			if assert.NoError(t, json.Unmarshal(standIn.published(io.expSubject), &rec)) {
+				assert.Equal(t, "https_open", rec.Check)
+				assert.Equal(t, 1, rec.Exit)
+				assert.False(t, rec.Passed)
+			}
+		})
+	}
+}
+
+func TestNATSBackend_SendDeafServer(t *testing.T) {
+	standIn := newNATSStandIn(t, "")
+	defer standIn.ln.Close()
+	defer close(standIn.done)
+	close(standIn.deaf)
+
+	p, err := NewNATSBackend(NATSConfig{Server: standIn.ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb := p.(*NATSBackend)
+	nb.writeTimeout = 100 * time.Millisecond
+
+	// enough to fill the socket buffers of every connection made
+	res := &health.ExecResult{Container: "/web", StdOut: strings.Repeat("x", 900*1024)}
+	hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+	// a publish which times out is made again on a new connection, so the
+	// sends may well succeed, but none may block
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 30; i++ {
+			p.Send(msg.NewBackendMessage(hc, nil, res))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("send blocked on a server which does not read")
+	}
+}
@@ -0,0 +1,467 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"github.com/ideal-co/ogre/pkg/version"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	otlpMetricsPath = "/v1/metrics"
+	otlpLogsPath    = "/v1/logs"
+
+	otlpFormatProtobuf = "protobuf"
+	otlpFormatJSON     = "json"
+
+	otlpScopeName = "github.com/ideal-co/ogre"
+
+	// log record severity numbers from the OpenTelemetry log data model
+	otlpSeverityInfo  = 9
+	otlpSeverityWarn  = 13
+	otlpSeverityError = 17
+)
+
+// OTLPBackend satisfies the Platform interface and is responsible for exporting
+// health check results to an OpenTelemetry collector over OTLP/HTTP. Each result
+// is exported as two gauges, the exit code and duration of the check, as well
+// as a log record carrying the stdout and stderr of the check. The resource of
+// both is the container the check was run in or against.
+type OTLPBackend struct {
+	Client     *http.Client
+	MetricsURL *url.URL
+	LogsURL    *url.URL
+	Format     string
+}
+
+// NewOTLPBackend takes four strings, a server which is the address of the
+// collector's OTLP/HTTP receiver, i.e. 127.0.0.1:4318, a scheme which is either
+// http (default) or https, an optional path prefix to prepend to the standard
+// /v1/metrics and /v1/logs paths, and a format which is either protobuf
+// (default) or json. A pointer to OTLPBackend is returned or an error should
+// the configuration be invalid.
+func NewOTLPBackend(server, scheme, path, format string) (Platform, error) {
+	ob := &OTLPBackend{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		Format: format,
+	}
+	if len(ob.Format) == 0 {
+		ob.Format = otlpFormatProtobuf
+	}
+	if ob.Format != otlpFormatProtobuf && ob.Format != otlpFormatJSON {
+		return nil, fmt.Errorf("otlp format must be protobuf or json, got %s", ob.Format)
+	}
+	if len(scheme) == 0 {
+		scheme = "http"
+	}
+
+	var err error
+	base := scheme + "://" + server + strings.TrimSuffix(path, "/")
+	if ob.MetricsURL, err = url.Parse(base + otlpMetricsPath); err != nil {
+		return nil, err
+	}
+	if ob.LogsURL, err = url.Parse(base + otlpLogsPath); err != nil {
+		return nil, err
+	}
+
+	return ob, nil
+}
+
+// Send is the OTLPBackend implementation of the Platform interface Send method.
+// Send takes a Message and exports the metrics and then the log record for the
+// health check result, returning an error should either export fail.
+func (ob *OTLPBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	ts := bem.Time()
+	res := otlpResourceFor(bem)
+	check := []otlpKeyValue{otlpString("check.name", bem.CompletedCheck.String())}
+
+	var duration time.Duration
+	var stdout, stderr string
+	if bem.Data != nil {
+		duration = bem.Data.Duration
+		stdout = bem.Data.StdOut
+		stderr = bem.Data.StdErr
+	}
+
+	metrics := otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: res,
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScopeInfo(),
+			Metrics: []otlpMetric{
+				{
+					Name:        "ogre.check.exit_code",
+					Description: "Exit code of the most recent health check execution.",
+					Unit:        "1",
+					Gauge: otlpGauge{DataPoints: []otlpDataPoint{{
+						Attributes:   check,
+						TimeUnixNano: ts.UnixNano(),
+						AsInt:        int64Ptr(int64(bem.Exit())),
+					}}},
+				},
+				{
+					Name:        "ogre.check.duration",
+					Description: "Wall time of the most recent health check execution.",
+					Unit:        "s",
+					Gauge: otlpGauge{DataPoints: []otlpDataPoint{{
+						Attributes:   check,
+						TimeUnixNano: ts.UnixNano(),
+						AsDouble:     float64Ptr(duration.Seconds()),
+					}}},
+				},
+			},
+		}},
+	}}}
+
+	severity, text := otlpSeverity(bem.Exit())
+	logs := otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: res,
+		ScopeLogs: []otlpScopeLogs{{
+			Scope: otlpScopeInfo(),
+			LogRecords: []otlpLogRecord{{
+				TimeUnixNano:         ts.UnixNano(),
+				ObservedTimeUnixNano: time.Now().UnixNano(),
+				SeverityNumber:       severity,
+				SeverityText:         text,
+				Body:                 otlpAnyValue{StringValue: &stdout},
+				Attributes: append([]otlpKeyValue{
+					otlpInt("check.exit_code", int64(bem.Exit())),
+					otlpString("check.stderr", stderr),
+				}, check...),
+			}},
+		}},
+	}}}
+
+	if err := ob.export(ob.MetricsURL, metrics); err != nil {
+		return fmt.Errorf("could not export metrics for otlp: %s", err)
+	}
+	if err := ob.export(ob.LogsURL, logs); err != nil {
+		return fmt.Errorf("could not export logs for otlp: %s", err)
+	}
+
+	return nil
+}
+
+// Type is the OTLPBackend implementation of the Platform interface Type
+// and returns a PlatformType of type OTLPBackend.
+func (ob *OTLPBackend) Type() types.PlatformType {
+	return types.OTLPBackend
+}
+
+// export encodes a request in the configured format and posts it to addr.
+func (ob *OTLPBackend) export(addr *url.URL, req otlpEncoder) error {
+	var data []byte
+	var contentType string
+	switch ob.Format {
+	case otlpFormatJSON:
+		var err error
+		if data, err = json.Marshal(req); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	default:
+		data = req.protobuf()
+		contentType = "application/x-protobuf"
+	}
+
+	resp, err := ob.Client.Post(addr.String(), contentType, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	log.Daemon.Tracef("otlp backend response %v", resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// otlpResourceFor returns the resource attributes describing the container a
+// check was run in or against.
+func otlpResourceFor(bem msg.BackendMessage) otlpResource {
+	attrs := []otlpKeyValue{otlpString("service.name", "ogre")}
+	if bem.Data == nil {
+		return otlpResource{Attributes: attrs}
+	}
+	for _, kv := range [][2]string{
+		{"container.name", strings.TrimPrefix(bem.Data.Container, "/")},
+		{"container.id", bem.Data.ContainerID},
+		{"container.image.name", bem.Data.Image},
+		{"host.name", bem.Data.Hostname},
+	} {
+		if len(kv[1]) > 0 {
+			attrs = append(attrs, otlpString(kv[0], kv[1]))
+		}
+	}
+	return otlpResource{Attributes: attrs}
+}
+
+// otlpSeverity maps an exit code to a log record severity.
+func otlpSeverity(exit int) (int32, string) {
+	switch exit {
+	case 0:
+		return otlpSeverityInfo, "INFO"
+	case 1:
+		return otlpSeverityWarn, "WARN"
+	default:
+		return otlpSeverityError, "ERROR"
+	}
+}
+
+func otlpScopeInfo() otlpScope {
+	return otlpScope{Name: otlpScopeName, Version: version.Version}
+}
+
+func otlpString(key, val string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &val}}
+}
+
+func otlpInt(key string, val int64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: int64Ptr(val)}}
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+// The types below are a subset of the OTLP protobuf messages which are needed
+// to export gauges and log records. They are tagged to produce the OTLP/JSON
+// encoding, and the protobuf methods produce the binary encoding, using the
+// field numbers from opentelemetry-proto.
+
+type otlpEncoder interface {
+	protobuf() []byte
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Unit        string    `json:"unit,omitempty"`
+	Gauge       otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano int64          `json:"timeUnixNano,string"`
+	AsDouble     *float64       `json:"asDouble,omitempty"`
+	AsInt        *int64         `json:"asInt,omitempty,string"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         int64          `json:"timeUnixNano,string"`
+	ObservedTimeUnixNano int64          `json:"observedTimeUnixNano,string"`
+	SeverityNumber       int32          `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *int64  `json:"intValue,omitempty,string"`
+}
+
+func (r otlpMetricsRequest) protobuf() []byte {
+	var b []byte
+	for _, rm := range r.ResourceMetrics {
+		b = appendMessage(b, 1, rm.protobuf())
+	}
+	return b
+}
+
+func (rm otlpResourceMetrics) protobuf() []byte {
+	b := appendMessage(nil, 1, rm.Resource.protobuf())
+	for _, sm := range rm.ScopeMetrics {
+		b = appendMessage(b, 2, sm.protobuf())
+	}
+	return b
+}
+
+func (sm otlpScopeMetrics) protobuf() []byte {
+	b := appendMessage(nil, 1, sm.Scope.protobuf())
+	for _, m := range sm.Metrics {
+		b = appendMessage(b, 2, m.protobuf())
+	}
+	return b
+}
+
+func (m otlpMetric) protobuf() []byte {
+	b := appendString(nil, 1, m.Name)
+	b = appendString(b, 2, m.Description)
+	b = appendString(b, 3, m.Unit)
+	return appendMessage(b, 5, m.Gauge.protobuf())
+}
+
+func (g otlpGauge) protobuf() []byte {
+	var b []byte
+	for _, dp := range g.DataPoints {
+		b = appendMessage(b, 1, dp.protobuf())
+	}
+	return b
+}
+
+func (dp otlpDataPoint) protobuf() []byte {
+	b := protowire.AppendTag(nil, 3, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(dp.TimeUnixNano))
+	if dp.AsDouble != nil {
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*dp.AsDouble))
+	}
+	if dp.AsInt != nil {
+		b = protowire.AppendTag(b, 6, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, uint64(*dp.AsInt))
+	}
+	for _, kv := range dp.Attributes {
+		b = appendMessage(b, 7, kv.protobuf())
+	}
+	return b
+}
+
+func (r otlpLogsRequest) protobuf() []byte {
+	var b []byte
+	for _, rl := range r.ResourceLogs {
+		b = appendMessage(b, 1, rl.protobuf())
+	}
+	return b
+}
+
+func (rl otlpResourceLogs) protobuf() []byte {
+	b := appendMessage(nil, 1, rl.Resource.protobuf())
+	for _, sl := range rl.ScopeLogs {
+		b = appendMessage(b, 2, sl.protobuf())
+	}
+	return b
+}
+
+func (sl otlpScopeLogs) protobuf() []byte {
+	b := appendMessage(nil, 1, sl.Scope.protobuf())
+	for _, lr := range sl.LogRecords {
+		b = appendMessage(b, 2, lr.protobuf())
+	}
+	return b
+}
+
+func (lr otlpLogRecord) protobuf() []byte {
+	b := protowire.AppendTag(nil, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(lr.TimeUnixNano))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(lr.SeverityNumber))
+	b = appendString(b, 3, lr.SeverityText)
+	b = appendMessage(b, 5, lr.Body.protobuf())
+	for _, kv := range lr.Attributes {
+		b = appendMessage(b, 6, kv.protobuf())
+	}
+	b = protowire.AppendTag(b, 11, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, uint64(lr.ObservedTimeUnixNano))
+}
+
+func (r otlpResource) protobuf() []byte {
+	var b []byte
+	for _, kv := range r.Attributes {
+		b = appendMessage(b, 1, kv.protobuf())
+	}
+	return b
+}
+
+func (s otlpScope) protobuf() []byte {
+	b := appendString(nil, 1, s.Name)
+	return appendString(b, 2, s.Version)
+}
+
+func (kv otlpKeyValue) protobuf() []byte {
+	b := appendString(nil, 1, kv.Key)
+	return appendMessage(b, 2, kv.Value.protobuf())
+}
+
+func (av otlpAnyValue) protobuf() []byte {
+	var b []byte
+	if av.StringValue != nil {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, *av.StringValue)
+	}
+	if av.IntValue != nil {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*av.IntValue))
+	}
+	return b
+}
+
+// appendMessage appends an embedded message field.
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// appendString appends a string field, omitting it should it be empty as
+// proto3 does for default values.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
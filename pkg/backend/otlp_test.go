@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"encoding/json"
+	"github.com/ideal-co/ogre/pkg/config"
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOTLP_protobuf(t *testing.T) {
+	testIO := []struct {
+		name string
+		enc  otlpEncoder
+		exp  []byte
+	}{
+		{
+			name: "should encode a string attribute",
+			enc:  otlpString("k", "v"),
+			exp:  []byte("\x0a\x01k\x12\x03\x0a\x01v"),
+		},
+		{
+			name: "should encode an int attribute as a varint",
+			enc:  otlpInt("k", 5),
+			exp:  []byte("\x0a\x01k\x12\x02\x18\x05"),
+		},
+		{
+			name: "should encode a negative int attribute in ten bytes",
+			enc:  otlpInt("k", -1),
+			exp:  []byte("\x0a\x01k\x12\x0b\x18\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"),
+		},
+		{
+			name: "should leave out an empty scope version",
+			enc:  otlpScope{Name: "ogre"},
+			exp:  []byte("\x0a\x04ogre"),
+		},
+		{
+			name: "should encode an int data point as fixed64",
+			enc:  otlpDataPoint{TimeUnixNano: 1, AsInt: int64Ptr(2)},
+			exp: []byte("\x19\x01\x00\x00\x00\x00\x00\x00\x00" +
+				"\x31\x02\x00\x00\x00\x00\x00\x00\x00"),
+		},
+		{
+			name: "should encode a double data point with its attributes",
+			enc:  otlpDataPoint{TimeUnixNano: 1, AsDouble: float64Ptr(0.5), Attributes: []otlpKeyValue{otlpString("k", "v")}},
+			exp: []byte("\x19\x01\x00\x00\x00\x00\x00\x00\x00" +
+				"\x21\x00\x00\x00\x00\x00\x00\xe0\x3f" +
+				"\x3a\x08\x0a\x01k\x12\x03\x0a\x01v"),
+		},
+		{
+			name: "should encode a gauge metric and leave out an empty description",
+			enc:  otlpMetric{Name: "m", Unit: "1", Gauge: otlpGauge{DataPoints: []otlpDataPoint{{TimeUnixNano: 1}}}},
+			exp: []byte("\x0a\x01m\x1a\x011" +
+				"\x2a\x0b\x0a\x09\x19\x01\x00\x00\x00\x00\x00\x00\x00"),
+		},
+		{
+			name: "should encode a log record",
+			enc: otlpLogRecord{
+				TimeUnixNano:         1,
+				ObservedTimeUnixNano: 2,
+				SeverityNumber:       otlpSeverityWarn,
+				SeverityText:         "WARN",
+				Body:                 otlpString("", "out").Value,
+				Attributes:           []otlpKeyValue{otlpInt("check.exit_code", 1)},
+			},
+			exp: []byte("\x09\x01\x00\x00\x00\x00\x00\x00\x00" +
+				"\x10\x0d" +
+				"\x1a\x04WARN" +
+				"\x2a\x05\x0a\x03out" +
+				"\x32\x15\x0a\x0fcheck.exit_code\x12\x02\x18\x01" +
+				"\x59\x02\x00\x00\x00\x00\x00\x00\x00"),
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			assert.Equal(t, io.exp, io.enc.protobuf())
+		})
+	}
+}
+
+func TestOTLP_json(t *testing.T) {
+	testIO := []struct {
+		name string
+		enc  otlpEncoder
+		exp  string
+	}{
+		{
+			name: "should encode int attributes as strings",
+			enc:  otlpInt("k", 5),
+			exp:  `{"key":"k","value":{"intValue":"5"}}`,
+		},
+		{
+			name: "should encode an int data point with its times and value as strings",
+			enc:  otlpDataPoint{TimeUnixNano: 1, AsInt: int64Ptr(2), Attributes: []otlpKeyValue{otlpString("k", "v")}},
+			exp:  `{"attributes":[{"key":"k","value":{"stringValue":"v"}}],"timeUnixNano":"1","asInt":"2"}`,
+		},
+		{
+			name: "should encode a double data point value as a number",
+			enc:  otlpDataPoint{TimeUnixNano: 1, AsDouble: float64Ptr(0.5)},
+			exp:  `{"timeUnixNano":"1","asDouble":0.5}`,
+		},
+		{
+			name: "should encode a log record",
+			enc: otlpLogRecord{
+				TimeUnixNano:         1,
+				ObservedTimeUnixNano: 2,
+				SeverityNumber:       otlpSeverityWarn,
+				SeverityText:         "WARN",
+				Body:                 otlpString("", "out").Value,
+				Attributes:           []otlpKeyValue{otlpInt("check.exit_code", 1)},
+			},
+			exp: `{"timeUnixNano":"1","observedTimeUnixNano":"2","severityNumber":13,"severityText":"WARN","body":{"stringValue":"out"},"attributes":[{"key":"check.exit_code","value":{"intValue":"1"}}]}`,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			data, err := json.Marshal(io.enc)
+			if assert.NoError(t, err) {
+				assert.Equal(t, io.exp, string(data))
+			}
+		})
+	}
+}
+
+func TestOTLPBackend_Send(t *testing.T) {
+	testIO := []struct {
+		name           string
+		format         string
+		expContentType string
+		expTime        string
+	}{
+		{
+			name:           "should export protobuf by default",
+			expContentType: "application/x-protobuf",
+			// the time of the data point or log record as a fixed64
+			expTime: "\x00\x00\x39\x6e\xfe\x75\x14\x16",
+		},
+		{
+			name:           "should export json when configured",
+			format:         otlpFormatJSON,
+			expContentType: "application/json",
+			expTime:        `"timeUnixNano":"1591026304000000000"`,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got, bodies []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				got = append(got, r.URL.Path+" "+r.Header.Get("Content-Type"))
+				bodies = append(bodies, string(body))
+				mu.Unlock()
+			}))
+			defer srv.Close()
+
+			p, err := NewOTLPBackend(strings.TrimPrefix(srv.URL, "http://"), "", "/otel/", io.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a result replayed from a spool is exported as of its run
+			res := &health.ExecResult{Container: "/web", Exit: 1, Time: time.Unix(1591026304, 0)}
+			hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+			assert.NoError(t, p.Send(msg.NewBackendMessage(hc, nil, res)))
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, []string{
+				"/otel/v1/metrics " + io.expContentType,
+				"/otel/v1/logs " + io.expContentType,
+			}, got)
+			for _, body := range bodies {
+				assert.Contains(t, body, io.expTime)
+			}
+		})
+	}
+}
+
+func TestNewBackendClient_otlpScheme(t *testing.T) {
+	p, err := NewBackendClient(types.OTLPBackend, config.BackendConfig{Server: "127.0.0.1:4318", Scheme: "https"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob := p.(*OTLPBackend)
+	assert.Equal(t, "https://127.0.0.1:4318/v1/metrics", ob.MetricsURL.String())
+	assert.Equal(t, "https://127.0.0.1:4318/v1/logs", ob.LogsURL.String())
+}
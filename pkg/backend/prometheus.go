@@ -1,57 +1,199 @@
 package backend
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/health"
 	"github.com/ideal-co/ogre/pkg/log"
 	msg "github.com/ideal-co/ogre/pkg/message"
 	"github.com/ideal-co/ogre/pkg/types"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// prometheusDefaultMetric is the prefix of the metric names when neither
+	// the container labels nor the backend config provide one.
+	prometheusDefaultMetric = "ogre_check"
+	// prometheusDefaultLabel is the value of the job label when neither the
+	// container labels nor the backend config provide one.
+	prometheusDefaultLabel = "ogre_job"
+)
+
+// prometheusLabels are the labels of every series, a series is unique to the
+// container, host (container hostname) and check it was reported for.
+var prometheusLabels = []string{"container", "host", "check", "job"}
+
 // PrometheusBackend satisfies the Platform interface and is responsible for
 // exposing health check metrics to be scraped by a prometheus instance via an
-// http endpoint.
+// http endpoint. Every container, host and check has its own series which
+// reflect the most recent result of that check, the series are only deleted
+// when the container the check belongs to stops.
 type PrometheusBackend struct {
-	CounterVec *prometheus.CounterVec
+	Registerer prometheus.Registerer
+	Server     *http.Server
 	MetricPath string
 	Metric     string
 	Label      string
+
+	// pushGateway is only set when results are pushed to a Pushgateway
+	pushGateway *pushGateway
+
+	// collectors are keyed by metric prefix so containers may choose their own
+	// metric names with the ogre.format.backend.prometheus.metric label
+	collectors map[string]*prometheusCollectors
+	// series tracks the labels reported for each container by ID so they can
+	// be deleted when it stops
+	series map[string]map[prometheusSeries]struct{}
+	mu     sync.Mutex
+}
+
+// prometheusCollectors are the collectors registered for a single prefix.
+type prometheusCollectors struct {
+	up       *prometheus.GaugeVec
+	exitCode *prometheus.GaugeVec
+	lastRun  *prometheus.GaugeVec
+	duration *prometheus.HistogramVec
+}
+
+// prometheusSeries identifies the series of a single check.
+type prometheusSeries struct {
+	prefix    string
+	host      string
+	check     string
+	job       string
+	container string
 }
 
-// NewPrometheusBackend takes three strings, a server (address) to listen on, a
-// metric name to register a prometheus collector under, and a resource path by
-// which a prometheus instance will scrap for metrics. The server string will be
-// passed as a colin separated address and port, i.e. 127.0.0.1:9099. The path
-// will be passed as a forward slash prefixed string representing the full path
-// to which your prometheus instance expects to scrape for metrics, most setups
-// use the resource path '/metrics' and will be the default.
-func NewPrometheusBackend(server, metric, path string) (Platform, error) {
-	pbe := &PrometheusBackend{MetricPath: path}
-	if len(metric) > 0 {
-		pbe.Metric = metric
-	} else {
-		pbe.Metric = "ogre_health_check"
-	}
-	pbe.CounterVec = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: pbe.Metric,
-			Help: "Ogre executed health checks.",
-		},
-		[]string{"host", "check", "health"},
-	)
-
-	// register the collector for prometheus to scrape
-	if err := prometheus.Register(pbe.CounterVec); err != nil {
+// labels returns the labels of the series.
+func (s prometheusSeries) labels() prometheus.Labels {
+	return prometheus.Labels{"container": s.container, "host": s.host, "check": s.check, "job": s.job}
+}
+
+// PrometheusConfig holds the values from the BackendConfig which are used to
+// establish a PrometheusBackend.
+type PrometheusConfig struct {
+	// Server is the colon separated address and port to listen on for scrapes,
+	// i.e. 127.0.0.1:9099.
+	Server string
+	// Metric is the metric name prefix used when a container does not provide
+	// its own, defaulting to 'ogre_check'.
+	Metric string
+	// Label is the value of the job label used when a container does not
+	// provide its own, defaulting to 'ogre_job'.
+	Label string
+	// ResourcePath is the path prometheus scrapes, defaulting to '/metrics'.
+	ResourcePath string
+	// TLSCert and TLSKey are the paths to a PEM encoded certificate and key,
+	// when both are set the scrape endpoint is served over https.
+	TLSCert string
+	TLSKey  string
+	// Username and Password, when set, are required of scrapes with basic auth.
+	Username string
+	Password string
+	// PushGateway is the URL of a Pushgateway to push results to, when set
+	// the scrape endpoint is only served should a Server also be set.
+	PushGateway string
+	// PushInterval is how often results are pushed, when zero each result is
+	// pushed as it is received.
+	PushInterval time.Duration
+}
+
+// NewPrometheusBackend takes a PrometheusConfig and returns a pointer to a
+// PrometheusBackend which satisfies the Platform interface, or an error. The
+// backend has its own registry and serves it on its own mux so nothing else in
+// the process is exposed to scrapes. The listener is bound before returning so
+// an address which is in use is reported when the daemon starts. Should a push
+// gateway be configured results are also pushed there, and the scrape endpoint
+// is only served if a server address was also configured.
+func NewPrometheusBackend(conf PrometheusConfig) (Platform, error) {
+	reg := prometheus.NewRegistry()
+	pbe := &PrometheusBackend{
+		Registerer: reg,
+		MetricPath: conf.ResourcePath,
+		Metric:     conf.Metric,
+		Label:      conf.Label,
+		collectors: make(map[string]*prometheusCollectors),
+		series:     make(map[string]map[prometheusSeries]struct{}),
+	}
+	if len(pbe.Metric) == 0 {
+		pbe.Metric = prometheusDefaultMetric
+	}
+	if len(pbe.Label) == 0 {
+		pbe.Label = prometheusDefaultLabel
+	}
+	if len(pbe.MetricPath) == 0 {
+		pbe.MetricPath = "/metrics"
+	}
+	if (len(conf.TLSCert) > 0) != (len(conf.TLSKey) > 0) {
+		return nil, fmt.Errorf("prometheus tls_cert and tls_key must be provided together")
+	}
+
+	// the process and runtime metrics which the global registry would have
+	// provided are still useful for monitoring ogre itself, as are the
+	// failures of the other backends
+	for _, col := range []prometheus.Collector{
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		deliveryFailures,
+	} {
+		if err := reg.Register(col); err != nil {
+			return nil, err
+		}
+	}
+
+	// register the collectors for the default prefix up front so a bad metric
+	// name in the config is reported when the daemon starts
+	if _, err := pbe.collectorsFor(pbe.Metric); err != nil {
 		return nil, err
 	}
 
-	// expose the handler and start the server to be scraped
-	http.Handle(pbe.MetricPath, promhttp.Handler())
-	go func() {
-		err := http.ListenAndServe(server, nil)
+	if len(conf.PushGateway) > 0 {
+		pbe.pushGateway = newPushGateway(conf.PushGateway, conf.PushInterval)
+		// short lived hosts may have nothing to scrape them at all
+		if len(conf.Server) == 0 {
+			return pbe, nil
+		}
+	}
+
+	var handler http.Handler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	if len(conf.Username) > 0 || len(conf.Password) > 0 {
+		handler = basicAuth(handler, conf.Username, conf.Password)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(pbe.MetricPath, handler)
+
+	pbe.Server = &http.Server{Handler: mux}
+	// load the certificate now as well so a bad one is reported when the
+	// daemon starts rather than by the go routine serving scrapes
+	if len(conf.TLSCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
 		if err != nil {
-			log.Daemon.Errorf("error starting prometheus server: %s", err)
+			return nil, fmt.Errorf("could not load prometheus tls_cert and tls_key: %s", err)
+		}
+		pbe.Server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	// bind now rather than in the go routine so the error can be returned
+	lis, err := net.Listen("tcp", conf.Server)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for prometheus scrapes: %s", err)
+	}
+	go func() {
+		var err error
+		if pbe.Server.TLSConfig != nil {
+			err = pbe.Server.ServeTLS(lis, "", "")
+		} else {
+			err = pbe.Server.Serve(lis)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Daemon.Errorf("error serving prometheus scrapes: %s", err)
 		}
 	}()
 
@@ -59,28 +201,110 @@ func NewPrometheusBackend(server, metric, path string) (Platform, error) {
 }
 
 // Send is the PrometheusBackend implementation of the Platform interface. Send
-// will take a Message and present a prometheus metric to be scraped. This will
-// expose to a prometheus instance a value of 1 should a health check be failing
-// and will other wise not report.
+// will take a Message and update the series for the container, host and check
+// it reports.
+// ogre_check_up is 1 for a passing check and 0 otherwise, ogre_check_exit_code
+// is the exit code, ogre_check_last_run_timestamp_seconds is the time the result
+// was received and ogre_check_duration_seconds observes the check duration.
 func (p *PrometheusBackend) Send(m msg.Message) error {
 	bem := m.(msg.BackendMessage)
-	host := bem.Data.Hostname
-	check := bem.CompletedCheck.String()
-	result := bem.Data.Exit
-
-	// we always want to attempt to register because the backend doesn't know
-	// if this is a 'new' check result or not, we don't concern ourselves with
-	// the error returned which would most often be an AlreadyRegisteredError
-	prometheus.Register(p.CounterVec)
-	if result >= 1 {
-		// to achieve binary reporting, we always reset the counter before adding
-		p.CounterVec.Reset()
-		p.CounterVec.With(prometheus.Labels{"host": host, "check": check, "health": "unhealthy"}).Add(1)
-	} else {
-		// if our exit code is 0, we reset the counter so as to stop reporting
-		p.CounterVec.Reset()
+	s := prometheusSeries{
+		prefix: p.Metric,
+		check:  bem.CompletedCheck.String(),
+		job:    p.Label,
 	}
+	// the labels of the container take precedence over the backend config
+	if dhc, ok := bem.CompletedCheck.(*health.DockerHealthCheck); ok && dhc.Formatter != nil {
+		if len(dhc.Formatter.Platform.Metric) > 0 {
+			s.prefix = dhc.Formatter.Platform.Metric
+		}
+		if len(dhc.Formatter.Platform.Label) > 0 {
+			s.job = dhc.Formatter.Platform.Label
+		}
+	}
+	var containerID string
+	var duration time.Duration
+	if bem.Data != nil {
+		s.host = bem.Data.Hostname
+		s.container = strings.TrimPrefix(bem.Data.Container, "/")
+		containerID = bem.Data.ContainerID
+		duration = bem.Data.Duration
+	}
+
+	p.mu.Lock()
+	c, err := p.collectorsFor(s.prefix)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+
+	labels := s.labels()
+	up := 0.0
+	if bem.Passed() {
+		up = 1
+	}
+	c.up.With(labels).Set(up)
+	c.exitCode.With(labels).Set(float64(bem.Exit()))
+	c.lastRun.With(labels).SetToCurrentTime()
+	c.duration.With(labels).Observe(duration.Seconds())
+
+	if _, ok := p.series[containerID]; !ok {
+		p.series[containerID] = make(map[prometheusSeries]struct{})
+	}
+	p.series[containerID][s] = struct{}{}
+	p.mu.Unlock()
+
+	// pushing may wait on the network so is done without holding the lock
+	if p.pushGateway != nil {
+		return p.pushGateway.record(s, pushResult{
+			exit:     bem.Exit(),
+			passed:   bem.Passed(),
+			duration: duration,
+			ts:       time.Now(),
+		})
+	}
+
+	return nil
+}
+
+// ContainerStopped is the PrometheusBackend implementation of the
+// ContainerStopper interface and deletes every series which was reported for
+// the container with the ID passed.
+func (p *PrometheusBackend) ContainerStopped(containerID string) {
+	p.mu.Lock()
+	series := p.series[containerID]
+	for s := range series {
+		c, ok := p.collectors[s.prefix]
+		if !ok {
+			continue
+		}
+		labels := s.labels()
+		c.up.Delete(labels)
+		c.exitCode.Delete(labels)
+		c.lastRun.Delete(labels)
+		c.duration.Delete(labels)
+	}
+	delete(p.series, containerID)
+	p.mu.Unlock()
 
+	// deleting from the Pushgateway may wait on the network so is done
+	// without holding the lock
+	if p.pushGateway != nil {
+		for s := range series {
+			p.pushGateway.remove(s)
+		}
+	}
+	log.Daemon.Tracef("prometheus backend removed series for container %s", containerID)
+}
+
+// Close stops pushing results to the Pushgateway and serving scrapes.
+func (p *PrometheusBackend) Close() error {
+	if p.pushGateway != nil {
+		p.pushGateway.close()
+	}
+	if p.Server != nil {
+		return p.Server.Close()
+	}
 	return nil
 }
 
@@ -89,3 +313,61 @@ func (p *PrometheusBackend) Send(m msg.Message) error {
 func (p *PrometheusBackend) Type() types.PlatformType {
 	return types.PrometheusBackend
 }
+
+// collectorsFor returns the collectors for a metric prefix, creating and
+// registering them the first time the prefix is seen. Callers are expected to
+// hold the mutex once the backend has been established.
+func (p *PrometheusBackend) collectorsFor(prefix string) (*prometheusCollectors, error) {
+	if c, ok := p.collectors[prefix]; ok {
+		return c, nil
+	}
+
+	c := &prometheusCollectors{
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_up",
+			Help: "Whether the most recent execution of an ogre health check passed (1) or failed (0).",
+		}, prometheusLabels),
+		exitCode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_exit_code",
+			Help: "Exit code of the most recent execution of an ogre health check.",
+		}, prometheusLabels),
+		lastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_last_run_timestamp_seconds",
+			Help: "Unix time of the most recent execution of an ogre health check.",
+		}, prometheusLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_duration_seconds",
+			Help:    "Duration of ogre health check executions.",
+			Buckets: prometheus.DefBuckets,
+		}, prometheusLabels),
+	}
+	cols := []prometheus.Collector{c.up, c.exitCode, c.lastRun, c.duration}
+	for i, col := range cols {
+		if err := p.Registerer.Register(col); err != nil {
+			// leave nothing half registered behind for the prefix
+			for _, reg := range cols[:i] {
+				p.Registerer.Unregister(reg)
+			}
+			return nil, err
+		}
+	}
+	p.collectors[prefix] = c
+
+	return c, nil
+}
+
+// basicAuth wraps a handler so that it is only served to requests with the
+// username and password passed.
+func basicAuth(next http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ogre"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPrometheusBackend_tls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogre-prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notPEM := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testIO := []struct {
+		name string
+		cert string
+		key  string
+		exp  string
+	}{
+		{
+			name: "should fail when only the certificate is provided",
+			cert: notPEM,
+			exp:  "must be provided together",
+		},
+		{
+			name: "should fail when the certificate does not exist",
+			cert: filepath.Join(dir, "missing.pem"),
+			key:  filepath.Join(dir, "missing.key"),
+			exp:  "could not load prometheus tls_cert and tls_key",
+		},
+		{
+			name: "should fail when the certificate is not PEM",
+			cert: notPEM,
+			key:  notPEM,
+			exp:  "could not load prometheus tls_cert and tls_key",
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			_, err := NewPrometheusBackend(PrometheusConfig{
+				Server:  "127.0.0.1:0",
+				TLSCert: io.cert,
+				TLSKey:  io.key,
+			})
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), io.exp)
+			}
+		})
+	}
+}
+
+func TestPrometheusBackend_Send(t *testing.T) {
+	p, err := NewPrometheusBackend(PrometheusConfig{Server: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbe := p.(*PrometheusBackend)
+	defer pbe.Server.Close()
+
+	// two containers sharing a hostname, i.e. with --network container:<name>
+	for _, container := range []string{"/web", "/sidecar"} {
+		res := &health.ExecResult{Container: container, ContainerID: container, Hostname: "daae3a5a717f", Exit: 1}
+		hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+		assert.NoError(t, p.Send(msg.NewBackendMessage(hc, nil, res)))
+	}
+	pbe.ContainerStopped("/sidecar")
+
+	families, err := pbe.Registerer.(prometheus.Gatherer).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]string
+	for _, family := range families {
+		if family.GetName() != "ogre_check_up" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			got = append(got, labels)
+		}
+	}
+	assert.Equal(t, []map[string]string{{
+		"check":     "https_open",
+		"container": "web",
+		"host":      "daae3a5a717f",
+		"job":       prometheusDefaultLabel,
+	}}, got)
+}
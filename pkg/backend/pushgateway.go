@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pushGateway pushes the most recent result of each check to a Prometheus
+// Pushgateway. Results are grouped by the container and check they belong to
+// so that every push replaces only the metrics of a single check, and so the
+// group can be deleted once the container stops.
+type pushGateway struct {
+	URL      string
+	Interval time.Duration
+	Client   *http.Client
+
+	// pending holds the latest result of each series which has yet to be
+	// pushed when pushing on an interval
+	pending map[prometheusSeries]pushResult
+	mu      sync.Mutex
+	// pushMu serialises the pushes and deletes so the delete of a group is
+	// never overtaken by a push of a result taken before it
+	pushMu sync.Mutex
+
+	closed  bool
+	stop    chan struct{}
+	flushed chan struct{}
+}
+
+// pushResult is the state of a single check at the time it reported.
+type pushResult struct {
+	exit     int
+	passed   bool
+	duration time.Duration
+	ts       time.Time
+}
+
+// newPushGateway returns a pointer to a pushGateway for the URL passed. With an
+// interval of zero results are pushed as they are received, otherwise they are
+// collected and pushed together on each tick of the interval.
+func newPushGateway(url string, interval time.Duration) *pushGateway {
+	pg := &pushGateway{
+		URL:      url,
+		Interval: interval,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		pending:  make(map[prometheusSeries]pushResult),
+		stop:     make(chan struct{}),
+		flushed:  make(chan struct{}),
+	}
+	if pg.Interval > 0 {
+		go pg.flushLoop()
+	} else {
+		close(pg.flushed)
+	}
+	return pg
+}
+
+// record pushes the result of a series or holds on to it until the next flush,
+// an error is only returned for results pushed immediately.
+func (pg *pushGateway) record(s prometheusSeries, res pushResult) error {
+	if pg.Interval > 0 {
+		pg.mu.Lock()
+		pg.pending[s] = res
+		pg.mu.Unlock()
+		return nil
+	}
+
+	pg.pushMu.Lock()
+	defer pg.pushMu.Unlock()
+	return pg.push(s, res)
+}
+
+// remove deletes the group of a series from the Pushgateway. A flush which
+// already took the pending result of the series pushes it before the delete.
+func (pg *pushGateway) remove(s prometheusSeries) {
+	pg.mu.Lock()
+	delete(pg.pending, s)
+	pg.mu.Unlock()
+
+	pg.pushMu.Lock()
+	defer pg.pushMu.Unlock()
+	if err := pg.pusher(s).Delete(); err != nil {
+		log.Daemon.Errorf("could not delete push gateway group for %s %s: %s", s.container, s.check, err)
+	}
+}
+
+// close stops the flushing of pending results and waits on a flush which is
+// under way to finish.
+func (pg *pushGateway) close() {
+	pg.mu.Lock()
+	if !pg.closed {
+		pg.closed = true
+		close(pg.stop)
+	}
+	pg.mu.Unlock()
+
+	<-pg.flushed
+}
+
+// flushLoop pushes every pending result on each tick of the interval until the
+// pushGateway is closed.
+func (pg *pushGateway) flushLoop() {
+	defer close(pg.flushed)
+	tick := time.NewTicker(pg.Interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-pg.stop:
+			return
+		case <-tick.C:
+			pg.flush()
+		}
+	}
+}
+
+// flush pushes every pending result.
+func (pg *pushGateway) flush() {
+	pg.pushMu.Lock()
+	defer pg.pushMu.Unlock()
+
+	pg.mu.Lock()
+	pending := pg.pending
+	pg.pending = make(map[prometheusSeries]pushResult)
+	pg.mu.Unlock()
+
+	for s, res := range pending {
+		if err := pg.push(s, res); err != nil {
+			log.Daemon.Errorf("could not push %s %s to push gateway: %s", s.container, s.check, err)
+		}
+	}
+}
+
+// push replaces the metrics of the series' group with those of the result.
+// The check and container are part of the grouping key, so only the host is
+// a label of the pushed metrics themselves. Callers are expected to hold the
+// pushMu.
+func (pg *pushGateway) push(s prometheusSeries, res pushResult) error {
+	labels := []string{"host"}
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: s.prefix + "_up",
+		Help: "Whether the most recent execution of an ogre health check passed (1) or failed (0).",
+	}, labels)
+	exitCode := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: s.prefix + "_exit_code",
+		Help: "Exit code of the most recent execution of an ogre health check.",
+	}, labels)
+	lastRun := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: s.prefix + "_last_run_timestamp_seconds",
+		Help: "Unix time of the most recent execution of an ogre health check.",
+	}, labels)
+	duration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: s.prefix + "_last_duration_seconds",
+		Help: "Duration of the most recent execution of an ogre health check.",
+	}, labels)
+
+	hostLabel := prometheus.Labels{"host": s.host}
+	if res.passed {
+		up.With(hostLabel).Set(1)
+	} else {
+		up.With(hostLabel).Set(0)
+	}
+	exitCode.With(hostLabel).Set(float64(res.exit))
+	lastRun.With(hostLabel).Set(float64(res.ts.UnixNano()) / 1e9)
+	duration.With(hostLabel).Set(res.duration.Seconds())
+
+	err := pg.pusher(s).
+		Collector(up).
+		Collector(exitCode).
+		Collector(lastRun).
+		Collector(duration).
+		Push()
+	if err != nil {
+		return fmt.Errorf("could not push to push gateway: %s", err)
+	}
+	return nil
+}
+
+// pusher returns a push.Pusher for the group of a series.
+func (pg *pushGateway) pusher(s prometheusSeries) *push.Pusher {
+	container := s.container
+	if len(container) == 0 {
+		container = "unknown"
+	}
+	return push.New(pg.URL, s.job).
+		Client(pg.Client).
+		Grouping("container", container).
+		Grouping("check", s.check)
+}
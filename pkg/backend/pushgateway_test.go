@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pushGatewayStandIn records the method and path of every request made to it.
+// The pusher writes the grouping labels following the job in no set order, so
+// they are recorded sorted by name.
+type pushGatewayStandIn struct {
+	requests []string
+	mu       sync.Mutex
+}
+
+func (ps *pushGatewayStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.mu.Lock()
+	ps.requests = append(ps.requests, r.Method+" "+sortGrouping(r.URL.EscapedPath()))
+	ps.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (ps *pushGatewayStandIn) received() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.requests
+}
+
+// sortGrouping sorts the label pairs of a /metrics/job/<job>/... path by name.
+func sortGrouping(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 4 {
+		return path
+	}
+	var pairs []string
+	for i := 4; i+1 < len(parts); i += 2 {
+		pairs = append(pairs, parts[i]+"/"+parts[i+1])
+	}
+	sort.Strings(pairs)
+	return strings.Join(append(parts[:4], pairs...), "/")
+}
+
+func TestPushGateway_groupingKey(t *testing.T) {
+	testIO := []struct {
+		name   string
+		series prometheusSeries
+		exp    []string
+	}{
+		{
+			name:   "should group by job, container and check",
+			series: prometheusSeries{prefix: "ogre_check", job: "ogre_job", container: "web", check: "https_open", host: "daae3a5a717f"},
+			exp: []string{
+				"PUT /metrics/job/ogre_job/check/https_open/container/web",
+				"DELETE /metrics/job/ogre_job/check/https_open/container/web",
+			},
+		},
+		{
+			name:   "should group a result without a container as unknown",
+			series: prometheusSeries{prefix: "ogre_check", job: "ogre_job", check: "https_open"},
+			exp: []string{
+				"PUT /metrics/job/ogre_job/check/https_open/container/unknown",
+				"DELETE /metrics/job/ogre_job/check/https_open/container/unknown",
+			},
+		},
+		{
+			name:   "should base64 encode a check holding a slash",
+			series: prometheusSeries{prefix: "ogre_check", job: "ogre_job", container: "web", check: "api/v1"},
+			exp: []string{
+				"PUT /metrics/job/ogre_job/check@base64/YXBpL3Yx/container/web",
+				"DELETE /metrics/job/ogre_job/check@base64/YXBpL3Yx/container/web",
+			},
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			standIn := &pushGatewayStandIn{}
+			srv := httptest.NewServer(standIn)
+			defer srv.Close()
+
+			pg := newPushGateway(srv.URL, 0)
+			assert.NoError(t, pg.record(io.series, pushResult{exit: 1, ts: time.Now()}))
+			pg.remove(io.series)
+			assert.Equal(t, io.exp, standIn.received())
+		})
+	}
+}
+
+// pushGatewayGroups is a Pushgateway stand-in which keeps the groups pushed
+// to it, holding every push until it is released.
+type pushGatewayGroups struct {
+	groups  map[string]bool
+	pushed  chan struct{}
+	release chan struct{}
+	mu      sync.Mutex
+}
+
+func (pg *pushGatewayGroups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	group := sortGrouping(r.URL.EscapedPath())
+	if r.Method == http.MethodPut {
+		pg.pushed <- struct{}{}
+		<-pg.release
+	}
+	pg.mu.Lock()
+	pg.groups[group] = r.Method == http.MethodPut
+	pg.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func TestPushGateway_removeDuringFlush(t *testing.T) {
+	standIn := &pushGatewayGroups{
+		groups:  make(map[string]bool),
+		pushed:  make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	// the interval is never reached, the flush is made by the test
+	pg := newPushGateway(srv.URL, time.Hour)
+	defer pg.close()
+
+	s := prometheusSeries{prefix: "ogre_check", job: "ogre_job", container: "web", check: "https_open"}
+	assert.NoError(t, pg.record(s, pushResult{exit: 1, ts: time.Now()}))
+
+	flushed := make(chan struct{})
+	go func() {
+		pg.flush()
+		close(flushed)
+	}()
+	<-standIn.pushed
+
+	// the container stops while the flush is pushing its result
+	removed := make(chan struct{})
+	go func() {
+		pg.remove(s)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+		t.Fatal("group was deleted before the push of its result finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(standIn.release)
+	<-flushed
+	<-removed
+
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	assert.Equal(t, map[string]bool{"/metrics/job/ogre_job/check/https_open/container/web": false}, standIn.groups)
+}
+
+func TestPushGateway_close(t *testing.T) {
+	standIn := &pushGatewayStandIn{}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	pg := newPushGateway(srv.URL, 10*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		pg.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push gateway did not stop flushing")
+	}
+
+	// nothing is pushed once it is closed
+	s := prometheusSeries{prefix: "ogre_check", job: "ogre_job", container: "web", check: "https_open"}
+	assert.NoError(t, pg.record(s, pushResult{exit: 1, ts: time.Now()}))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, standIn.received())
+}
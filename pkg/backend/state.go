@@ -0,0 +1,91 @@
+package backend
+
+import (
+	"sync"
+)
+
+const (
+	// statePassing is the state of a check whose most recent execution passed.
+	statePassing = "passing"
+	// stateFailing is the state of a check whose most recent execution failed.
+	stateFailing = "failing"
+)
+
+// stateTracker remembers the most recent state of every check so backends can
+// tell when a check has changed state, i.e. from passing to failing. Checks are
+// tracked by container ID so they can be forgotten when the container stops.
+type stateTracker struct {
+	states map[string]map[string]string
+	mu     sync.Mutex
+}
+
+// stateTransition is the state of a check before and after a result.
+type stateTransition struct {
+	ContainerID string
+	Check       string
+	// Previous is empty for the first result of a check
+	Previous string
+	Current  string
+}
+
+// Changed reports whether the state of the check is different to its previous
+// state, the first result of a check is only a change should it be failing.
+func (st stateTransition) Changed() bool {
+	if len(st.Previous) == 0 {
+		return st.Current == stateFailing
+	}
+	return st.Previous != st.Current
+}
+
+// newStateTracker returns a pointer to an empty stateTracker.
+func newStateTracker() *stateTracker {
+	return &stateTracker{
+		states: make(map[string]map[string]string),
+	}
+}
+
+// observe records the state of a check for a container and returns the
+// transition from the state previously recorded.
+func (st *stateTracker) observe(containerID, check string, passed bool) stateTransition {
+	trans := st.transition(containerID, check, passed)
+	st.record(trans)
+	return trans
+}
+
+// transition returns the transition from the state recorded for a check of a
+// container without recording the new state, for backends which only record
+// it once the result is delivered.
+func (st *stateTracker) transition(containerID, check string, passed bool) stateTransition {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	current := stateFailing
+	if passed {
+		current = statePassing
+	}
+	return stateTransition{
+		ContainerID: containerID,
+		Check:       check,
+		Previous:    st.states[containerID][check],
+		Current:     current,
+	}
+}
+
+// record records the current state of a transition.
+func (st *stateTracker) record(trans stateTransition) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.states[trans.ContainerID]; !ok {
+		st.states[trans.ContainerID] = make(map[string]string)
+	}
+	st.states[trans.ContainerID][trans.Check] = trans.Current
+}
+
+// forget removes the states of every check of a container.
+func (st *stateTracker) forget(containerID string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.states, containerID)
+}
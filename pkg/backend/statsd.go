@@ -1,47 +1,177 @@
 package backend
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/cactus/go-statsd-client/statsd"
 	"github.com/ideal-co/ogre/pkg/log"
 	msg "github.com/ideal-co/ogre/pkg/message"
 	"github.com/ideal-co/ogre/pkg/types"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 )
 
+const (
+	// statsdGauge reports the exit code of the check as a gauge under the
+	// metric name itself.
+	statsdGauge = "gauge"
+	// statsdTiming reports the duration of the check in milliseconds under
+	// the metric name with a '.duration' suffix.
+	statsdTiming = "timing"
+	// statsdCounter counts failed executions of the check under the metric
+	// name with a '.failures' suffix.
+	statsdCounter = "counter"
+
+	// statsdDefaultTemplate names metrics after the check alone.
+	statsdDefaultTemplate = "{{.Check}}"
+
+	// statsdTagsDog writes tags in the DogStatsD format, name:1|g|#key:value
+	statsdTagsDog = "dogstatsd"
+	// statsdTagsInflux writes tags in the Influx/Telegraf format,
+	// name,key=value:1|g
+	statsdTagsInflux = "influx"
+)
+
+// statsdUnsafe matches the characters which may not appear in a stat name or
+// tag, and are replaced with an underscore.
+var statsdUnsafe = regexp.MustCompile(`[^a-zA-Z0-9\-_.]`)
+
 // StatsdBackend implements the Platform interface and is responsible for the
-// sending of health check results to a statsd instance.
+// sending of health check results to a statsd instance. Each result may be
+// reported as a gauge of the exit code, a timing of the duration and a counter
+// of failures, optionally tagged with the container, image and host.
 type StatsdBackend struct {
-	Client statsd.Statter
+	Client   statsd.Statter
+	Name     *template.Template
+	Metrics  []string
+	TagStyle string
+}
+
+// StatsdConfig holds the values from the BackendConfig which are used to
+// establish a StatsdBackend.
+type StatsdConfig struct {
+	// Server is the address of the statsd instance.
+	Server string
+	// Prefix is prepended to every metric name.
+	Prefix string
+	// NameTemplate is a text/template rendering the metric name from the
+	// Check, Container, Image and Host of a result, defaulting to '{{.Check}}'.
+	NameTemplate string
+	// Metrics are the kinds of metric sent for each result, any of 'gauge',
+	// 'timing' and 'counter', defaulting to 'gauge'. The metric name was a
+	// counter incremented by the exit code before the kinds could be chosen.
+	Metrics []string
+	// Tags is the format of the container, image and host tags, either
+	// 'dogstatsd' or 'influx'. When empty no tags are sent.
+	Tags string
 }
 
-// NewStatsdClient takes two strings, an address and a prefix and returns a new
-// pointer to StatsdBackend which satisfies the Platform interface, or an error.
-// If no prefix is provided, the field will be an empty string.
-func NewStatsdClient(addr, prefix string) (Platform, error) {
-	conf := &statsd.ClientConfig{
-		Address: addr,
-		Prefix:  prefix,
+// statsdNameData is passed to the name template of a StatsdBackend.
+type statsdNameData struct {
+	Check     string
+	Container string
+	Image     string
+	Host      string
+}
+
+// NewStatsdClient takes a StatsdConfig and returns a new pointer to
+// StatsdBackend which satisfies the Platform interface, or an error. If no
+// prefix is provided, the field will be an empty string.
+func NewStatsdClient(conf StatsdConfig) (Platform, error) {
+	nameTmpl := conf.NameTemplate
+	if len(nameTmpl) == 0 {
+		nameTmpl = statsdDefaultTemplate
+	}
+	name, err := template.New("statsd").Option("missingkey=error").Parse(nameTmpl)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse statsd name_template: %s", err)
+	}
+
+	metrics := conf.Metrics
+	if len(metrics) == 0 {
+		metrics = []string{statsdGauge}
+	}
+	for _, kind := range metrics {
+		switch kind {
+		case statsdGauge, statsdTiming, statsdCounter:
+		default:
+			return nil, fmt.Errorf("statsd metrics must be gauge, timing or counter, got %s", kind)
+		}
 	}
 
-	client, err := statsd.NewClientWithConfig(conf)
+	switch conf.Tags {
+	case "", statsdTagsDog, statsdTagsInflux:
+	default:
+		return nil, fmt.Errorf("statsd tags must be dogstatsd or influx, got %s", conf.Tags)
+	}
+
+	client, err := statsd.NewClientWithConfig(&statsd.ClientConfig{
+		Address: conf.Server,
+		Prefix:  conf.Prefix,
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	be := &StatsdBackend{
-		Client: client,
+		Client:   client,
+		Name:     name,
+		Metrics:  metrics,
+		TagStyle: conf.Tags,
 	}
 
 	return be, nil
 }
 
 // Send is the StatsdBackend's implementation of the Platform interface Send
-// method. Send takes a Message and sends a metric to a statsd backend equal
-// to that of the exit code of the health check. An error is returned on a
-// failure to send.
+// method. Send takes a Message and sends each of the configured metric kinds
+// for the health check. An error is returned on a failure to send.
 func (sdb *StatsdBackend) Send(m msg.Message) error {
 	bem := m.(msg.BackendMessage)
 	log.Daemon.Tracef("statsd client listen got %+v", bem)
-	return sdb.Client.Inc(bem.CompletedCheck.String(), int64(bem.CompletedCheck.ExitCode()), 1.0)
+
+	data := statsdNameData{Check: bem.CompletedCheck.String()}
+	var duration time.Duration
+	if bem.Data != nil {
+		data.Container = strings.TrimPrefix(bem.Data.Container, "/")
+		data.Image = bem.Data.Image
+		data.Host = bem.Data.Hostname
+		duration = bem.Data.Duration
+	}
+
+	var buf bytes.Buffer
+	if err := sdb.Name.Execute(&buf, data); err != nil {
+		return fmt.Errorf("could not render statsd metric name: %s", err)
+	}
+	name := statsdUnsafe.ReplaceAllString(buf.String(), "_")
+	tags := [][2]string{
+		{"container", data.Container},
+		{"image", data.Image},
+		{"host", data.Host},
+	}
+
+	for _, kind := range sdb.Metrics {
+		var err error
+		switch kind {
+		case statsdGauge:
+			err = sdb.send(name, strconv.Itoa(bem.Exit()), "g", tags)
+		case statsdTiming:
+			ms := strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', -1, 64)
+			err = sdb.send(name+".duration", ms, "ms", tags)
+		case statsdCounter:
+			if !bem.Passed() {
+				err = sdb.send(name+".failures", "1", "c", tags)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("could not send %s for statsd: %s", kind, err)
+		}
+	}
+
+	return nil
 }
 
 // Type is the StatsdBackend implementation of the Platform interface Type
@@ -49,3 +179,28 @@ func (sdb *StatsdBackend) Send(m msg.Message) error {
 func (sdb *StatsdBackend) Type() types.PlatformType {
 	return types.StatsdBackend
 }
+
+// send writes a single stat with the tags in the configured style. Without a
+// tag style this is equivalent to the typed methods of the statsd client.
+func (sdb *StatsdBackend) send(name, value, kind string, tags [][2]string) error {
+	value = value + "|" + kind
+	switch sdb.TagStyle {
+	case statsdTagsDog:
+		var dog []string
+		for _, tag := range tags {
+			if len(tag[1]) > 0 {
+				dog = append(dog, tag[0]+":"+statsdUnsafe.ReplaceAllString(tag[1], "_"))
+			}
+		}
+		if len(dog) > 0 {
+			value = value + "|#" + strings.Join(dog, ",")
+		}
+	case statsdTagsInflux:
+		for _, tag := range tags {
+			if len(tag[1]) > 0 {
+				name = name + "," + tag[0] + "=" + statsdUnsafe.ReplaceAllString(tag[1], "_")
+			}
+		}
+	}
+	return sdb.Client.Raw(name, value, 1.0)
+}
@@ -0,0 +1,91 @@
+package backend
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdBackend_Send(t *testing.T) {
+	testIO := []struct {
+		name         string
+		nameTemplate string
+		metrics      []string
+		tags         string
+		exp          []string
+	}{
+		{
+			name: "should send the exit code as an untagged gauge",
+			exp:  []string{"ogre.https_open:1|g"},
+		},
+		{
+			name: "should tag in the dogstatsd format",
+			tags: statsdTagsDog,
+			exp:  []string{"ogre.https_open:1|g|#container:web,image:nginx_1.19,host:daae3a5a717f"},
+		},
+		{
+			name: "should tag in the influx format",
+			tags: statsdTagsInflux,
+			exp:  []string{"ogre.https_open,container=web,image=nginx_1.19,host=daae3a5a717f:1|g"},
+		},
+		{
+			name:    "should send a timing and a failure counter",
+			metrics: []string{statsdGauge, statsdTiming, statsdCounter},
+			tags:    statsdTagsDog,
+			exp: []string{
+				"ogre.https_open:1|g|#container:web,image:nginx_1.19,host:daae3a5a717f",
+				"ogre.https_open.duration:12.5|ms|#container:web,image:nginx_1.19,host:daae3a5a717f",
+				"ogre.https_open.failures:1|c|#container:web,image:nginx_1.19,host:daae3a5a717f",
+			},
+		},
+		{
+			name:         "should render the name template and replace unsafe characters",
+			nameTemplate: "{{.Container}}.{{.Check}}/{{.Image}}",
+			exp:          []string{"ogre.web.https_open_nginx_1.19:1|g"},
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			p, err := NewStatsdClient(StatsdConfig{
+				Server:       conn.LocalAddr().String(),
+				Prefix:       "ogre",
+				NameTemplate: io.nameTemplate,
+				Metrics:      io.metrics,
+				Tags:         io.tags,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := &health.ExecResult{
+				Container: "/web",
+				Image:     "nginx:1.19",
+				Hostname:  "daae3a5a717f",
+				Exit:      1,
+				Duration:  12500 * time.Microsecond,
+			}
+			hc := &health.DockerHealthCheck{Name: "https_open", Result: res}
+			assert.NoError(t, p.Send(msg.NewBackendMessage(hc, nil, res)))
+
+			var got []string
+			buf := make([]byte, 512)
+			for range io.exp {
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, string(buf[:n]))
+			}
+			assert.Equal(t, io.exp, got)
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// syslogDialTimeout is the amount of time we are willing to wait on a
+	// syslog receiver to accept a connection before giving up on a send.
+	syslogDialTimeout = 5 * time.Second
+	// syslogDefaultSocket is the local syslog socket used when a unix socket
+	// is requested without a server.
+	syslogDefaultSocket = "/dev/log"
+	// journaldSocket is the socket of the native journal protocol.
+	journaldSocket = "/run/systemd/journal/socket"
+	// syslogSDID identifies the structured data element of each message, the
+	// enterprise number is the one reserved for documentation by RFC 5612.
+	syslogSDID = "ogre@32473"
+
+	syslogSeverityErr     = 3
+	syslogSeverityWarning = 4
+	syslogSeverityInfo    = 6
+)
+
+// syslogFacilities maps the names of the facilities to their codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogBackend satisfies the Platform interface and is responsible for the
+// sending of health check results as RFC 5424 syslog messages over udp, tcp,
+// tls or a local unix socket, or as native journald entries. The severity is
+// derived from the exit code, 0 is info, 1 is warning and anything else err.
+type SyslogBackend struct {
+	Network  string
+	Address  string
+	Facility int
+	AppName  string
+	Hostname string
+
+	tlsConf *tls.Config
+	conn    net.Conn
+	mu      sync.Mutex
+}
+
+// SyslogConfig holds the values from the BackendConfig which are used to
+// establish a SyslogBackend.
+type SyslogConfig struct {
+	// Server is the address of the syslog receiver, or the path of the socket
+	// for the unix and journald protocols.
+	Server string
+	// Protocol is one of 'udp' (default), 'tcp', 'tls', 'unix' or 'journald'.
+	Protocol string
+	// Facility is the name of the syslog facility, defaulting to 'daemon'.
+	Facility string
+	// AppName identifies ogre in each message, defaulting to 'ogre'.
+	AppName string
+	// TLSCA, TLSCert, TLSKey and InsecureSkipVerify configure the tls protocol
+	// in the same way as for the http backend.
+	TLSCA              string
+	TLSCert            string
+	TLSKey             string
+	InsecureSkipVerify bool
+}
+
+// NewSyslogBackend takes a SyslogConfig and returns a pointer to SyslogBackend
+// which satisfies the Platform interface, or an error. The connection is
+// established here so a misconfigured address is reported when the daemon
+// starts rather than on the first health check.
+func NewSyslogBackend(conf SyslogConfig) (Platform, error) {
+	sb := &SyslogBackend{
+		Network: conf.Protocol,
+		Address: conf.Server,
+		AppName: conf.AppName,
+	}
+	if len(sb.Network) == 0 {
+		sb.Network = "udp"
+	}
+	if len(sb.AppName) == 0 {
+		sb.AppName = "ogre"
+	}
+
+	facility := conf.Facility
+	if len(facility) == 0 {
+		facility = "daemon"
+	}
+	code, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %s", facility)
+	}
+	sb.Facility = code
+
+	switch sb.Network {
+	case "udp", "tcp":
+	case "tls":
+		tlsConf, err := newClientTLSConfig(conf.TLSCA, conf.TLSCert, conf.TLSKey, conf.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConf == nil {
+			tlsConf = &tls.Config{}
+		}
+		sb.tlsConf = tlsConf
+	case "unix":
+		if len(sb.Address) == 0 {
+			sb.Address = syslogDefaultSocket
+		}
+	case "journald":
+		if len(sb.Address) == 0 {
+			sb.Address = journaldSocket
+		}
+	default:
+		return nil, fmt.Errorf("syslog protocol must be udp, tcp, tls, unix or journald, got %s", sb.Network)
+	}
+
+	host, err := os.Hostname()
+	if err != nil || len(host) == 0 {
+		host = "-"
+	}
+	sb.Hostname = host
+
+	if err := sb.connect(); err != nil {
+		return nil, err
+	}
+
+	return sb, nil
+}
+
+// Send is the SyslogBackend implementation of the Platform interface Send
+// method. Send takes a Message and writes a single syslog message or journal
+// entry. Should the write fail, the connection is re-established and the write
+// is attempted once more before an error is returned.
+func (sb *SyslogBackend) Send(m msg.Message) error {
+	bem := m.(msg.BackendMessage)
+	var data []byte
+	if sb.Network == "journald" {
+		data = sb.formatJournal(bem)
+	} else {
+		data = sb.frame(sb.format(bem, bem.Time()))
+	}
+	log.Daemon.Tracef("syslog backend sending %q", data)
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.conn != nil {
+		_, err := sb.conn.Write(data)
+		if err == nil {
+			return nil
+		}
+		log.Daemon.Infof("syslog write to %s failed, reconnecting: %s", sb.Address, err)
+	}
+
+	if err := sb.connect(); err != nil {
+		return fmt.Errorf("could not reconnect to syslog: %s", err)
+	}
+	if _, err := sb.conn.Write(data); err != nil {
+		sb.close()
+		return fmt.Errorf("could not send message for syslog: %s", err)
+	}
+
+	return nil
+}
+
+// Type is the SyslogBackend implementation of the Platform interface Type
+// and returns a PlatformType of type SyslogBackend.
+func (sb *SyslogBackend) Type() types.PlatformType {
+	return types.SyslogBackend
+}
+
+// format builds the RFC 5424 message for a BackendMessage, i.e.
+// <28>1 2020-06-01T12:00:00.000000Z myhost ogre - check [ogre@32473 check="foo" container="bar" exit="1" host="baz"] check foo of bar exited 1
+func (sb *SyslogBackend) format(bem msg.BackendMessage, ts time.Time) string {
+	var container, host string
+	if bem.Data != nil {
+		container = strings.TrimPrefix(bem.Data.Container, "/")
+		host = bem.Data.Hostname
+	}
+	check := bem.CompletedCheck.String()
+	exit := bem.Exit()
+
+	var b strings.Builder
+	pri := sb.Facility*8 + syslogSeverity(exit)
+	b.WriteString("<" + strconv.Itoa(pri) + ">1 ")
+	b.WriteString(ts.UTC().Format("2006-01-02T15:04:05.000000Z07:00") + " ")
+	b.WriteString(syslogHeader(sb.Hostname, 255) + " ")
+	b.WriteString(syslogHeader(sb.AppName, 48) + " - check ")
+
+	b.WriteString("[" + syslogSDID)
+	for _, param := range [][2]string{
+		{"check", check},
+		{"container", container},
+		{"exit", strconv.Itoa(exit)},
+		{"host", host},
+	} {
+		if len(param[1]) == 0 {
+			continue
+		}
+		b.WriteString(" " + param[0] + `="` + syslogEscape(param[1]) + `"`)
+	}
+	b.WriteString("] ")
+
+	b.WriteString(fmt.Sprintf("check %s of %s exited %d", check, container, exit))
+	return b.String()
+}
+
+// frame prepares a message to be written to the connection, stream transports
+// use octet counting as described by RFC 6587 so messages may contain newlines.
+func (sb *SyslogBackend) frame(message string) []byte {
+	switch sb.Network {
+	case "tcp", "tls":
+		return []byte(strconv.Itoa(len(message)) + " " + message)
+	}
+	return []byte(message)
+}
+
+// formatJournal builds the native journal protocol entry for a BackendMessage,
+// each field is written as KEY=value, or in the binary form should the value
+// hold a newline.
+func (sb *SyslogBackend) formatJournal(bem msg.BackendMessage) []byte {
+	var container, host, stdout, stderr string
+	if bem.Data != nil {
+		container = strings.TrimPrefix(bem.Data.Container, "/")
+		host = bem.Data.Hostname
+		stdout = bem.Data.StdOut
+		stderr = bem.Data.StdErr
+	}
+	check := bem.CompletedCheck.String()
+	exit := bem.Exit()
+
+	var b bytes.Buffer
+	for _, field := range [][2]string{
+		{"MESSAGE", fmt.Sprintf("check %s of %s exited %d", check, container, exit)},
+		{"PRIORITY", strconv.Itoa(syslogSeverity(exit))},
+		{"SYSLOG_FACILITY", strconv.Itoa(sb.Facility)},
+		{"SYSLOG_IDENTIFIER", sb.AppName},
+		{"OGRE_CHECK", check},
+		{"OGRE_CONTAINER", container},
+		{"OGRE_HOST", host},
+		{"OGRE_EXIT", strconv.Itoa(exit)},
+		{"OGRE_STDOUT", stdout},
+		{"OGRE_STDERR", stderr},
+	} {
+		if len(field[1]) == 0 {
+			continue
+		}
+		if !strings.Contains(field[1], "\n") {
+			b.WriteString(field[0] + "=" + field[1] + "\n")
+			continue
+		}
+		b.WriteString(field[0] + "\n")
+		size := make([]byte, 8)
+		binary.LittleEndian.PutUint64(size, uint64(len(field[1])))
+		b.Write(size)
+		b.WriteString(field[1] + "\n")
+	}
+	return b.Bytes()
+}
+
+// connect closes any existing connection and dials the configured address.
+// Callers are expected to hold the mutex.
+func (sb *SyslogBackend) connect() error {
+	sb.close()
+
+	var conn net.Conn
+	var err error
+	switch sb.Network {
+	case "tls":
+		dialer := &net.Dialer{Timeout: syslogDialTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", sb.Address, sb.tlsConf)
+	case "unix", "journald":
+		conn, err = net.DialTimeout("unixgram", sb.Address, syslogDialTimeout)
+	default:
+		conn, err = net.DialTimeout(sb.Network, sb.Address, syslogDialTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	sb.conn = conn
+	return nil
+}
+
+// close tears down the connection if there is one. Callers are expected to
+// hold the mutex.
+func (sb *SyslogBackend) close() {
+	if sb.conn != nil {
+		sb.conn.Close()
+		sb.conn = nil
+	}
+}
+
+// syslogSeverity returns the severity of a health check result by exit code.
+func syslogSeverity(exit int) int {
+	switch exit {
+	case 0:
+		return syslogSeverityInfo
+	case 1:
+		return syslogSeverityWarning
+	default:
+		return syslogSeverityErr
+	}
+}
+
+// syslogHeader makes a value fit for a header field, which must be printable
+// ASCII without spaces and no longer than the max length.
+func syslogHeader(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+// syslogEscape escapes the characters which are special in the value of a
+// structured data parameter.
+func syslogEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "]", `\]`).Replace(s)
+}
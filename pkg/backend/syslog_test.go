@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func syslogResult(name string, res *health.ExecResult) msg.BackendMessage {
+	hc := &health.DockerHealthCheck{Name: name, Result: res}
+	return msg.NewBackendMessage(hc, nil, res).(msg.BackendMessage)
+}
+
+func TestSyslogBackend_format(t *testing.T) {
+	ts := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	testIO := []struct {
+		name     string
+		hostname string
+		bem      msg.BackendMessage
+		exp      string
+	}{
+		{
+			name:     "should report a passing check at info",
+			hostname: "ogre-host",
+			bem:      syslogResult("https_open", &health.ExecResult{Container: "/web", Hostname: "daae3a5a717f", Exit: 0}),
+			exp:      `<30>1 2020-06-01T12:00:00.000000Z ogre-host ogre - check [ogre@32473 check="https_open" container="web" exit="0" host="daae3a5a717f"] check https_open of web exited 0`,
+		},
+		{
+			name:     "should report an exit of 1 at warning",
+			hostname: "ogre-host",
+			bem:      syslogResult("https_open", &health.ExecResult{Container: "/web", Exit: 1}),
+			exp:      `<28>1 2020-06-01T12:00:00.000000Z ogre-host ogre - check [ogre@32473 check="https_open" container="web" exit="1"] check https_open of web exited 1`,
+		},
+		{
+			name:     "should escape the structured data parameter values",
+			hostname: "ogre-host",
+			bem:      syslogResult(`a"b\c]d`, &health.ExecResult{Container: "/web", Exit: 2}),
+			exp:      `<27>1 2020-06-01T12:00:00.000000Z ogre-host ogre - check [ogre@32473 check="a\"b\\c\]d" container="web" exit="2"] check a"b\c]d of web exited 2`,
+		},
+		{
+			name:     "should replace what is not printable in a header",
+			hostname: "ogre host",
+			bem:      syslogResult("https_open", &health.ExecResult{Container: "/web", Exit: 0}),
+			exp:      `<30>1 2020-06-01T12:00:00.000000Z ogre_host ogre - check [ogre@32473 check="https_open" container="web" exit="0"] check https_open of web exited 0`,
+		},
+		{
+			name:     "should use the nil value for an empty header",
+			hostname: "",
+			bem:      syslogResult("https_open", &health.ExecResult{Container: "/web", Exit: 0}),
+			exp:      `<30>1 2020-06-01T12:00:00.000000Z - ogre - check [ogre@32473 check="https_open" container="web" exit="0"] check https_open of web exited 0`,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			sb := &SyslogBackend{Facility: syslogFacilities["daemon"], AppName: "ogre", Hostname: io.hostname}
+			assert.Equal(t, io.exp, sb.format(io.bem, ts))
+		})
+	}
+}
+
+func TestSyslogBackend_frame(t *testing.T) {
+	testIO := []struct {
+		name    string
+		network string
+		message string
+		exp     []byte
+	}{
+		{
+			name:    "should octet count over tcp",
+			network: "tcp",
+			message: "<30>1 - - - - - -",
+			exp:     []byte("17 <30>1 - - - - - -"),
+		},
+		{
+			name:    "should octet count over tls including newlines",
+			network: "tls",
+			message: "<30>1 - - - - - - a\nb",
+			exp:     []byte("21 <30>1 - - - - - - a\nb"),
+		},
+		{
+			name:    "should count bytes rather than runes",
+			network: "tcp",
+			message: "é",
+			exp:     []byte("2 é"),
+		},
+		{
+			name:    "should send one message per datagram over udp",
+			network: "udp",
+			message: "<30>1 - - - - - -",
+			exp:     []byte("<30>1 - - - - - -"),
+		},
+		{
+			name:    "should send one message per datagram over a unix socket",
+			network: "unix",
+			message: "<30>1 - - - - - -",
+			exp:     []byte("<30>1 - - - - - -"),
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			sb := &SyslogBackend{Network: io.network}
+			assert.Equal(t, io.exp, sb.frame(io.message))
+		})
+	}
+}
+
+func TestSyslogBackend_formatJournal(t *testing.T) {
+	testIO := []struct {
+		name string
+		bem  msg.BackendMessage
+		exp  []byte
+	}{
+		{
+			name: "should write each field as KEY=value",
+			bem:  syslogResult("https_open", &health.ExecResult{Container: "/web", Hostname: "daae3a5a717f", Exit: 1, StdErr: "connection refused"}),
+			exp: []byte("MESSAGE=check https_open of web exited 1\n" +
+				"PRIORITY=4\n" +
+				"SYSLOG_FACILITY=3\n" +
+				"SYSLOG_IDENTIFIER=ogre\n" +
+				"OGRE_CHECK=https_open\n" +
+				"OGRE_CONTAINER=web\n" +
+				"OGRE_HOST=daae3a5a717f\n" +
+				"OGRE_EXIT=1\n" +
+				"OGRE_STDERR=connection refused\n"),
+		},
+		{
+			name: "should write a value holding a newline in the binary form",
+			bem:  syslogResult("https_open", &health.ExecResult{Container: "/web", Exit: 0, StdOut: "a\nb"}),
+			exp: []byte("MESSAGE=check https_open of web exited 0\n" +
+				"PRIORITY=6\n" +
+				"SYSLOG_FACILITY=3\n" +
+				"SYSLOG_IDENTIFIER=ogre\n" +
+				"OGRE_CHECK=https_open\n" +
+				"OGRE_CONTAINER=web\n" +
+				"OGRE_EXIT=0\n" +
+				"OGRE_STDOUT\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"),
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			sb := &SyslogBackend{Network: "journald", Facility: syslogFacilities["daemon"], AppName: "ogre"}
+			assert.Equal(t, io.exp, sb.formatJournal(io.bem))
+		})
+	}
+}
+
+func TestSyslogBackend_Send(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p, err := NewSyslogBackend(SyslogConfig{Server: conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a result replayed from a spool is sent as of its run
+	ts := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, p.Send(syslogResult("https_open", &health.ExecResult{Container: "/web", Exit: 1, Time: ts})))
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Regexp(t, `^<28>1 2020-06-01T12:00:00\.000000Z \S+ ogre - check `, string(buf[:n]))
+}
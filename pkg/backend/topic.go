@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"strings"
+	"text/template"
+)
+
+// topicTemplate renders the subject or topic a result is published to by the
+// message bus backends. Values of the check are escaped before they are
+// rendered so a container name cannot add levels to, or wildcards in, the
+// topic.
+type topicTemplate struct {
+	tmpl   *template.Template
+	escape func(string) string
+}
+
+// newTopicTemplate parses the template of a topic, falling back to the default
+// when none is configured.
+func newTopicTemplate(inline, def string, escape func(string) string) (*topicTemplate, error) {
+	if len(inline) == 0 {
+		inline = def
+	}
+	tmpl, err := template.New("topic").Funcs(templateFuncs).Option("missingkey=error").Parse(inline)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse topic template: %s", err)
+	}
+	return &topicTemplate{tmpl: tmpl, escape: escape}, nil
+}
+
+// render returns the topic of a BackendMessage.
+func (tt *topicTemplate) render(bem msg.BackendMessage) (string, error) {
+	td := newTemplateData(bem)
+	td.Check = tt.escape(td.Check)
+	td.Container = tt.escape(td.Container)
+	td.ContainerID = tt.escape(td.ContainerID)
+	td.Image = tt.escape(td.Image)
+	td.Host = tt.escape(td.Host)
+
+	var buf bytes.Buffer
+	if err := tt.tmpl.Execute(&buf, td); err != nil {
+		return "", fmt.Errorf("could not render topic template: %s", err)
+	}
+	topic := buf.String()
+	if len(topic) == 0 {
+		return "", fmt.Errorf("topic template rendered an empty topic")
+	}
+	return topic, nil
+}
+
+// topicEscaper returns an escape func replacing the separator and wildcards of
+// a topic, as well as whitespace, with an underscore. Empty values are
+// replaced with an underscore too so a level of the topic is never empty.
+func topicEscaper(special string) func(string) string {
+	return func(s string) string {
+		if len(s) == 0 {
+			return "_"
+		}
+		return strings.Map(func(r rune) rune {
+			if r <= ' ' || strings.ContainsRune(special, r) {
+				return '_'
+			}
+			return r
+		}, s)
+	}
+}
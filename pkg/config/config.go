@@ -28,6 +28,64 @@ NOTE: the backend config stanza
       "server": "127.0.0.1:9009",
       "format": "json",
       "resource_path": "/health"
+    },
+    {
+      "type": "graphite",
+      "server": "127.0.0.1:2003",
+      "prefix": "ogre",
+      "protocol": "tcp"
+    },
+    {
+      "type": "collectd",
+      "server": "127.0.0.1:25826",
+      "protocol": "udp"
+    },
+    {
+      "type": "influx",
+      "server": "127.0.0.1:8086",
+      "protocol": "http",
+      "database": "ogre"
+    },
+    {
+      "type": "otlp",
+      "server": "127.0.0.1:4318",
+      "scheme": "http",
+      "format": "protobuf"
+    },
+    {
+      "type": "syslog",
+      "server": "127.0.0.1:514",
+      "protocol": "udp",
+      "facility": "daemon"
+    },
+    {
+      "type": "alertmanager",
+      "server": "127.0.0.1:9093",
+      "resend_interval": "1m"
+    },
+    {
+      "type": "file",
+      "path": "/var/log/ogre/results.json",
+      "format": "json",
+      "max_bytes": 104857600,
+      "max_files": 5,
+      "compress": true
+    },
+    {
+      "type": "nats",
+      "server": "127.0.0.1:4222",
+      "topic": "ogre.{{.Host}}.{{.Container}}.{{.Check}}"
+    },
+    {
+      "type": "mqtt",
+      "server": "127.0.0.1:1883",
+      "qos": 1,
+      "retain": true
+    },
+    {
+      "type": "exec",
+      "command": "/usr/local/bin/ogre-pager",
+      "args": ["--team", "platform"]
     }
   ],
   "services": [
@@ -67,6 +125,8 @@ type DaemonConfig struct {
 	OgredBin         string          `json:"ogred_bin,omitempty"`
 	Log              LogConfig       `json:"log"`
 	Backends         []BackendConfig `json:"backends,omitempty"`
+	DefaultBackends  []string        `json:"default_backends,omitempty"`
+	CheckTimeout     string          `json:"check_timeout,omitempty"`
 	Services         []ServiceConfig `json:"services,omitempty"`
 }
 
@@ -86,17 +146,110 @@ type BackendConfig struct {
 	// shared
 	Type   string `json:"type"`
 	Server string `json:"server"`
+	// Name is used to route results to this backend with the label
+	// ogre.format.backend.name and defaults to the backend type, it must be
+	// set when more than one backend of the same type is configured.
+	Name string `json:"name,omitempty"`
+
+	// shared (delivery queue), batch_wait is a duration i.e. "1s" and
+	// drop_policy is one of drop-oldest, drop-newest or block
+	QueueSize  int    `json:"queue_size,omitempty"`
+	BatchSize  int    `json:"batch_size,omitempty"`
+	BatchWait  string `json:"batch_wait,omitempty"`
+	DropPolicy string `json:"drop_policy,omitempty"`
+
+	// shared (spool), spool_max_age is a duration i.e. "24h"
+	SpoolDir      string `json:"spool_dir,omitempty"`
+	SpoolMaxBytes int64  `json:"spool_max_bytes,omitempty"`
+	SpoolMaxAge   string `json:"spool_max_age,omitempty"`
 
-	// statsd
+	// statsd, graphite
 	Prefix string `json:"prefix,omitempty"`
 
-	// prometheus
+	// statsd, name_template is a text/template of the metric name, metrics are
+	// any of gauge, timing and counter, tags is either dogstatsd or influx.
+	// metrics defaults to gauge, the metric name used to be a counter
+	// incremented by the exit code
+	NameTemplate string   `json:"name_template,omitempty"`
+	Metrics      []string `json:"metrics,omitempty"`
+	Tags         string   `json:"tags,omitempty"`
+
+	// graphite, collectd, influx, syslog, nats, mqtt
+	Protocol string `json:"protocol,omitempty"`
+
+	// syslog
+	Facility string `json:"facility,omitempty"`
+	AppName  string `json:"app_name,omitempty"`
+
+	// prometheus, influx (measurement)
 	Label  string `json:"label,omitempty"`
 	Metric string `json:"metric,omitempty"`
 
-	// http(s)
+	// http(s), otlp, influx (resource path only), file (format only)
 	Format       string `json:"format,omitempty"`
 	ResourcePath string `json:"resource_path,omitempty"`
+
+	// http (alertmanager timeout only), timeout and the retry backoffs are
+	// durations i.e. "10s". For exec they are the acknowledgement timeout and
+	// the backoff of plugin restarts
+	Timeout         string `json:"timeout,omitempty"`
+	Retries         int    `json:"retries,omitempty"`
+	RetryBackoff    string `json:"retry_backoff,omitempty"`
+	RetryMaxBackoff string `json:"retry_max_backoff,omitempty"`
+
+	// prometheus (scrape endpoint), http (client certificate and auth), nats and
+	// mqtt (auth)
+	TLSCert  string `json:"tls_cert,omitempty"`
+	TLSKey   string `json:"tls_key,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// http, alertmanager, otlp, scheme is either http or https. The tls fields also
+	// apply to syslog, nats and mqtt over tls
+	Scheme             string            `json:"scheme,omitempty"`
+	TLSCA              string            `json:"tls_ca,omitempty"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify,omitempty"`
+	BearerToken        string            `json:"bearer_token,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+
+	// http, template is an inline text/template of the request body and
+	// template_file the path to one
+	Template     string `json:"template,omitempty"`
+	TemplateFile string `json:"template_file,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+
+	// prometheus (push gateway), push_interval is a duration i.e. "30s"
+	PushGateway  string `json:"push_gateway,omitempty"`
+	PushInterval string `json:"push_interval,omitempty"`
+
+	// alertmanager, resend_interval is a duration i.e. "1m"
+	AlertName      string            `json:"alert_name,omitempty"`
+	AlertLabels    map[string]string `json:"alert_labels,omitempty"`
+	ResendInterval string            `json:"resend_interval,omitempty"`
+
+	// file, rotate_interval is a duration i.e. "24h"
+	Path           string `json:"path,omitempty"`
+	MaxBytes       int64  `json:"max_bytes,omitempty"`
+	RotateInterval string `json:"rotate_interval,omitempty"`
+	MaxFiles       int    `json:"max_files,omitempty"`
+	Compress       bool   `json:"compress,omitempty"`
+
+	// nats, mqtt, topic is a text/template of the subject or topic. qos,
+	// retain and client_id are mqtt only
+	Topic    string `json:"topic,omitempty"`
+	QoS      int    `json:"qos,omitempty"`
+	Retain   bool   `json:"retain,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+
+	// exec, command is the path of the plugin and args its arguments
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+
+	// influx, nats (token only)
+	Database string `json:"database,omitempty"`
+	Org      string `json:"org,omitempty"`
+	Bucket   string `json:"bucket,omitempty"`
+	Token    string `json:"token,omitempty"`
 }
 
 // ServiceConfig is the structural representation of a service in the config
@@ -12,6 +12,8 @@ import (
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 const (
@@ -217,16 +219,75 @@ func (d *Daemon) establishClients() {
 				fmt.Printf("ogred not started check daemon log at %s\n", config.DaemonConf.Log.File)
 				log.Daemon.Fatalf("could not get backend %s: %s", bEnd.Type, err)
 			}
-			bes.Platforms[platform.Type()] = platform
+			// backends without a user chosen name are addressed by their type
+			name := bEnd.Name
+			if len(name) == 0 {
+				name = string(platform.Type())
+			}
+			if err = bes.AddPlatform(name, platform); err != nil {
+				fmt.Printf("ogred not started check daemon log at %s\n", config.DaemonConf.Log.File)
+				log.Daemon.Fatalf("could not add backend %s: %s", bEnd.Type, err)
+			}
+			queue, err := queueConfig(name, bEnd)
+			if err != nil {
+				fmt.Printf("ogred not started check daemon log at %s\n", config.DaemonConf.Log.File)
+				log.Daemon.Fatalf("could not configure queue of backend %s: %s", name, err)
+			}
+			bes.Queues[name] = queue
 		}
 	}
 
-	// always set up the default backend (log)
-	platform, err := backend.NewBackendClient(types.DefaultBackend, config.BackendConfig{})
-	if err != nil {
-		log.Daemon.Fatalf("cannot start daemon %s", err)
+	// always set up the default backend (log), unless a configured backend
+	// already goes by its name
+	if _, ok := bes.Platforms[string(types.DefaultBackend)]; ok {
+		log.Daemon.Infof("backend %s is configured, not adding the default", types.DefaultBackend)
+	} else {
+		platform, err := backend.NewBackendClient(types.DefaultBackend, config.BackendConfig{})
+		if err != nil {
+			log.Daemon.Fatalf("cannot start daemon %s", err)
+		}
+		if err = bes.AddPlatform(string(types.DefaultBackend), platform); err != nil {
+			log.Daemon.Fatalf("cannot start daemon %s", err)
+		}
+	}
+
+	// the backends for containers without backend labels must all exist
+	for _, name := range config.DaemonConf.DefaultBackends {
+		if _, ok := bes.Platforms[name]; !ok {
+			fmt.Printf("ogred not started check daemon log at %s\n", config.DaemonConf.Log.File)
+			log.Daemon.Fatalf("default backend %s does not match a configured backend", name)
+		}
+	}
+}
+
+// queueConfig returns the srvc.QueueConfig for the queue of a backend, or an
+// error should the config be invalid. Each backend spools to a directory of
+// its own name within the spool_dir so they may share the same spool_dir.
+func queueConfig(name string, bEnd config.BackendConfig) (srvc.QueueConfig, error) {
+	qc := srvc.QueueConfig{
+		Size:          bEnd.QueueSize,
+		BatchSize:     bEnd.BatchSize,
+		DropPolicy:    bEnd.DropPolicy,
+		SpoolMaxBytes: bEnd.SpoolMaxBytes,
+	}
+	if len(bEnd.SpoolDir) > 0 {
+		qc.SpoolDir = filepath.Join(bEnd.SpoolDir, name)
+	}
+	if len(bEnd.SpoolMaxAge) > 0 {
+		age, err := time.ParseDuration(bEnd.SpoolMaxAge)
+		if err != nil {
+			return qc, fmt.Errorf("could not parse spool_max_age: %s", err)
+		}
+		qc.SpoolMaxAge = age
+	}
+	if len(bEnd.BatchWait) > 0 {
+		wait, err := time.ParseDuration(bEnd.BatchWait)
+		if err != nil {
+			return qc, fmt.Errorf("could not parse batch_wait: %s", err)
+		}
+		qc.BatchWait = wait
 	}
-	bes.Platforms[types.DefaultBackend] = platform
+	return qc, qc.Validate()
 }
 
 // directIncomingMsg takes a message and pushes it over the corresponding
@@ -1,9 +1,16 @@
 package daemon
 
 import (
+	"context"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/ideal-co/ogre/pkg/config"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	srvc "github.com/ideal-co/ogre/pkg/service"
 	"github.com/ideal-co/ogre/pkg/types"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestDaemon_collectServices(t *testing.T) {
@@ -32,3 +39,132 @@ func TestDaemon_collectServices(t *testing.T) {
 		})
 	}
 }
+
+// eventsClient is a srvc.DockerAPIClient with no containers which passes on
+// the events it is given.
+type eventsClient struct {
+	events chan events.Message
+}
+
+func (ec *eventsClient) Events(ctx context.Context, options dockerTypes.EventsOptions) (<-chan events.Message, <-chan error) {
+	return ec.events, nil
+}
+
+func (ec *eventsClient) ContainerInspect(ctx context.Context, container string) (dockerTypes.ContainerJSON, error) {
+	return dockerTypes.ContainerJSON{}, nil
+}
+
+func (ec *eventsClient) ContainerList(ctx context.Context, options dockerTypes.ContainerListOptions) ([]dockerTypes.Container, error) {
+	return nil, nil
+}
+
+func (ec *eventsClient) ContainerExecAttach(ctx context.Context, execID string, config dockerTypes.ExecConfig) (dockerTypes.HijackedResponse, error) {
+	return dockerTypes.HijackedResponse{}, nil
+}
+
+func (ec *eventsClient) ContainerExecCreate(ctx context.Context, container string, config dockerTypes.ExecConfig) (dockerTypes.IDResponse, error) {
+	return dockerTypes.IDResponse{}, nil
+}
+
+func (ec *eventsClient) ContainerExecInspect(ctx context.Context, execID string) (dockerTypes.ContainerExecInspect, error) {
+	return dockerTypes.ContainerExecInspect{}, nil
+}
+
+func TestDaemon_containerStopped(t *testing.T) {
+	containers := []string{"abc123", "def456", "ghi789", "jkl012", "mno345"}
+
+	// docker reports both a stop and a die for a container which is stopped
+	client := &eventsClient{events: make(chan events.Message, 2*len(containers))}
+	for _, cid := range containers {
+		for _, action := range []string{"stop", "die"} {
+			client.events <- events.Message{
+				Type:   events.ContainerEventType,
+				Action: action,
+				Actor:  events.Actor{ID: cid},
+			}
+		}
+	}
+
+	d := New()
+	dockerIn := make(chan msg.Message)
+	ds, err := srvc.NewDockerServiceWithClient(client, d.In, dockerIn, d.Err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cid := range containers {
+		ds.RunningChecks[cid] = func() {}
+	}
+	backendIn := make(chan msg.Message)
+	d.services[types.DockerService] = ds
+	d.Out[types.DockerMessage] = dockerIn
+	d.Out[types.BackendMessage] = backendIn
+
+	stopped := make(chan struct{})
+	go func() {
+		ds.Start()
+		close(stopped)
+	}()
+	go d.listenChannel()
+
+	var got []string
+	for range containers {
+		select {
+		case m := <-backendIn:
+			bem := m.(msg.BackendMessage)
+			assert.Equal(t, "stop-health", bem.Action)
+			got = append(got, bem.Data.ContainerID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("daemon is stuck after the backends were told of %v", got)
+		}
+	}
+	assert.ElementsMatch(t, containers, got)
+
+	// the backends are told once per container, not once per event
+	select {
+	case m := <-backendIn:
+		t.Errorf("unexpected message for the backends %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	d.ctx.Cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("docker service did not stop")
+	}
+}
+
+func TestDaemon_establishClients(t *testing.T) {
+	testIO := []struct {
+		name     string
+		backends []config.BackendConfig
+		expType  types.PlatformType
+	}{
+		{
+			name:    "should add the default backend",
+			expType: types.DefaultBackend,
+		},
+		{
+			name:     "should not replace a configured backend named as the default",
+			backends: []config.BackendConfig{{Type: string(types.GraphiteBackend), Name: string(types.DefaultBackend), Server: "127.0.0.1:2003", Protocol: "udp"}},
+			expType:  types.GraphiteBackend,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			defer func(backends []config.BackendConfig) {
+				config.DaemonConf.Backends = backends
+			}(config.DaemonConf.Backends)
+			config.DaemonConf.Backends = io.backends
+
+			d := New()
+			bes, _ := srvc.NewBackendService(d.In, make(chan msg.Message), d.Err)
+			d.services[types.BackendService] = bes
+			d.establishClients()
+
+			if assert.Len(t, bes.Platforms, 1) {
+				assert.Equal(t, io.expType, bes.Platforms[string(types.DefaultBackend)].Type())
+			}
+		})
+	}
+}
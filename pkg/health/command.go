@@ -0,0 +1,127 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/log"
+	"strings"
+)
+
+// defaultShell runs the commands of health checks labelled to run in a shell,
+// it is expected to be present in the container for internal checks.
+const defaultShell = "/bin/sh"
+
+// shellOperators are the characters which mean something to a shell when they
+// are not quoted. A command holding any of them is most likely meant to run in
+// a shell, i.e. a pipeline.
+const shellOperators = "|&;<>()$`"
+
+// parseCommand takes the value of a health check label and returns the
+// arguments of the command to run. A value which is a JSON array of strings
+// is used as is, i.e. ["nc", "-vz", "127.0.0.1", "80"]. Otherwise, the value
+// is wrapped in '/bin/sh -c' when shell is true, or split into words as a
+// POSIX shell would without expanding anything.
+func parseCommand(cmd string, shell bool) ([]string, error) {
+	if trimmed := strings.TrimSpace(cmd); strings.HasPrefix(trimmed, "[") {
+		var args []string
+		// a value which is not a JSON array is a command starting with '[',
+		// i.e. "[ -f /tmp/ready ]"
+		if err := json.Unmarshal([]byte(trimmed), &args); err == nil {
+			if shell {
+				return nil, fmt.Errorf("a command given as an array cannot be run in a shell")
+			}
+			if len(args) == 0 || len(args[0]) == 0 {
+				return nil, fmt.Errorf("command array is empty")
+			}
+			return args, nil
+		}
+	}
+
+	if shell {
+		if len(strings.TrimSpace(cmd)) == 0 {
+			return nil, fmt.Errorf("command is empty")
+		}
+		return []string{defaultShell, "-c", cmd}, nil
+	}
+
+	args, operators, err := splitCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("command is empty")
+	}
+	if operators {
+		log.Daemon.Warnf("command %q holds shell syntax which is passed to %s as arguments, label the check with shell=true to run it in %s", cmd, args[0], defaultShell)
+	}
+	return args, nil
+}
+
+// splitCommand splits a command into words following the quoting rules of a
+// POSIX shell. Words are separated by unquoted whitespace, single quotes keep
+// everything between them literally, double quotes do too other than for a
+// backslash before one of $ ` " \ or a newline, and an unquoted backslash
+// keeps the character following it. Nothing is expanded. Whether any shell
+// operators were found outside of quotes is returned along with the words.
+func splitCommand(cmd string) ([]string, bool, error) {
+	var (
+		args      []string
+		word      strings.Builder
+		inWord    bool
+		operators bool
+	)
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return nil, false, fmt.Errorf("unterminated single quote in command")
+			}
+			word.WriteString(cmd[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		case c == '"':
+			i++
+			for ; i < len(cmd) && cmd[i] != '"'; i++ {
+				if cmd[i] == '\\' && i+1 < len(cmd) && strings.IndexByte("$`\"\\\n", cmd[i+1]) >= 0 {
+					i++
+					if cmd[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(cmd[i])
+			}
+			if i >= len(cmd) {
+				return nil, false, fmt.Errorf("unterminated double quote in command")
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 >= len(cmd) {
+				return nil, false, fmt.Errorf("command ends with an escape")
+			}
+			i++
+			// an escaped newline continues the line
+			if cmd[i] != '\n' {
+				word.WriteByte(cmd[i])
+				inWord = true
+			}
+		default:
+			if strings.IndexByte(shellOperators, c) >= 0 {
+				operators = true
+			}
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, operators, nil
+}
@@ -0,0 +1,90 @@
+package health
+
+import (
+	"github.com/docker/docker/pkg/testutil/assert"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	testIO := []struct {
+		name   string
+		cmd    string
+		shell  bool
+		exp    []string
+		expErr bool
+	}{
+		{
+			name: "should split on whitespace",
+			cmd:  "ping  -c 1\t127.0.0.1",
+			exp:  []string{"ping", "-c", "1", "127.0.0.1"},
+		},
+		{
+			name: "should keep single quoted words literally",
+			cmd:  `awk '{$1=$1;exit $1}'`,
+			exp:  []string{"awk", "{$1=$1;exit $1}"},
+		},
+		{
+			name: "should unescape within double quotes",
+			cmd:  `echo "say \"hi\" to \$USER\n"`,
+			exp:  []string{"echo", `say "hi" to $USER\n`},
+		},
+		{
+			name: "should join adjacent quoted and unquoted parts",
+			cmd:  `curl -H 'Host: 'example.com\ site`,
+			exp:  []string{"curl", "-H", "Host: example.com site"},
+		},
+		{
+			name: "should keep empty quoted words",
+			cmd:  `test -n ""`,
+			exp:  []string{"test", "-n", ""},
+		},
+		{
+			name:  "should pass a pipeline to the shell",
+			cmd:   "ps aux | grep -q nginx",
+			shell: true,
+			exp:   []string{"/bin/sh", "-c", "ps aux | grep -q nginx"},
+		},
+		{
+			name: "should use a json array as is",
+			cmd:  ` ["sh", "-c", "exit 1"]`,
+			exp:  []string{"sh", "-c", "exit 1"},
+		},
+		{
+			name: "should split a command starting with a bracket",
+			cmd:  "[ -f /tmp/ready ]",
+			exp:  []string{"[", "-f", "/tmp/ready", "]"},
+		},
+		{
+			name:   "should not run a json array in a shell",
+			cmd:    `["true"]`,
+			shell:  true,
+			expErr: true,
+		},
+		{
+			name:   "should fail on an unterminated quote",
+			cmd:    `echo 'oops`,
+			expErr: true,
+		},
+		{
+			name:   "should fail on a trailing escape",
+			cmd:    `echo oops\`,
+			expErr: true,
+		},
+		{
+			name:   "should fail on an empty command",
+			cmd:    "   ",
+			expErr: true,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			args, err := parseCommand(io.cmd, io.shell)
+			if io.expErr {
+				assert.Error(t, err, "")
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, args, io.exp)
+		})
+	}
+}
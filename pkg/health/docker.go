@@ -2,14 +2,28 @@ package health
 
 import (
 	"context"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/config"
 	"github.com/ideal-co/ogre/pkg/log"
 	"github.com/ideal-co/ogre/pkg/types"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	// defaultTimeout bounds the command of a check when neither the
+	// 'ogre.format.health.timeout' label nor the check_timeout of the daemon
+	// configuration are set.
+	defaultTimeout = 30 * time.Second
+	// ExitTimedOut is the exit of a check killed for running longer than its
+	// timeout, the same as that of timeout(1).
+	ExitTimedOut = 124
+)
+
 // DockerHealthCheck satisfies the HeathCheck interface and encapsulates the
 // behaviors for issuing health checks in or against docker containers
 type DockerHealthCheck struct {
@@ -18,6 +32,12 @@ type DockerHealthCheck struct {
 	Cmd *exec.Cmd
 	// the slice string representation of the command
 	RawCmd []string
+	// the probe run by ogred in place of a command, nil for checks which
+	// execute a command
+	Probe Prober
+	// whether an internal check is executed with a privileged exec, which
+	// it only is when labelled to be
+	Privileged bool
 
 	// context associated with the command to be run and the
 	// corresponding cancel function
@@ -30,6 +50,9 @@ type DockerHealthCheck struct {
 
 	// the interval at which to run the health check
 	Interval time.Duration
+	// how long the check may run before it is killed, probes are also
+	// bounded by their own timeout option
+	Timeout time.Duration
 
 	// information about how to operate the health checks
 	Formatter *DockerFormatter
@@ -50,11 +73,20 @@ type DockerFormatter struct {
 // ExecResult is the encapsulating struct used to capture the output from a command
 // run internal or external to a container.
 type ExecResult struct {
-	Container string
-	Hostname  string
-	Exit      int
-	StdOut    string
-	StdErr    string
+	Container   string
+	ContainerID string
+	Image       string
+	Hostname    string
+	Exit        int
+	StdOut      string
+	StdErr      string
+	// whether the command was killed for running longer than the timeout of
+	// the check, the exit is then ExitTimedOut
+	TimedOut bool
+	// the wall time it took the command to complete
+	Duration time.Duration
+	// when the command was started
+	Time time.Time
 }
 
 // FormatOutput is the struct representation of the ogre.format.output.$ labels.
@@ -65,13 +97,34 @@ type FormatOutput struct {
 
 // FormatPlatform is the struct representation of the ogre.format.backend.$ labels.
 type FormatPlatform struct {
-	Target types.PlatformType
-	// Metric will only be set for types.PrometheusBackend
+	// Targets are all the backends a health check result is delivered to
+	Targets []PlatformTarget
+	// Metric will only be set for types.PrometheusBackend and is the prefix of
+	// the metric names, when empty the metric of the backend config is used
 	Metric string
-	// Label will only be set for types.PrometheusBackend
+	// Label will only be set for types.PrometheusBackend and is the value of
+	// the job label, when empty the label of the backend config is used
 	Label string
 }
 
+// PlatformTarget identifies a single backend a health check result is sent to.
+// When Name is set the result is routed to the backend configured with that
+// name, otherwise it is routed by Type.
+type PlatformTarget struct {
+	Type types.PlatformType
+	Name string
+}
+
+// Has returns true should any of the targets be of the PlatformType passed.
+func (fp FormatPlatform) Has(pType types.PlatformType) bool {
+	for _, t := range fp.Targets {
+		if t.Type == pType {
+			return true
+		}
+	}
+	return false
+}
+
 func (dhc *DockerHealthCheck) String() string {
 	return dhc.Name
 }
@@ -114,19 +167,48 @@ func NewDockerHealthCheck(labels map[string]string) []*DockerHealthCheck {
 			}
 			switch splitKey[space] {
 			case health:
-				hc := &DockerHealthCheck{}
+				// ogre.health.*.shell and ogre.health.*.privileged are
+				// options of the check labelled without them rather than
+				// checks of their own
+				if isHealthOption(labels, splitKey) {
+					continue
+				}
+				shell, err := healthBoolOption(labels, key, healthShell)
+				if err != nil {
+					log.Daemon.Errorf("could not parse health check %s: %s", key, err)
+					continue
+				}
+				privileged, err := healthBoolOption(labels, key, healthPrivileged)
+				if err != nil {
+					log.Daemon.Errorf("could not parse health check %s: %s", key, err)
+					continue
+				}
+				hc := &DockerHealthCheck{Privileged: privileged}
 				hc.Formatter = formatter
 				// get checks from labels 'ogre.health.*'
-				hc.parseHealthCheck(splitKey[subSpaceOne], splitKey[subSpaceOne:], val)
-				if interval, ok := labels["ogre.format.health.interval"]; ok {
-					dur, err := time.ParseDuration(interval)
-					hc.Interval = dur
-					if err != nil {
-						log.Daemon.Errorf("could not parse time %s from label", interval)
-						hc.Interval = 5 * time.Second
-					}
-
+				if err := hc.parseHealthCheck(splitKey[subSpaceOne], splitKey[subSpaceOne:], val, shell); err != nil {
+					log.Daemon.Errorf("could not parse health check %s: %s", key, err)
+					continue
 				}
+				hc.parseInterval(labels)
+				hc.parseTimeout(labels)
+				hc.setDefaultIfEmpty()
+				checks = append(checks, hc)
+			case probe:
+				// ogre.probe.<kind>.<name>, anything shorter is incomplete
+				if len(splitKey) <= subSpaceTwo || isProbeOption(labels, splitKey) {
+					continue
+				}
+				hc := &DockerHealthCheck{}
+				hc.Formatter = formatter
+				// get probes from labels 'ogre.probe.*'
+				kind := splitKey[subSpaceOne]
+				if err := hc.parseProbe(kind, splitKey[subSpaceTwo:], val, probeOptions(labels, key, probeKinds[kind])); err != nil {
+					log.Daemon.Errorf("could not parse probe %s: %s", key, err)
+					continue
+				}
+				hc.parseInterval(labels)
+				hc.parseTimeout(labels)
 				hc.setDefaultIfEmpty()
 				checks = append(checks, hc)
 			}
@@ -136,6 +218,86 @@ func NewDockerHealthCheck(labels map[string]string) []*DockerHealthCheck {
 	return checks
 }
 
+// isHealthOption reports whether the split key of an 'ogre.health.*' label is
+// an option of another check, i.e. 'ogre.health.in.https.open.shell' when the
+// 'ogre.health.in.https.open' label is also present.
+func isHealthOption(labels map[string]string, splitKey []string) bool {
+	if len(splitKey) <= subSpaceOne+1 {
+		return false
+	}
+	switch splitKey[len(splitKey)-1] {
+	case healthShell, healthPrivileged:
+	default:
+		return false
+	}
+	_, ok := labels[strings.Join(splitKey[:len(splitKey)-1], ".")]
+	return ok
+}
+
+// healthBoolOption returns the value of a true or false option, i.e. shell, of
+// the check with the label key passed, which is false when the option is not
+// present.
+func healthBoolOption(labels map[string]string, key, option string) (bool, error) {
+	val, ok := labels[key+"."+option]
+	if !ok {
+		return false, nil
+	}
+	set, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%s option must be true or false, got %s", option, val)
+	}
+	return set, nil
+}
+
+// formatHealthLabel returns the key of the label of an option of the health
+// format, i.e. 'ogre.format.health.interval'.
+func formatHealthLabel(option string) string {
+	return strings.Join([]string{"ogre", format, formatHeath, option}, ".")
+}
+
+// parseInterval sets the interval of the check from the
+// 'ogre.format.health.interval' label should it be present.
+func (dhc *DockerHealthCheck) parseInterval(labels map[string]string) {
+	if interval, ok := labels[formatHealthLabel(formatHeathInterval)]; ok {
+		dur, err := time.ParseDuration(interval)
+		dhc.Interval = dur
+		if err != nil {
+			log.Daemon.Errorf("could not parse time %s from label", interval)
+			dhc.Interval = 5 * time.Second
+		}
+	}
+}
+
+// parseTimeout sets the timeout of the check from the
+// 'ogre.format.health.timeout' label should it be present and valid, or else
+// from the check_timeout of the daemon configuration.
+func (dhc *DockerHealthCheck) parseTimeout(labels map[string]string) {
+	if timeout, ok := labels[formatHealthLabel(formatHeathTimeout)]; ok {
+		dur, err := time.ParseDuration(timeout)
+		if err == nil && dur > 0 {
+			dhc.Timeout = dur
+			return
+		}
+		log.Daemon.Errorf("could not parse timeout %s from label, using check_timeout", timeout)
+	}
+	dhc.Timeout = checkTimeout()
+}
+
+// checkTimeout returns the check_timeout of the daemon configuration, or the
+// defaultTimeout should it not be set or not be valid.
+func checkTimeout() time.Duration {
+	timeout := config.DaemonConf.CheckTimeout
+	if len(timeout) == 0 {
+		return defaultTimeout
+	}
+	dur, err := time.ParseDuration(timeout)
+	if err != nil || dur <= 0 {
+		log.Daemon.Errorf("could not parse check_timeout %s, using default %s", timeout, defaultTimeout)
+		return defaultTimeout
+	}
+	return dur
+}
+
 // setDefaultIfEmpty sets and fields of a DockerHealthCheck should they be empty.
 func (dhc *DockerHealthCheck) setDefaultIfEmpty() {
 	// ogre.health.{in, ex}.check.name
@@ -150,6 +312,10 @@ func (dhc *DockerHealthCheck) setDefaultIfEmpty() {
 		log.Daemon.Info("health check interval was empty, using default '5s' (5 seconds)")
 		dhc.Interval = time.Second * 5
 	}
+	// ogre.format.health.{timeout}
+	if dhc.Timeout == 0 {
+		dhc.Timeout = defaultTimeout
+	}
 }
 
 // newFormatterFromLabels takes a map of string string representing Docker labels
@@ -225,9 +391,13 @@ func (fo *FormatOutput) setDefaultIfEmpty() {
 
 // parsePlatformFromLabels takes a subset of the Docker labels parsed from a
 // container and returns a FormatPlatform should any contain the prefix 'ogre'
-// followed by the dot separated string 'format.backend' in the key.
+// followed by the dot separated string 'format.backend' in the key. Every
+// backend label adds a target, so a single container can report to several
+// backends at once.
 func parsePlatformFromLabels(backendLabels map[string]string) FormatPlatform {
 	fp := &FormatPlatform{}
+	typed := make(map[types.PlatformType]bool)
+	var names []string
 	for key, val := range backendLabels {
 		splitKey := strings.Split(key, ".")
 		// if we got incomplete values passed, bail
@@ -236,11 +406,38 @@ func parsePlatformFromLabels(backendLabels map[string]string) FormatPlatform {
 		}
 		switch splitKey[space] {
 		case formatBackendStatsd:
-			fp.Target = types.StatsdBackend
+			typed[types.StatsdBackend] = true
 		case formatBackendHTTP:
-			fp.Target = types.HTTPBackend
+			typed[types.HTTPBackend] = true
+		case formatBackendGraphite:
+			typed[types.GraphiteBackend] = true
+		case formatBackendCollectd:
+			typed[types.CollectdBackend] = true
+		case formatBackendInflux:
+			typed[types.InfluxBackend] = true
+		case formatBackendOTLP:
+			typed[types.OTLPBackend] = true
+		case formatBackendSyslog:
+			typed[types.SyslogBackend] = true
+		case formatBackendAlertmanager:
+			typed[types.AlertmanagerBackend] = true
+		case formatBackendFile:
+			typed[types.FileBackend] = true
+		case formatBackendNATS:
+			typed[types.NATSBackend] = true
+		case formatBackendMQTT:
+			typed[types.MQTTBackend] = true
+		case formatBackendExec:
+			typed[types.ExecBackend] = true
+		case formatBackendName:
+			// ogre.format.backend.name="prod-webhook,statsd-east"
+			for _, name := range strings.Split(val, ",") {
+				if name = strings.TrimSpace(name); len(name) > 0 {
+					names = append(names, name)
+				}
+			}
 		case formatBackendProm:
-			fp.Target = types.PrometheusBackend
+			typed[types.PrometheusBackend] = true
 			// if no other values were provided, bail
 			// ogre.format.backend.{prometheus}="true"
 			if len(splitKey) <= subSpaceOne {
@@ -256,7 +453,22 @@ func parsePlatformFromLabels(backendLabels map[string]string) FormatPlatform {
 
 		}
 	}
+
+	// a named backend takes the place of the type label for its type, i.e.
+	// 'http' and 'name=prod-webhook' target only the prod webhook
+	for _, name := range names {
+		pType := backendTypeByName(name)
+		if len(pType) == 0 {
+			log.Daemon.Errorf("format backend name %s does not match a configured backend", name)
+		}
+		delete(typed, pType)
+		fp.Targets = append(fp.Targets, PlatformTarget{Type: pType, Name: name})
+	}
+	for pType := range typed {
+		fp.Targets = append(fp.Targets, PlatformTarget{Type: pType})
+	}
 	fp.setDefaultIfEmpty()
+	sortTargets(fp.Targets)
 
 	return *fp
 }
@@ -264,36 +476,58 @@ func parsePlatformFromLabels(backendLabels map[string]string) FormatPlatform {
 // setDefaultIfEmpty ensures that if labels were not passed to configure these
 // fields, we use some default values in their place for FormatPlatform.
 func (fp *FormatPlatform) setDefaultIfEmpty() {
-	switch fp.Target {
-	case types.StatsdBackend:
-		// Do nothing, we only need to indicate this is our desired platform
-		return
-	case types.HTTPBackend:
-		// Do nothing, we only need to indicate this is our desired platform
-		return
-	case types.PrometheusBackend:
-		if len(fp.Label) == 0 {
-			log.Daemon.Info("format backend prometheus job missing, using default name 'ogre_job'")
-			fp.Label = "ogre_job"
+	if len(fp.Targets) == 0 {
+		// the daemon can be configured with backends for unlabeled containers
+		for _, name := range config.DaemonConf.DefaultBackends {
+			fp.Targets = append(fp.Targets, PlatformTarget{Type: backendTypeByName(name), Name: name})
 		}
-		if len(fp.Metric) == 0 {
-			log.Daemon.Info("format backend prometheus metric missing, using default name 'ogre_metric'")
-			fp.Metric = "ogre_metric"
-		}
-	case types.CollectdBackend:
-		// TODO (lmower): issue #9
-	default:
+	}
+	if len(fp.Targets) == 0 {
 		log.Daemon.Info("format backend missing, will send health checks to log")
-		fp.Target = types.DefaultBackend
+		fp.Targets = []PlatformTarget{{Type: types.DefaultBackend}}
 	}
+
+}
+
+// sortTargets orders targets by type and then name so the same labels always
+// result in the same FormatPlatform.
+func sortTargets(targets []PlatformTarget) {
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Type != targets[j].Type {
+			return targets[i].Type < targets[j].Type
+		}
+		return targets[i].Name < targets[j].Name
+	})
+}
+
+// backendTypeByName returns the type of the backend in the daemon config with
+// the name passed, an empty PlatformType is returned if there is none. Like the
+// daemon, a backend without a name is known by its type.
+func backendTypeByName(name string) types.PlatformType {
+	if name == string(types.DefaultBackend) {
+		return types.DefaultBackend
+	}
+	for _, be := range config.DaemonConf.Backends {
+		if be.Name == name || (len(be.Name) == 0 && be.Type == name) {
+			return types.PlatformType(be.Type)
+		}
+	}
+	return ""
 }
 
 // parseHealthCheck takes a string representing where a health check should be
 // run, i.e. internal or external to a container, a slice of strings representing
-// the name of that health check, and a space separated string representing the
-// command. These values are then parsed and set on the DockerHealthCheck fields
-// accordingly. Should a destination not be passed, a default of internal is used.
-func (dhc *DockerHealthCheck) parseHealthCheck(dest string, name []string, cmd string) {
+// the name of that health check, a string representing the command and whether
+// that command is run in a shell. These values are then parsed and set on the
+// DockerHealthCheck fields accordingly. Should a destination not be passed, a
+// default of internal is used. An error is returned should the command not be
+// parsed, see parseCommand for the forms it may take.
+func (dhc *DockerHealthCheck) parseHealthCheck(dest string, name []string, cmd string, shell bool) error {
+	args, err := parseCommand(cmd, shell)
+	if err != nil {
+		return err
+	}
+
 	dhc.Ctx, dhc.cancel = context.WithCancel(context.Background())
 	switch dest {
 	case internalCheck:
@@ -301,49 +535,49 @@ func (dhc *DockerHealthCheck) parseHealthCheck(dest string, name []string, cmd s
 		// ogre.health.in.{0...n}=""
 		dhc.formatNameByPlatform(name[1:])
 		dhc.Destination = dest
-		dhc.Cmd = getCommand(dhc.Ctx, cmd)
-		dhc.RawCmd = strings.Split(cmd, " ")
 	case externalCheck:
 		// Docker label values passed in brackets
 		// ogre.health.ex.{0...n}=""
 		dhc.formatNameByPlatform(name[1:])
 		dhc.Destination = dest
-		dhc.Cmd = getCommand(dhc.Ctx, cmd)
-		dhc.RawCmd = strings.Split(cmd, " ")
 	default:
 		// Docker label values passed in brackets
 		// ogre.health.{0...n}=""
 		dhc.formatNameByPlatform(name[0:])
 		dhc.Destination = internalCheck
-		dhc.Cmd = getCommand(dhc.Ctx, cmd)
-		dhc.RawCmd = strings.Split(cmd, " ")
 	}
+	dhc.Cmd = getCommand(dhc.Ctx, args)
+	dhc.RawCmd = args
+	return nil
 }
 
 // formatNameByPlatform will adjust the separating token on a health check name
-// based upon platform or will set as the default which is an underscore.
+// based upon platform or will set as the default which is an underscore. Dots
+// are only used when every target platform treats them as path separators.
 func (dhc *DockerHealthCheck) formatNameByPlatform(name []string) {
-	switch dhc.Formatter.Platform.Target {
-	case types.StatsdBackend:
-		// ogre.health.{in, ex}.some.check.name -> some.check.name
-		dhc.Name = strings.Join(name, ".")
-	default:
+	for _, t := range dhc.Formatter.Platform.Targets {
+		switch t.Type {
+		case types.StatsdBackend, types.GraphiteBackend:
+			continue
+		}
 		// ogre.health.{in, ex}.some.check.name -> some_check_name
 		dhc.Name = strings.Join(name, "_")
+		return
 	}
+	// ogre.health.{in, ex}.some.check.name -> some.check.name
+	dhc.Name = strings.Join(name, ".")
 }
 
-// getCommand takes a context.Context and a string of space separated values
-// and returns a pointer to a command. If the slice of arguments returned
-// from splitting the string results in a zero length slice, we will return a
-// nil value for the command. Both the context.Context passed and the returned
-// exec.Cmd pointer are values associated with the corresponding fields of the
-// HealthCheck which is being initialized.
-func getCommand(ctx context.Context, com string) *exec.Cmd {
-	comSlice := strings.Split(com, " ")
-	if len(comSlice) < 1 {
+// getCommand takes a context.Context and the arguments of a command as parsed
+// by parseCommand and returns a pointer to a command. If the slice of
+// arguments is zero length, we will return a nil value for the command. Both
+// the context.Context passed and the returned exec.Cmd pointer are values
+// associated with the corresponding fields of the HealthCheck which is being
+// initialized.
+func getCommand(ctx context.Context, args []string) *exec.Cmd {
+	if len(args) < 1 {
 		return nil
 	}
 
-	return exec.CommandContext(ctx, comSlice[0], comSlice[1:]...)
+	return exec.CommandContext(ctx, args[0], args[1:]...)
 }
@@ -3,11 +3,21 @@ package health
 import (
 	"context"
 	"github.com/docker/docker/pkg/testutil/assert"
+	"github.com/ideal-co/ogre/pkg/config"
 	"github.com/ideal-co/ogre/pkg/types"
+	"os/exec"
 	"testing"
 	"time"
 )
 
+// cmdString returns the string of a command, which is empty for probes.
+func cmdString(cmd *exec.Cmd) string {
+	if cmd == nil {
+		return ""
+	}
+	return cmd.String()
+}
+
 func TestNewDockerHealthCheck(t *testing.T) {
 	testIO := []struct {
 		name string
@@ -22,7 +32,7 @@ func TestNewDockerHealthCheck(t *testing.T) {
 			exp: []*DockerHealthCheck{
 				{
 					Name:        "foo_check",
-					Cmd:         getCommand(context.Background(), "./usr/bin/foo.sh"),
+					Cmd:         getCommand(context.Background(), []string{"./usr/bin/foo.sh"}),
 					RawCmd:      []string{"./usr/bin/foo.sh"},
 					Destination: "in",
 					Interval:    time.Second * 5,
@@ -39,7 +49,7 @@ func TestNewDockerHealthCheck(t *testing.T) {
 			exp: []*DockerHealthCheck{
 				{
 					Name:        "foo_check",
-					Cmd:         getCommand(context.Background(), "./usr/bin/foo.sh"),
+					Cmd:         getCommand(context.Background(), []string{"./usr/bin/foo.sh"}),
 					RawCmd:      []string{"./usr/bin/foo.sh"},
 					Destination: "in",
 					Interval:    time.Second * 5,
@@ -47,7 +57,7 @@ func TestNewDockerHealthCheck(t *testing.T) {
 				},
 				{
 					Name:        "foo_bar_check",
-					Cmd:         getCommand(context.Background(), "./usr/bin/foo_bar.sh"),
+					Cmd:         getCommand(context.Background(), []string{"./usr/bin/foo_bar.sh"}),
 					RawCmd:      []string{"./usr/bin/foo_bar.sh"},
 					Destination: "in",
 					Interval:    time.Second * 5,
@@ -64,7 +74,7 @@ func TestNewDockerHealthCheck(t *testing.T) {
 			exp: []*DockerHealthCheck{
 				{
 					Name:        "foo.check",
-					Cmd:         getCommand(context.Background(), "./usr/bin/foo.sh"),
+					Cmd:         getCommand(context.Background(), []string{"./usr/bin/foo.sh"}),
 					RawCmd:      []string{"./usr/bin/foo.sh"},
 					Destination: "in",
 					Interval:    time.Second * 5,
@@ -86,7 +96,7 @@ func TestNewDockerHealthCheck(t *testing.T) {
 			exp: []*DockerHealthCheck{
 				{
 					Name:        "foo_check",
-					Cmd:         getCommand(context.Background(), "./usr/bin/foo.sh"),
+					Cmd:         getCommand(context.Background(), []string{"./usr/bin/foo.sh"}),
 					RawCmd:      []string{"./usr/bin/foo.sh"},
 					Destination: "in",
 					Interval:    time.Second * 5,
@@ -99,10 +109,143 @@ func TestNewDockerHealthCheck(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "should run a check labelled with the shell option in a shell",
+			in: map[string]string{
+				"ogre.health.in.https.open":       "nmap -p 443 127.0.0.1 | grep -i closed | wc -l | awk '{$1=$1;exit $1}'",
+				"ogre.health.in.https.open.shell": "true",
+			},
+			exp: []*DockerHealthCheck{
+				{
+					Name: "https_open",
+					Cmd: getCommand(context.Background(), []string{
+						"/bin/sh", "-c", "nmap -p 443 127.0.0.1 | grep -i closed | wc -l | awk '{$1=$1;exit $1}'",
+					}),
+					RawCmd:      []string{"/bin/sh", "-c", "nmap -p 443 127.0.0.1 | grep -i closed | wc -l | awk '{$1=$1;exit $1}'"},
+					Destination: "in",
+					Interval:    time.Second * 5,
+					Formatter:   newFormatterFromLabels(make(map[string]string)),
+				},
+			},
+		},
+		{
+			name: "should run a check labelled with the privileged option privileged",
+			in: map[string]string{
+				"ogre.health.in.iptables.rules":            "iptables -C INPUT -p tcp --dport 443 -j ACCEPT",
+				"ogre.health.in.iptables.rules.privileged": "true",
+			},
+			exp: []*DockerHealthCheck{
+				{
+					Name:        "iptables_rules",
+					Cmd:         getCommand(context.Background(), []string{"iptables", "-C", "INPUT", "-p", "tcp", "--dport", "443", "-j", "ACCEPT"}),
+					RawCmd:      []string{"iptables", "-C", "INPUT", "-p", "tcp", "--dport", "443", "-j", "ACCEPT"},
+					Destination: "in",
+					Interval:    time.Second * 5,
+					Privileged:  true,
+					Formatter:   newFormatterFromLabels(make(map[string]string)),
+				},
+			},
+		},
+		{
+			name: "should skip a check whose privileged option is not true or false",
+			in: map[string]string{
+				"ogre.health.in.iptables.rules":            "iptables -C INPUT -p tcp --dport 443 -j ACCEPT",
+				"ogre.health.in.iptables.rules.privileged": "always",
+			},
+			exp: nil,
+		},
+		{
+			name: "should split a quoted command into words",
+			in: map[string]string{
+				"ogre.health.ex.greeting": `echo 'hello world' "it's me"`,
+			},
+			exp: []*DockerHealthCheck{
+				{
+					Name:        "greeting",
+					Cmd:         getCommand(context.Background(), []string{"echo", "hello world", "it's me"}),
+					RawCmd:      []string{"echo", "hello world", "it's me"},
+					Destination: "ex",
+					Interval:    time.Second * 5,
+					Formatter:   newFormatterFromLabels(make(map[string]string)),
+				},
+			},
+		},
+		{
+			name: "should use a command given as an array as is",
+			in: map[string]string{
+				"ogre.health.port": `["nc", "-vz", "127.0.0.1", "80"]`,
+			},
+			exp: []*DockerHealthCheck{
+				{
+					Name:        "port",
+					Cmd:         getCommand(context.Background(), []string{"nc", "-vz", "127.0.0.1", "80"}),
+					RawCmd:      []string{"nc", "-vz", "127.0.0.1", "80"},
+					Destination: "in",
+					Interval:    time.Second * 5,
+					Formatter:   newFormatterFromLabels(make(map[string]string)),
+				},
+			},
+		},
+		{
+			name: "should return a probe without making checks of its options",
+			in: map[string]string{
+				"ogre.probe.http.api":                  "http://{{.ContainerIP}}:8080/healthz",
+				"ogre.probe.http.api.status":           "200",
+				"ogre.probe.http.api.header.X-Api-Key": "s3cret",
+			},
+			exp: []*DockerHealthCheck{
+				{
+					Name:        "api",
+					RawCmd:      []string{"http", "http://{{.ContainerIP}}:8080/healthz"},
+					Destination: "ex",
+					Interval:    time.Second * 5,
+					Formatter:   newFormatterFromLabels(make(map[string]string)),
+				},
+			},
+		},
+		{
+			name: "should return a tcp probe sending what its options say",
+			in: map[string]string{
+				"ogre.probe.tcp.redis":        `{{.Published "6379"}}`,
+				"ogre.probe.tcp.redis.send":   `PING\r\n`,
+				"ogre.probe.tcp.redis.expect": `\+PONG`,
+			},
+			exp: []*DockerHealthCheck{
+				{
+					Name:        "redis",
+					RawCmd:      []string{"tcp", `{{.Published "6379"}}`},
+					Destination: "ex",
+					Interval:    time.Second * 5,
+					Formatter:   newFormatterFromLabels(make(map[string]string)),
+				},
+			},
+		},
+		{
+			name: "should skip a dns probe without a name to look up",
+			in: map[string]string{
+				"ogre.probe.dns.resolver": "{{.ContainerIP}}:53",
+			},
+			exp: nil,
+		},
+		{
+			name: "should skip a probe of an unknown kind",
+			in: map[string]string{
+				"ogre.probe.gopher.api": "127.0.0.1:70",
+			},
+			exp: nil,
+		},
+		{
+			name: "should skip a check whose command cannot be parsed",
+			in: map[string]string{
+				"ogre.health.broken": `echo "unterminated`,
+			},
+			exp: nil,
+		},
 	}
 	for _, io := range testIO {
 		t.Run(io.name, func(t *testing.T) {
 			dhc := NewDockerHealthCheck(io.in)
+			assert.Equal(t, len(dhc), len(io.exp))
 			// we cannot guarantee the order of the slice so for multiple we'll
 			// just ensure the values are not nil for now
 			chkMap := map[string]*DockerHealthCheck{}
@@ -114,17 +257,19 @@ func TestNewDockerHealthCheck(t *testing.T) {
 					exp, ok := chkMap[hc.Name]
 					assert.Equal(t, ok, true)
 					assert.Equal(t, hc.Name, exp.Name)
-					assert.Equal(t, hc.Cmd.String(), exp.Cmd.String())
+					assert.Equal(t, cmdString(hc.Cmd), cmdString(exp.Cmd))
 					assert.DeepEqual(t, hc.RawCmd, exp.RawCmd)
 					assert.Equal(t, hc.Interval, exp.Interval)
+					assert.Equal(t, hc.Privileged, exp.Privileged)
 					assert.DeepEqual(t, hc.Formatter, exp.Formatter)
 				}
 			} else {
 				for idx, hc := range dhc {
 					assert.Equal(t, hc.Name, io.exp[idx].Name)
-					assert.Equal(t, hc.Cmd.String(), io.exp[idx].Cmd.String())
+					assert.Equal(t, cmdString(hc.Cmd), cmdString(io.exp[idx].Cmd))
 					assert.DeepEqual(t, hc.RawCmd, io.exp[idx].RawCmd)
 					assert.Equal(t, hc.Interval, io.exp[idx].Interval)
+					assert.Equal(t, hc.Privileged, io.exp[idx].Privileged)
 					assert.DeepEqual(t, hc.Formatter, io.exp[idx].Formatter)
 				}
 			}
@@ -147,7 +292,7 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "exit",
 				},
 				Platform: FormatPlatform{
-					Target: types.DefaultBackend,
+					Targets: []PlatformTarget{{Type: types.DefaultBackend}},
 				},
 			},
 		},
@@ -162,7 +307,7 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "return",
 				},
 				Platform: FormatPlatform{
-					Target: types.DefaultBackend,
+					Targets: []PlatformTarget{{Type: types.DefaultBackend}},
 				},
 			},
 		},
@@ -177,7 +322,7 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "exit",
 				},
 				Platform: FormatPlatform{
-					Target: types.DefaultBackend,
+					Targets: []PlatformTarget{{Type: types.DefaultBackend}},
 				},
 			},
 		},
@@ -192,7 +337,7 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "exit",
 				},
 				Platform: FormatPlatform{
-					Target: types.DefaultBackend,
+					Targets: []PlatformTarget{{Type: types.DefaultBackend}},
 				},
 			},
 		},
@@ -207,12 +352,12 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "exit",
 				},
 				Platform: FormatPlatform{
-					Target: types.StatsdBackend,
+					Targets: []PlatformTarget{{Type: types.StatsdBackend}},
 				},
 			},
 		},
 		{
-			name: "should make a formatter for prometheus with default job",
+			name: "should make a formatter for prometheus without a job",
 			in: map[string]string{
 				"ogre.format.backend.prometheus.metric": "foo_bar",
 			},
@@ -222,14 +367,13 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "exit",
 				},
 				Platform: FormatPlatform{
-					Target: types.PrometheusBackend,
-					Metric: "foo_bar",
-					Label:  "ogre_job",
+					Targets: []PlatformTarget{{Type: types.PrometheusBackend}},
+					Metric:  "foo_bar",
 				},
 			},
 		},
 		{
-			name: "should make a formatter for prometheus with default metric",
+			name: "should make a formatter for prometheus without a metric",
 			in: map[string]string{
 				"ogre.format.backend.prometheus.label": "foo_bar",
 			},
@@ -239,14 +383,13 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "exit",
 				},
 				Platform: FormatPlatform{
-					Target: types.PrometheusBackend,
-					Metric: "ogre_metric",
-					Label:  "foo_bar",
+					Targets: []PlatformTarget{{Type: types.PrometheusBackend}},
+					Label:   "foo_bar",
 				},
 			},
 		},
 		{
-			name: "should make a formatter for prometheus with default values",
+			name: "should make a formatter for prometheus without a metric or job",
 			in: map[string]string{
 				"ogre.format.backend.prometheus": "true",
 			},
@@ -256,9 +399,7 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "exit",
 				},
 				Platform: FormatPlatform{
-					Target: types.PrometheusBackend,
-					Metric: "ogre_metric",
-					Label:  "ogre_job",
+					Targets: []PlatformTarget{{Type: types.PrometheusBackend}},
 				},
 			},
 		},
@@ -276,9 +417,9 @@ func TestNewFormatterFromLabels(t *testing.T) {
 					Result: "return",
 				},
 				Platform: FormatPlatform{
-					Target: types.PrometheusBackend,
-					Metric: "foo_metric",
-					Label:  "foo_job",
+					Targets: []PlatformTarget{{Type: types.PrometheusBackend}},
+					Metric:  "foo_metric",
+					Label:   "foo_job",
 				},
 			},
 		},
@@ -344,7 +485,7 @@ func TestParsePlatformFromLabels(t *testing.T) {
 			name: "should return a default from empty labels",
 			in:   make(map[string]string),
 			exp: FormatPlatform{
-				Target: types.DefaultBackend,
+				Targets: []PlatformTarget{{Type: types.DefaultBackend}},
 			},
 		},
 		{
@@ -353,30 +494,139 @@ func TestParsePlatformFromLabels(t *testing.T) {
 				"backend.statsd": "true",
 			},
 			exp: FormatPlatform{
-				Target: types.StatsdBackend,
+				Targets: []PlatformTarget{{Type: types.StatsdBackend}},
+			},
+		},
+		{
+			name: "should return a graphite target",
+			in: map[string]string{
+				"backend.graphite": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.GraphiteBackend}},
+			},
+		},
+		{
+			name: "should return a collectd target",
+			in: map[string]string{
+				"backend.collectd": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.CollectdBackend}},
 			},
 		},
 		{
-			name: "should return a prometheus target and defaults",
+			name: "should return an influx target",
+			in: map[string]string{
+				"backend.influx": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.InfluxBackend}},
+			},
+		},
+		{
+			name: "should return an otlp target",
+			in: map[string]string{
+				"backend.otlp": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.OTLPBackend}},
+			},
+		},
+		{
+			name: "should return a syslog target",
+			in: map[string]string{
+				"backend.syslog": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.SyslogBackend}},
+			},
+		},
+		{
+			name: "should return an alertmanager target",
+			in: map[string]string{
+				"backend.alertmanager": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.AlertmanagerBackend}},
+			},
+		},
+		{
+			name: "should return a file target",
+			in: map[string]string{
+				"backend.file": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.FileBackend}},
+			},
+		},
+		{
+			name: "should return a nats target",
+			in: map[string]string{
+				"backend.nats": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.NATSBackend}},
+			},
+		},
+		{
+			name: "should return an mqtt target",
+			in: map[string]string{
+				"backend.mqtt": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.MQTTBackend}},
+			},
+		},
+		{
+			name: "should return an exec target",
+			in: map[string]string{
+				"backend.exec": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.ExecBackend}},
+			},
+		},
+		{
+			name: "should return a target for every backend label",
+			in: map[string]string{
+				"backend.statsd":     "true",
+				"backend.prometheus": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{
+					{Type: types.PrometheusBackend},
+					{Type: types.StatsdBackend},
+				},
+			},
+		},
+		{
+			name: "should not default to log for an unknown backend name",
+			in: map[string]string{
+				"backend.name": "prod-webhook",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Name: "prod-webhook"}},
+			},
+		},
+		{
+			name: "should return a prometheus target",
 			in: map[string]string{
 				"backend.prometheus": "true",
 			},
 			exp: FormatPlatform{
-				Target: types.PrometheusBackend,
-				Metric: "ogre_metric",
-				Label:  "ogre_job",
+				Targets: []PlatformTarget{{Type: types.PrometheusBackend}},
 			},
 		},
 		{
-			name: "should return a prometheus target a metric, and a default",
+			name: "should return a prometheus target and a metric",
 			in: map[string]string{
 				"backend.prometheus":        "true",
 				"backend.prometheus.metric": "foo_metric_name",
 			},
 			exp: FormatPlatform{
-				Target: types.PrometheusBackend,
-				Metric: "foo_metric_name",
-				Label:  "ogre_job",
+				Targets: []PlatformTarget{{Type: types.PrometheusBackend}},
+				Metric:  "foo_metric_name",
 			},
 		},
 		{
@@ -387,9 +637,9 @@ func TestParsePlatformFromLabels(t *testing.T) {
 				"backend.prometheus.label":  "foo_job_name",
 			},
 			exp: FormatPlatform{
-				Target: types.PrometheusBackend,
-				Metric: "foo_metric_name",
-				Label:  "foo_job_name",
+				Targets: []PlatformTarget{{Type: types.PrometheusBackend}},
+				Metric:  "foo_metric_name",
+				Label:   "foo_job_name",
 			},
 		},
 	}
@@ -400,3 +650,122 @@ func TestParsePlatformFromLabels(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePlatformFromLabelsNamed(t *testing.T) {
+	backends, defaults := config.DaemonConf.Backends, config.DaemonConf.DefaultBackends
+	defer func() {
+		config.DaemonConf.Backends, config.DaemonConf.DefaultBackends = backends, defaults
+	}()
+	config.DaemonConf.Backends = []config.BackendConfig{
+		{Type: "http", Name: "staging-webhook"},
+		{Type: "http", Name: "prod-webhook"},
+		{Type: "statsd"},
+	}
+
+	testIO := []struct {
+		name     string
+		in       map[string]string
+		defaults []string
+		exp      FormatPlatform
+	}{
+		{
+			name: "should return a named target in place of the type target",
+			in: map[string]string{
+				"backend.http": "true",
+				"backend.name": "prod-webhook",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{{Type: types.HTTPBackend, Name: "prod-webhook"}},
+			},
+		},
+		{
+			name: "should return every named target and remaining type targets",
+			in: map[string]string{
+				"backend.name":   "prod-webhook, staging-webhook",
+				"backend.statsd": "true",
+			},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{
+					{Type: types.HTTPBackend, Name: "prod-webhook"},
+					{Type: types.HTTPBackend, Name: "staging-webhook"},
+					{Type: types.StatsdBackend},
+				},
+			},
+		},
+		{
+			name:     "should return the default backends when there are no labels",
+			in:       make(map[string]string),
+			defaults: []string{"statsd", "prod-webhook"},
+			exp: FormatPlatform{
+				Targets: []PlatformTarget{
+					{Type: types.HTTPBackend, Name: "prod-webhook"},
+					{Type: types.StatsdBackend, Name: "statsd"},
+				},
+			},
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			config.DaemonConf.DefaultBackends = io.defaults
+			fmtr := parsePlatformFromLabels(io.in)
+			assert.DeepEqual(t, fmtr, io.exp)
+		})
+	}
+}
+
+func TestDockerHealthCheck_ParseTimeout(t *testing.T) {
+	defer func(timeout string) {
+		config.DaemonConf.CheckTimeout = timeout
+	}(config.DaemonConf.CheckTimeout)
+
+	testIO := []struct {
+		name     string
+		labels   map[string]string
+		global   string
+		expected time.Duration
+	}{
+		{
+			name:     "should default when no timeout is set",
+			labels:   map[string]string{},
+			expected: defaultTimeout,
+		},
+		{
+			name:     "should use the timeout of the daemon configuration",
+			labels:   map[string]string{},
+			global:   "10s",
+			expected: time.Second * 10,
+		},
+		{
+			name:     "should prefer the timeout label of the container",
+			labels:   map[string]string{"ogre.format.health.timeout": "2s"},
+			global:   "10s",
+			expected: time.Second * 2,
+		},
+		{
+			name:     "should default when the timeout cannot be parsed",
+			labels:   map[string]string{"ogre.format.health.timeout": "soon"},
+			expected: defaultTimeout,
+		},
+		{
+			name:     "should use the daemon configuration when the timeout label cannot be parsed",
+			labels:   map[string]string{"ogre.format.health.timeout": "soon"},
+			global:   "10s",
+			expected: time.Second * 10,
+		},
+		{
+			name:     "should default when the daemon configuration cannot be parsed",
+			labels:   map[string]string{},
+			global:   "soon",
+			expected: defaultTimeout,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			config.DaemonConf.CheckTimeout = io.global
+			dhc := &DockerHealthCheck{}
+			dhc.parseTimeout(io.labels)
+			dhc.setDefaultIfEmpty()
+			assert.Equal(t, dhc.Timeout, io.expected)
+		})
+	}
+}
@@ -11,9 +11,13 @@ const (
 
 	health = "health"
 	format = "format"
+	probe  = "probe"
 
 	internalCheck = "in"
 	externalCheck = "ex"
+	healthShell   = "shell"
+	// healthPrivileged runs an internal check with a privileged exec
+	healthPrivileged = "privileged"
 
 	formatHeath   = "health"
 	formatBackend = "backend"
@@ -22,11 +26,23 @@ const (
 	prometheusMetric  = "metric"
 	prometheusLabel   = "label"
 
-	formatBackendStatsd = "statsd"
-	formatBackendHTTP   = "http"
+	formatBackendStatsd       = "statsd"
+	formatBackendHTTP         = "http"
+	formatBackendGraphite     = "graphite"
+	formatBackendCollectd     = "collectd"
+	formatBackendInflux       = "influx"
+	formatBackendOTLP         = "otlp"
+	formatBackendSyslog       = "syslog"
+	formatBackendAlertmanager = "alertmanager"
+	formatBackendFile         = "file"
+	formatBackendNATS         = "nats"
+	formatBackendMQTT         = "mqtt"
+	formatBackendExec         = "exec"
+	formatBackendName         = "name"
 
 	formatHeathOutput   = "output"
 	formatHeathInterval = "interval"
+	formatHeathTimeout  = "timeout"
 
 	formatHealthOutputType   = "type"
 	formatHealthOutputResult = "result"
@@ -0,0 +1,277 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// probeDefaultTimeout bounds a probe which is not given a timeout option.
+	probeDefaultTimeout = 5 * time.Second
+	// probeExitUnexpected is the exit code of a probe which got an answer
+	// other than the one it expects, i.e. a status code or body.
+	probeExitUnexpected = 1
+	// probeExitError is the exit code of a probe which got no answer at all,
+	// i.e. the connection was refused. A probe which got no answer before its
+	// deadline exits ExitTimedOut instead.
+	probeExitError = 2
+	// probeExitUnknown is the exit code of a probe which got an answer saying
+	// nothing about the health of the container, i.e. a grpc status of
+	// UNKNOWN.
+	probeExitUnknown = 3
+)
+
+// Prober is implemented by the probes ogred runs itself against a container,
+// rather than executing a command in or against it. A probe reports its
+// outcome as an ExecResult the same as a command would, an exit code of 0 when
+// it passed along with a description of what it found on stdout or stderr.
+type Prober interface {
+	Probe(ctx context.Context, target ProbeTarget) *ExecResult
+}
+
+// ProbeTarget holds the addresses of the container a probe is run against,
+// which the target of a probe is rendered from, i.e.
+// http://{{.ContainerIP}}:8080/healthz.
+type ProbeTarget struct {
+	// ContainerIP is the address of the container on its network, or the
+	// loopback address for containers using the network of the host.
+	ContainerIP string
+	// Hostname is the hostname of the container.
+	Hostname string
+	// Ports maps the ports of the container, i.e. '8080/tcp', to the address
+	// they are published on by the host.
+	Ports map[string]string
+}
+
+// Published returns the address on the host a port of the container is
+// published on, i.e. {{.Published "5432/tcp"}}. The protocol defaults to tcp
+// and an error is returned should the port not be published.
+func (pt ProbeTarget) Published(port string) (string, error) {
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+	addr, ok := pt.Ports[port]
+	if !ok {
+		return "", fmt.Errorf("port %s of the container is not published", port)
+	}
+	return addr, nil
+}
+
+// probeKind describes a kind of probe, ogre.probe.<kind>.<name>. The options
+// are the names which may follow the label of a probe to configure it, i.e.
+// ogre.probe.http.api.timeout, and build returns the probe for a target and
+// the options given.
+type probeKind struct {
+	options []string
+	build   func(target *template.Template, opts map[string]string) (Prober, error)
+}
+
+// probeKinds are the kinds of probe by the name used in labels.
+var probeKinds = map[string]probeKind{
+	probeHTTP: {options: httpProbeOptions, build: newHTTPProbe},
+	probeTCP:  {options: tcpProbeOptions, build: newTCPProbe},
+	probeUDP:  {options: udpProbeOptions, build: newUDPProbe},
+	probeDNS:  {options: dnsProbeOptions, build: newDNSProbe},
+	probeGRPC: {options: grpcProbeOptions, build: newGRPCProbe},
+}
+
+// isProbeOption reports whether the split key of an 'ogre.probe.*' label is an
+// option of another probe, i.e. 'ogre.probe.http.api.timeout' when the
+// 'ogre.probe.http.api' label is also present.
+func isProbeOption(labels map[string]string, splitKey []string) bool {
+	kind, ok := probeKinds[splitKey[subSpaceOne]]
+	if !ok {
+		return false
+	}
+	for i := len(splitKey) - 1; i > subSpaceTwo; i-- {
+		if !kind.hasOption(splitKey[i]) {
+			continue
+		}
+		if _, ok := labels[strings.Join(splitKey[:i], ".")]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// probeOptions returns the options of the probe with the label key passed,
+// keyed by what follows the key, i.e. 'timeout' or 'header.Host'.
+func probeOptions(labels map[string]string, key string, kind probeKind) map[string]string {
+	opts := make(map[string]string)
+	for k, v := range labels {
+		if !strings.HasPrefix(k, key+".") {
+			continue
+		}
+		opt := strings.TrimPrefix(k, key+".")
+		if kind.hasOption(strings.SplitN(opt, ".", 2)[0]) {
+			opts[opt] = v
+		}
+	}
+	return opts
+}
+
+// hasOption reports whether name is one of the options of the kind.
+func (pk probeKind) hasOption(name string) bool {
+	for _, opt := range pk.options {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProbe takes the kind of a probe, a slice of strings representing the
+// name of the probe, the target and options of the probe. These values are
+// then parsed and set on the DockerHealthCheck fields accordingly. Probes are
+// run by ogred from outside of the container, their destination is external.
+func (dhc *DockerHealthCheck) parseProbe(kind string, name []string, target string, opts map[string]string) error {
+	pk, ok := probeKinds[kind]
+	if !ok {
+		return fmt.Errorf("unknown probe kind %s", kind)
+	}
+	tmpl, err := template.New("target").Option("missingkey=error").Parse(target)
+	if err != nil {
+		return fmt.Errorf("could not parse probe target: %s", err)
+	}
+	prober, err := pk.build(tmpl, opts)
+	if err != nil {
+		return err
+	}
+
+	dhc.Ctx, dhc.cancel = context.WithCancel(context.Background())
+	// ogre.probe.<kind>.{0...n}=""
+	dhc.formatNameByPlatform(name)
+	dhc.Destination = externalCheck
+	dhc.Probe = prober
+	dhc.RawCmd = []string{kind, target}
+	return nil
+}
+
+// renderTarget renders the target of a probe for the container.
+func renderTarget(tmpl *template.Template, target ProbeTarget) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, target); err != nil {
+		return "", fmt.Errorf("could not render probe target: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// probeTimeout parses the timeout option of a probe, falling back to the
+// default when it is not set.
+func probeTimeout(opts map[string]string) (time.Duration, error) {
+	val, ok := opts["timeout"]
+	if !ok {
+		return probeDefaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("probe timeout must be a positive duration, got %s", val)
+	}
+	return timeout, nil
+}
+
+// probeTLSConfig builds the tls configuration of a probe from its tls_ca,
+// tls_server_name and insecure_skip_verify options. A nil config is returned
+// when none are set.
+func probeTLSConfig(opts map[string]string) (*tls.Config, error) {
+	ca, hasCA := opts["tls_ca"]
+	serverName, hasName := opts["tls_server_name"]
+	skip, hasSkip := opts["insecure_skip_verify"]
+	if !hasCA && !hasName && !hasSkip {
+		return nil, nil
+	}
+
+	conf := &tls.Config{ServerName: serverName}
+	if hasSkip {
+		insecure, err := strconv.ParseBool(skip)
+		if err != nil {
+			return nil, fmt.Errorf("insecure_skip_verify must be true or false, got %s", skip)
+		}
+		conf.InsecureSkipVerify = insecure
+	}
+	if hasCA {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("could not read tls_ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls_ca %s", ca)
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+// probeExpect parses the expect option of a probe, a nil expression is
+// returned when it is not set.
+func probeExpect(opts map[string]string) (*regexp.Regexp, error) {
+	val, ok := opts["expect"]
+	if !ok {
+		return nil, nil
+	}
+	re, err := regexp.Compile(val)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse expect regular expression: %s", err)
+	}
+	return re, nil
+}
+
+// probeSend parses the send option of a probe, escapes such as \r\n and \x00
+// are interpreted as they would be in a Go string.
+func probeSend(opts map[string]string) ([]byte, error) {
+	val, ok := opts["send"]
+	if !ok {
+		return nil, nil
+	}
+	var send []byte
+	for rest := val; len(rest) > 0; {
+		r, multibyte, tail, err := strconv.UnquoteChar(rest, 0)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse send %s: %s", val, err)
+		}
+		if multibyte {
+			send = append(send, string(r)...)
+		} else {
+			send = append(send, byte(r))
+		}
+		rest = tail
+	}
+	return send, nil
+}
+
+// probeFailed returns the ExecResult of a probe which got no answer because of
+// the error passed. A probe which ran out of time, whether its own timeout or
+// that of the check, is timed out the same as a command killed for running
+// past its timeout.
+func probeFailed(ctx context.Context, err error, format string, args ...interface{}) *ExecResult {
+	var netErr net.Error
+	if ctx.Err() == context.DeadlineExceeded || (errors.As(err, &netErr) && netErr.Timeout()) {
+		res := probeResult(ExitTimedOut, format, args...)
+		res.TimedOut = true
+		return res
+	}
+	return probeResult(probeExitError, format, args...)
+}
+
+// probeResult returns the ExecResult of a probe which exited with the code
+// passed, describing what the probe found on stdout when it passed and on
+// stderr when it did not.
+func probeResult(exit int, format string, args ...interface{}) *ExecResult {
+	out := fmt.Sprintf(format, args...)
+	if exit == 0 {
+		return &ExecResult{Exit: exit, StdOut: out}
+	}
+	return &ExecResult{Exit: exit, StdErr: out}
+}
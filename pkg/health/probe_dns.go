@@ -0,0 +1,165 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const probeDNS = "dns"
+
+// dnsProbeOptions are the options of a dns probe, i.e.
+// ogre.probe.dns.resolver.name="db.internal".
+var dnsProbeOptions = []string{"name", "type", "expect", "protocol", "timeout"}
+
+// dnsTypes are the types of record a dns probe may look up.
+var dnsTypes = map[string]bool{
+	"A": true, "AAAA": true, "CNAME": true, "MX": true, "NS": true, "TXT": true,
+}
+
+// dnsProbe looks up a name against a dns server of the container and passes
+// when records of the type asked for are returned which, if configured, match
+// a regular expression.
+type dnsProbe struct {
+	server   *template.Template
+	name     string
+	qtype    string
+	expect   *regexp.Regexp
+	protocol string
+	timeout  time.Duration
+}
+
+// newDNSProbe returns a dns probe of the server address template with the
+// options passed. The name option is required, the type of record defaults to
+// A and the protocol to udp.
+func newDNSProbe(server *template.Template, opts map[string]string) (Prober, error) {
+	dp := &dnsProbe{
+		server:   server,
+		name:     opts["name"],
+		qtype:    "A",
+		protocol: "udp",
+	}
+	if len(dp.name) == 0 {
+		return nil, fmt.Errorf("dns probe requires the name option")
+	}
+	if qtype, ok := opts["type"]; ok {
+		dp.qtype = strings.ToUpper(qtype)
+		if !dnsTypes[dp.qtype] {
+			return nil, fmt.Errorf("unsupported dns record type %s", qtype)
+		}
+	}
+	if protocol, ok := opts["protocol"]; ok {
+		if protocol != "udp" && protocol != "tcp" {
+			return nil, fmt.Errorf("dns probe protocol must be udp or tcp, got %s", protocol)
+		}
+		dp.protocol = protocol
+	}
+	var err error
+	if dp.expect, err = probeExpect(opts); err != nil {
+		return nil, err
+	}
+	if dp.timeout, err = probeTimeout(opts); err != nil {
+		return nil, err
+	}
+	return dp, nil
+}
+
+// Probe is the dnsProbe implementation of the Prober interface. The probe
+// exits 0 when the records it expects are returned, 1 when the name does not
+// exist or the records do not match, 2 when the server does not answer and 124
+// when it does not answer in time.
+func (dp *dnsProbe) Probe(ctx context.Context, target ProbeTarget) *ExecResult {
+	server, err := renderTarget(dp.server, target)
+	if err != nil {
+		return probeResult(probeExitError, "%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dp.timeout)
+	defer cancel()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		// every lookup goes to the server of the container, whichever
+		// servers the host is configured with
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, dp.protocol, server)
+		},
+	}
+	records, err := dp.lookup(ctx, resolver)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return probeResult(probeExitUnexpected, "%s has no %s records at %s", dp.name, dp.qtype, server)
+		}
+		return probeFailed(ctx, err, "could not look up %s %s at %s: %s", dp.qtype, dp.name, server, err)
+	}
+	if len(records) == 0 {
+		return probeResult(probeExitUnexpected, "%s has no %s records at %s", dp.name, dp.qtype, server)
+	}
+	if dp.expect != nil {
+		matched := false
+		for _, rec := range records {
+			if dp.expect.MatchString(rec) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return probeResult(probeExitUnexpected, "%s %s records %s at %s do not match %s", dp.name, dp.qtype, strings.Join(records, ", "), server, dp.expect)
+		}
+	}
+	return probeResult(0, "%s %s records at %s: %s", dp.name, dp.qtype, server, strings.Join(records, ", "))
+}
+
+// lookup returns the records of the name as strings, MX records as
+// '<pref> <host>'.
+func (dp *dnsProbe) lookup(ctx context.Context, resolver *net.Resolver) ([]string, error) {
+	var records []string
+	switch dp.qtype {
+	case "A", "AAAA":
+		addrs, err := resolver.LookupIPAddr(ctx, dp.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if (addr.IP.To4() != nil) == (dp.qtype == "A") {
+				records = append(records, addr.IP.String())
+			}
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, dp.name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, cname)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, dp.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			records = append(records, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, dp.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, dp.name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, txts...)
+	}
+	return records, nil
+}
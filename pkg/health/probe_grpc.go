@@ -0,0 +1,249 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const (
+	probeGRPC = "grpc"
+	// grpcProbeMaxMessage is the largest health response a grpc probe reads,
+	// a response only holds the status.
+	grpcProbeMaxMessage = 1 << 10
+)
+
+// grpcProbeOptions are the options of a grpc probe, i.e.
+// ogre.probe.grpc.api.service="orders.v1.Orders".
+var grpcProbeOptions = []string{
+	"service", "watch", "timeout",
+	"tls", "tls_ca", "tls_server_name", "insecure_skip_verify",
+}
+
+// grpcServingStatus is the status of a service in a HealthCheckResponse of the
+// grpc.health.v1 protocol.
+type grpcServingStatus uint64
+
+const (
+	grpcStatusUnknown grpcServingStatus = iota
+	grpcStatusServing
+	grpcStatusNotServing
+	grpcStatusServiceUnknown
+)
+
+func (s grpcServingStatus) String() string {
+	switch s {
+	case grpcStatusUnknown:
+		return "UNKNOWN"
+	case grpcStatusServing:
+		return "SERVING"
+	case grpcStatusNotServing:
+		return "NOT_SERVING"
+	case grpcStatusServiceUnknown:
+		return "SERVICE_UNKNOWN"
+	}
+	return strconv.FormatUint(uint64(s), 10)
+}
+
+// grpcProbe calls the grpc.health.v1.Health service of the container and
+// passes when the service asked about is SERVING. Check is called unless the
+// watch option is set, in which case Watch is called and the first status
+// streamed back is used.
+type grpcProbe struct {
+	addr      *template.Template
+	service   string
+	watch     bool
+	timeout   time.Duration
+	scheme    string
+	transport *http2.Transport
+}
+
+// newGRPCProbe returns a grpc probe of the address template with the options
+// passed. The connection is plaintext unless the tls option or any of the
+// other tls options are set.
+func newGRPCProbe(addr *template.Template, opts map[string]string) (Prober, error) {
+	gp := &grpcProbe{addr: addr, service: opts["service"], scheme: "http"}
+	if watch, ok := opts["watch"]; ok {
+		w, err := strconv.ParseBool(watch)
+		if err != nil {
+			return nil, fmt.Errorf("watch must be true or false, got %s", watch)
+		}
+		gp.watch = w
+	}
+	timeout, err := probeTimeout(opts)
+	if err != nil {
+		return nil, err
+	}
+	gp.timeout = timeout
+
+	tlsConf, err := probeTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS, ok := opts["tls"]; ok {
+		enabled, err := strconv.ParseBool(useTLS)
+		if err != nil {
+			return nil, fmt.Errorf("tls must be true or false, got %s", useTLS)
+		}
+		if enabled && tlsConf == nil {
+			tlsConf = &tls.Config{}
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: gp.timeout}
+	gp.transport = &http2.Transport{TLSClientConfig: tlsConf}
+	if tlsConf != nil {
+		gp.scheme = "https"
+	} else {
+		// grpc without tls is http/2 over a plain connection
+		gp.transport.AllowHTTP = true
+		gp.transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		}
+	}
+	return gp, nil
+}
+
+// Probe is the grpcProbe implementation of the Prober interface. The probe
+// exits 0 when the service is SERVING, 1 when it is NOT_SERVING, 3 when its
+// status is UNKNOWN or SERVICE_UNKNOWN, 2 when the call fails, i.e. the
+// service is not known to the server, and 124 when the deadline passed.
+func (gp *grpcProbe) Probe(ctx context.Context, target ProbeTarget) *ExecResult {
+	addr, err := renderTarget(gp.addr, target)
+	if err != nil {
+		return probeResult(probeExitError, "%s", err)
+	}
+	method := "Check"
+	if gp.watch {
+		method = "Watch"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, gp.timeout)
+	defer cancel()
+	// every probe is a fresh look at the container
+	defer gp.transport.CloseIdleConnections()
+
+	status, err := gp.call(ctx, addr, method)
+	if err != nil {
+		return probeFailed(ctx, err, "%s of %q at %s failed: %s", method, gp.service, addr, err)
+	}
+	switch status {
+	case grpcStatusServing:
+		return probeResult(0, "%q at %s is %s", gp.service, addr, status)
+	case grpcStatusNotServing:
+		return probeResult(probeExitUnexpected, "%q at %s is %s", gp.service, addr, status)
+	}
+	return probeResult(probeExitUnknown, "%q at %s is %s", gp.service, addr, status)
+}
+
+// call calls a method of the grpc.health.v1.Health service with a request for
+// the service of the probe, returning the status of the first response.
+func (gp *grpcProbe) call(ctx context.Context, addr, method string) (grpcServingStatus, error) {
+	// HealthCheckRequest { string service = 1; }
+	var msg []byte
+	if len(gp.service) > 0 {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, gp.service)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	url := fmt.Sprintf("%s://%s/grpc.health.v1.Health/%s", gp.scheme, addr, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(frame))
+	if err != nil {
+		return 0, fmt.Errorf("could not create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", time.Until(deadline).Milliseconds()))
+	}
+
+	resp, err := gp.transport.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected http status %s", resp.Status)
+	}
+
+	// a response is a 5 byte prefix, a compression flag and the length of
+	// the message, followed by the message
+	var prefix [5]byte
+	if _, err := io.ReadFull(resp.Body, prefix[:]); err != nil {
+		// no message means the call failed, the status of the call is in
+		// the trailers or, when there are none, the headers
+		io.Copy(ioutil.Discard, resp.Body)
+		return 0, grpcError(resp, err)
+	}
+	if prefix[0] != 0 {
+		return 0, fmt.Errorf("compressed responses are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcProbeMaxMessage {
+		return 0, fmt.Errorf("response of %d bytes is too large", size)
+	}
+	msg = make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, msg); err != nil {
+		return 0, fmt.Errorf("could not read response: %s", err)
+	}
+	return parseHealthResponse(msg)
+}
+
+// grpcError returns the error of a call which sent back no message.
+func grpcError(resp *http.Response, readErr error) error {
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if len(status) == 0 {
+		return fmt.Errorf("no response: %s", readErr)
+	}
+	if status == "0" {
+		return fmt.Errorf("no response")
+	}
+	return fmt.Errorf("grpc status %s: %s", status, message)
+}
+
+// parseHealthResponse returns the status of a HealthCheckResponse message,
+// HealthCheckResponse { ServingStatus status = 1; }.
+func parseHealthResponse(msg []byte) (grpcServingStatus, error) {
+	var status grpcServingStatus
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return 0, fmt.Errorf("could not parse response: %s", protowire.ParseError(n))
+		}
+		msg = msg[n:]
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return 0, fmt.Errorf("could not parse response: %s", protowire.ParseError(n))
+			}
+			status = grpcServingStatus(v)
+			msg = msg[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return 0, fmt.Errorf("could not parse response: %s", protowire.ParseError(n))
+		}
+		msg = msg[n:]
+	}
+	return status, nil
+}
@@ -0,0 +1,179 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	probeHTTP = "http"
+	// httpProbeMaxBody is as much of a response body as is matched against
+	// the body option.
+	httpProbeMaxBody = 1 << 20
+)
+
+// httpProbeOptions are the options of an http probe, i.e.
+// ogre.probe.http.api.status="200,204".
+var httpProbeOptions = []string{
+	"method", "status", "body", "header", "timeout",
+	"tls_ca", "tls_server_name", "insecure_skip_verify",
+}
+
+// httpProbe requests a URL of the container and passes when the response has
+// one of the expected status codes and, if configured, a body matching a
+// regular expression.
+type httpProbe struct {
+	url      *template.Template
+	method   string
+	statuses [][2]int
+	body     *regexp.Regexp
+	header   http.Header
+	timeout  time.Duration
+	client   *http.Client
+}
+
+// newHTTPProbe returns an http probe of the URL template with the options
+// passed. The status option is a comma separated list of codes or ranges of
+// codes, defaulting to 200-399.
+func newHTTPProbe(url *template.Template, opts map[string]string) (Prober, error) {
+	hp := &httpProbe{
+		url:      url,
+		method:   http.MethodGet,
+		statuses: [][2]int{{200, 399}},
+		header:   make(http.Header),
+	}
+	if method, ok := opts["method"]; ok {
+		hp.method = strings.ToUpper(method)
+	}
+	if status, ok := opts["status"]; ok {
+		statuses, err := parseStatuses(status)
+		if err != nil {
+			return nil, err
+		}
+		hp.statuses = statuses
+	}
+	if body, ok := opts["body"]; ok {
+		re, err := regexp.Compile(body)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse body regular expression: %s", err)
+		}
+		hp.body = re
+	}
+	for opt, val := range opts {
+		if name := strings.TrimPrefix(opt, "header."); name != opt {
+			hp.header.Set(name, val)
+		}
+	}
+
+	timeout, err := probeTimeout(opts)
+	if err != nil {
+		return nil, err
+	}
+	hp.timeout = timeout
+
+	tlsConf, err := probeTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConf
+	// every probe is a fresh look at the container
+	transport.DisableKeepAlives = true
+	hp.client = &http.Client{
+		Transport: transport,
+		// a redirect is an answer of its own, it is up to the status option
+		// whether it passes
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return hp, nil
+}
+
+// Probe is the httpProbe implementation of the Prober interface. The probe
+// exits 0 when the response is as expected, 1 when it is not, 2 when no
+// response was received and 124 when none was received in time.
+func (hp *httpProbe) Probe(ctx context.Context, target ProbeTarget) *ExecResult {
+	url, err := renderTarget(hp.url, target)
+	if err != nil {
+		return probeResult(probeExitError, "%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hp.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, hp.method, url, nil)
+	if err != nil {
+		return probeResult(probeExitError, "could not create request: %s", err)
+	}
+	for k, v := range hp.header {
+		req.Header[k] = v
+	}
+	if host := hp.header.Get("Host"); len(host) > 0 {
+		req.Host = host
+	}
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return probeFailed(ctx, err, "%s %s failed: %s", hp.method, url, err)
+	}
+	defer resp.Body.Close()
+
+	if !hp.expectedStatus(resp.StatusCode) {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, httpProbeMaxBody))
+		return probeResult(probeExitUnexpected, "%s %s returned unexpected status %s", hp.method, url, resp.Status)
+	}
+	if hp.body != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpProbeMaxBody))
+		if err != nil {
+			return probeFailed(ctx, err, "could not read body of %s %s: %s", hp.method, url, err)
+		}
+		if !hp.body.Match(body) {
+			return probeResult(probeExitUnexpected, "%s %s returned %s without a body matching %s", hp.method, url, resp.Status, hp.body)
+		}
+	}
+	return probeResult(0, "%s %s returned %s", hp.method, url, resp.Status)
+}
+
+// expectedStatus reports whether a status code is one of those expected.
+func (hp *httpProbe) expectedStatus(code int) bool {
+	for _, r := range hp.statuses {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatuses parses a comma separated list of status codes or ranges of
+// codes, i.e. "200,204,300-399".
+func parseStatuses(val string) ([][2]int, error) {
+	var statuses [][2]int
+	for _, part := range strings.Split(val, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse status %s", part)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("could not parse status %s", part)
+			}
+		}
+		if lo < 100 || hi > 599 || lo > hi {
+			return nil, fmt.Errorf("status %s is not a code or range of codes", part)
+		}
+		statuses = append(statuses, [2]int{lo, hi})
+	}
+	return statuses, nil
+}
@@ -0,0 +1,172 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const (
+	probeTCP = "tcp"
+	probeUDP = "udp"
+	// netProbeMaxRead is as much of what a server sends back as is matched
+	// against the expect option.
+	netProbeMaxRead = 64 << 10
+)
+
+// tcpProbeOptions are the options of a tcp probe, i.e.
+// ogre.probe.tcp.redis.send="PING\r\n".
+var tcpProbeOptions = []string{"send", "expect", "timeout"}
+
+// udpProbeOptions are the options of a udp probe, which must send a datagram
+// to get an answer.
+var udpProbeOptions = []string{"send", "expect", "timeout"}
+
+// tcpProbe connects to an address of the container and passes once the
+// connection is established or, if configured, once what the server sends
+// back matches a regular expression. Anything configured to be sent is
+// written first, i.e. to ask for a banner.
+type tcpProbe struct {
+	addr    *template.Template
+	send    []byte
+	expect  *regexp.Regexp
+	timeout time.Duration
+}
+
+// udpProbe sends a datagram to an address of the container and passes when a
+// datagram is received back which, if configured, matches a regular expression.
+type udpProbe struct {
+	addr    *template.Template
+	send    []byte
+	expect  *regexp.Regexp
+	timeout time.Duration
+}
+
+// newTCPProbe returns a tcp probe of the address template with the options
+// passed.
+func newTCPProbe(addr *template.Template, opts map[string]string) (Prober, error) {
+	tp := &tcpProbe{addr: addr}
+	var err error
+	if tp.send, err = probeSend(opts); err != nil {
+		return nil, err
+	}
+	if tp.expect, err = probeExpect(opts); err != nil {
+		return nil, err
+	}
+	if tp.timeout, err = probeTimeout(opts); err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
+
+// newUDPProbe returns a udp probe of the address template with the options
+// passed. A udp probe requires something to send.
+func newUDPProbe(addr *template.Template, opts map[string]string) (Prober, error) {
+	up := &udpProbe{addr: addr}
+	var err error
+	if up.send, err = probeSend(opts); err != nil {
+		return nil, err
+	}
+	if len(up.send) == 0 {
+		return nil, fmt.Errorf("udp probe requires the send option")
+	}
+	if up.expect, err = probeExpect(opts); err != nil {
+		return nil, err
+	}
+	if up.timeout, err = probeTimeout(opts); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+// Probe is the tcpProbe implementation of the Prober interface. The probe
+// exits 0 when it connects and gets what it expects, 1 when what it gets back
+// does not match, 2 when it cannot connect or gets nothing back at all and 124
+// when it does not connect or get anything back in time.
+func (tp *tcpProbe) Probe(ctx context.Context, target ProbeTarget) *ExecResult {
+	addr, err := renderTarget(tp.addr, target)
+	if err != nil {
+		return probeResult(probeExitError, "%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tp.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return probeFailed(ctx, err, "could not connect to %s: %s", addr, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if len(tp.send) > 0 {
+		if _, err := conn.Write(tp.send); err != nil {
+			return probeFailed(ctx, err, "could not send to %s: %s", addr, err)
+		}
+	}
+	if tp.expect == nil {
+		return probeResult(0, "connected to %s", addr)
+	}
+
+	// read until what was received matches, the server hangs up or the
+	// deadline passes
+	var got []byte
+	buf := make([]byte, 4096)
+	for len(got) < netProbeMaxRead {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if tp.expect.Match(got) {
+			return probeResult(0, "%s answered %s", addr, strconv.Quote(string(got)))
+		}
+		if err != nil {
+			if len(got) == 0 {
+				return probeFailed(ctx, err, "%s did not answer: %s", addr, err)
+			}
+			break
+		}
+	}
+	return probeResult(probeExitUnexpected, "%s answered %s which does not match %s", addr, strconv.Quote(string(got)), tp.expect)
+}
+
+// Probe is the udpProbe implementation of the Prober interface. The probe
+// exits 0 when it gets back what it expects, 1 when what it gets back does not
+// match, 2 when it gets nothing back at all and 124 when it gets nothing back
+// in time.
+func (up *udpProbe) Probe(ctx context.Context, target ProbeTarget) *ExecResult {
+	addr, err := renderTarget(up.addr, target)
+	if err != nil {
+		return probeResult(probeExitError, "%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, up.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return probeFailed(ctx, err, "could not connect to %s: %s", addr, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(up.send); err != nil {
+		return probeFailed(ctx, err, "could not send to %s: %s", addr, err)
+	}
+	buf := make([]byte, netProbeMaxRead)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return probeFailed(ctx, err, "%s did not answer: %s", addr, err)
+	}
+	got := buf[:n]
+	if up.expect != nil && !up.expect.Match(got) {
+		return probeResult(probeExitUnexpected, "%s answered %s which does not match %s", addr, strconv.Quote(string(got)), up.expect)
+	}
+	return probeResult(0, "%s answered %s", addr, strconv.Quote(string(got)))
+}
@@ -0,0 +1,466 @@
+package health
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/docker/docker/pkg/testutil/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestHTTPProbe_Probe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte(`{"status":"ok"}`))
+		case "/tenant":
+			if r.Host != "api.internal" || r.Header.Get("X-Api-Key") != "s3cret" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		case "/moved":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	testIO := []struct {
+		name    string
+		url     string
+		opts    map[string]string
+		expExit int
+	}{
+		{
+			name:    "should pass on a 2xx response",
+			url:     "http://{{.ContainerIP}}:" + port + "/healthz",
+			expExit: 0,
+		},
+		{
+			name:    "should fail on an unexpected status",
+			url:     "http://{{.ContainerIP}}:" + port + "/down",
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should pass on a status listed as expected",
+			url:     "http://{{.ContainerIP}}:" + port + "/down",
+			opts:    map[string]string{"status": "200,500-503"},
+			expExit: 0,
+		},
+		{
+			name:    "should pass on a body matching the expression",
+			url:     "http://{{.ContainerIP}}:" + port + "/healthz",
+			opts:    map[string]string{"body": `"status":\s*"ok"`},
+			expExit: 0,
+		},
+		{
+			name:    "should fail on a body not matching the expression",
+			url:     "http://{{.ContainerIP}}:" + port + "/healthz",
+			opts:    map[string]string{"body": "degraded"},
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should send the configured headers",
+			url:     "http://{{.ContainerIP}}:" + port + "/tenant",
+			opts:    map[string]string{"header.Host": "api.internal", "header.X-Api-Key": "s3cret"},
+			expExit: 0,
+		},
+		{
+			name:    "should not follow redirects",
+			url:     "http://{{.ContainerIP}}:" + port + "/moved",
+			opts:    map[string]string{"status": "200"},
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should error when nothing answers",
+			url:     "http://{{.ContainerIP}}:1/healthz",
+			expExit: probeExitError,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			if io.opts == nil {
+				io.opts = map[string]string{}
+			}
+			p, err := newHTTPProbe(template.Must(template.New("target").Parse(io.url)), io.opts)
+			assert.NilError(t, err)
+
+			res := p.Probe(context.Background(), ProbeTarget{ContainerIP: "127.0.0.1"})
+			assert.Equal(t, res.Exit, io.expExit)
+		})
+	}
+}
+
+func TestTCPProbe_Probe(t *testing.T) {
+	// the listener stands in for a server greeting clients with a banner and
+	// answering PING
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.Write([]byte("220 ready\r\n"))
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil && line == "PING\r\n" {
+					conn.Write([]byte("+PONG\r\n"))
+				}
+			}(conn)
+		}
+	}()
+
+	// the silent listener accepts connections but never sends anything
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer silent.Close()
+
+	testIO := []struct {
+		name    string
+		addr    string
+		opts    map[string]string
+		expExit int
+	}{
+		{
+			name:    "should pass once connected",
+			addr:    ln.Addr().String(),
+			expExit: 0,
+		},
+		{
+			name:    "should pass on a banner matching the expression",
+			addr:    ln.Addr().String(),
+			opts:    map[string]string{"expect": "^220 "},
+			expExit: 0,
+		},
+		{
+			name:    "should pass on an answer to what was sent",
+			addr:    ln.Addr().String(),
+			opts:    map[string]string{"send": `PING\r\n`, "expect": `\+PONG`},
+			expExit: 0,
+		},
+		{
+			name:    "should fail on an answer not matching the expression",
+			addr:    ln.Addr().String(),
+			opts:    map[string]string{"expect": "^SSH-", "timeout": "200ms"},
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should error when nothing is listening",
+			addr:    "{{.ContainerIP}}:1",
+			expExit: probeExitError,
+		},
+		{
+			name:    "should time out when nothing is sent back in time",
+			addr:    silent.Addr().String(),
+			opts:    map[string]string{"expect": "^220 ", "timeout": "200ms"},
+			expExit: ExitTimedOut,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			if io.opts == nil {
+				io.opts = map[string]string{}
+			}
+			p, err := newTCPProbe(template.Must(template.New("target").Parse(io.addr)), io.opts)
+			assert.NilError(t, err)
+
+			res := p.Probe(context.Background(), ProbeTarget{ContainerIP: "127.0.0.1"})
+			assert.Equal(t, res.Exit, io.expExit)
+		})
+	}
+}
+
+func TestProbe_checkTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	p, err := newHTTPProbe(template.Must(template.New("target").Parse(srv.URL)), map[string]string{})
+	assert.NilError(t, err)
+
+	// the timeout of the check is shorter than that of the probe
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	res := p.Probe(ctx, ProbeTarget{})
+	assert.Equal(t, res.Exit, ExitTimedOut)
+	assert.Equal(t, res.TimedOut, true)
+}
+
+func TestUDPProbe_Probe(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	// a closed socket leaves a port nothing answers on
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	closed.Close()
+
+	testIO := []struct {
+		name    string
+		addr    string
+		opts    map[string]string
+		expExit int
+	}{
+		{
+			name:    "should pass on any answer",
+			addr:    echo.LocalAddr().String(),
+			opts:    map[string]string{"send": "ping"},
+			expExit: 0,
+		},
+		{
+			name:    "should pass on an answer matching the expression",
+			addr:    echo.LocalAddr().String(),
+			opts:    map[string]string{"send": `\x00ping`, "expect": "ping$"},
+			expExit: 0,
+		},
+		{
+			name:    "should fail on an answer not matching the expression",
+			addr:    echo.LocalAddr().String(),
+			opts:    map[string]string{"send": "ping", "expect": "pong"},
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should error when nothing answers",
+			addr:    closed.LocalAddr().String(),
+			opts:    map[string]string{"send": "ping", "timeout": "200ms"},
+			expExit: probeExitError,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			p, err := newUDPProbe(template.Must(template.New("target").Parse(io.addr)), io.opts)
+			assert.NilError(t, err)
+
+			res := p.Probe(context.Background(), ProbeTarget{ContainerIP: "127.0.0.1"})
+			assert.Equal(t, res.Exit, io.expExit)
+		})
+	}
+
+	_, err = newUDPProbe(template.Must(template.New("target").Parse(echo.LocalAddr().String())), map[string]string{})
+	assert.Error(t, err, "requires the send option")
+}
+
+// serveDNS answers A queries for db.test with 10.0.0.7 and any other query for
+// db.test with no records, the name missing.test does not exist.
+func serveDNS(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		// the question follows the 12 byte header, a name of length
+		// prefixed labels then the type and class
+		end := 12
+		var labels []string
+		for end < n && req[end] != 0 {
+			labels = append(labels, string(req[end+1:end+1+int(req[end])]))
+			end += int(req[end]) + 1
+		}
+		end += 5
+		name, qtype := strings.Join(labels, "."), int(req[end-4])<<8|int(req[end-3])
+
+		resp := append([]byte{req[0], req[1], 0x85, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, req[12:end]...)
+		switch {
+		case name != "db.test":
+			resp[3] |= 3 // NXDOMAIN
+		case qtype == 1:
+			resp[7] = 1
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 0, 0, 7)
+		}
+		conn.WriteTo(resp, addr)
+	}
+}
+
+func TestDNSProbe_Probe(t *testing.T) {
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer srv.Close()
+	go serveDNS(srv)
+
+	testIO := []struct {
+		name    string
+		opts    map[string]string
+		expExit int
+	}{
+		{
+			name:    "should pass when the name resolves",
+			opts:    map[string]string{"name": "db.test."},
+			expExit: 0,
+		},
+		{
+			name:    "should pass on records matching the expression",
+			opts:    map[string]string{"name": "db.test.", "type": "a", "expect": `^10\.0\.0\.7$`},
+			expExit: 0,
+		},
+		{
+			name:    "should fail on records not matching the expression",
+			opts:    map[string]string{"name": "db.test.", "expect": `^10\.0\.0\.8$`},
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should fail when there are no records of the type",
+			opts:    map[string]string{"name": "db.test.", "type": "AAAA"},
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should fail when the name does not exist",
+			opts:    map[string]string{"name": "missing.test."},
+			expExit: probeExitUnexpected,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			p, err := newDNSProbe(template.Must(template.New("target").Parse(srv.LocalAddr().String())), io.opts)
+			assert.NilError(t, err)
+
+			res := p.Probe(context.Background(), ProbeTarget{ContainerIP: "127.0.0.1"})
+			assert.Equal(t, res.Exit, io.expExit)
+		})
+	}
+
+	_, err = newDNSProbe(template.Must(template.New("target").Parse(srv.LocalAddr().String())), map[string]string{"name": "db.test.", "type": "SRV"})
+	assert.Error(t, err, "unsupported dns record type")
+}
+
+func TestProbeTarget_Published(t *testing.T) {
+	target := ProbeTarget{Ports: map[string]string{"5432/tcp": "127.0.0.1:49153", "53/udp": "127.0.0.1:5353"}}
+	tmpl := template.Must(template.New("target").Option("missingkey=error").Parse(`{{.Published "5432"}} {{.Published "53/udp"}}`))
+	addrs, err := renderTarget(tmpl, target)
+	assert.NilError(t, err)
+	assert.Equal(t, addrs, "127.0.0.1:49153 127.0.0.1:5353")
+
+	_, err = renderTarget(template.Must(template.New("target").Parse(`{{.Published "6379"}}`)), target)
+	assert.Error(t, err, "port 6379/tcp of the container is not published")
+}
+
+// grpcHealth stands in for a grpc.health.v1.Health service, the server is
+// SERVING, the db service NOT_SERVING and the status of the cache service is
+// UNKNOWN. Any other service is not found.
+func grpcHealth(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var service string
+	if len(body) > 5 {
+		if _, _, n := protowire.ConsumeTag(body[5:]); n > 0 {
+			service, _ = protowire.ConsumeString(body[5+n:])
+		}
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	status, ok := map[string]uint64{"": 1, "db": 2, "cache": 0}[service]
+	if !ok {
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "unknown service")
+		return
+	}
+
+	msg := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), status)
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	w.Write(append(frame, msg...))
+	if strings.HasSuffix(r.URL.Path, "/Watch") {
+		// a watch streams until the client goes away
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		return
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+func TestGRPCProbe_Probe(t *testing.T) {
+	plain := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(grpcHealth), &http2.Server{}))
+	defer plain.Close()
+	secure := httptest.NewUnstartedServer(http.HandlerFunc(grpcHealth))
+	secure.EnableHTTP2 = true
+	secure.StartTLS()
+	defer secure.Close()
+
+	testIO := []struct {
+		name    string
+		addr    string
+		opts    map[string]string
+		expExit int
+	}{
+		{
+			name:    "should pass when the server is serving",
+			addr:    plain.Listener.Addr().String(),
+			expExit: 0,
+		},
+		{
+			name:    "should fail when the service is not serving",
+			addr:    plain.Listener.Addr().String(),
+			opts:    map[string]string{"service": "db"},
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should report an unknown status",
+			addr:    plain.Listener.Addr().String(),
+			opts:    map[string]string{"service": "cache"},
+			expExit: probeExitUnknown,
+		},
+		{
+			name:    "should error when the service is not found",
+			addr:    plain.Listener.Addr().String(),
+			opts:    map[string]string{"service": "orders"},
+			expExit: probeExitError,
+		},
+		{
+			name:    "should use the first status of a watch",
+			addr:    plain.Listener.Addr().String(),
+			opts:    map[string]string{"service": "db", "watch": "true"},
+			expExit: probeExitUnexpected,
+		},
+		{
+			name:    "should call the server over tls",
+			addr:    secure.Listener.Addr().String(),
+			opts:    map[string]string{"tls": "true", "insecure_skip_verify": "true"},
+			expExit: 0,
+		},
+		{
+			name:    "should error when nothing answers",
+			addr:    "{{.ContainerIP}}:1",
+			expExit: probeExitError,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			if io.opts == nil {
+				io.opts = map[string]string{}
+			}
+			p, err := newGRPCProbe(template.Must(template.New("target").Parse(io.addr)), io.opts)
+			assert.NilError(t, err)
+
+			res := p.Probe(context.Background(), ProbeTarget{ContainerIP: "127.0.0.1"})
+			assert.Equal(t, res.Exit, io.expExit)
+		})
+	}
+}
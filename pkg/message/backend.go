@@ -4,40 +4,83 @@ import (
 	"encoding/json"
 	"github.com/ideal-co/ogre/pkg/health"
 	"github.com/ideal-co/ogre/pkg/types"
+	"time"
 )
 
 // BackendMessage implements the Message interface and is the type responsible
 // for interfacing between the services (i.e. Docker) and the backend.Platform
 // interface. The backend is itself, a Service and can route the BackendMessage
-// type to the appropriate Platform by way of the Destination field
+// type to the appropriate Platforms by way of the Destinations field
 type BackendMessage struct {
 	// the executed health check (currently only DockerHealthCheck type)
 	CompletedCheck health.HealthCheck
 
-	// the backend platform the result is destined for
-	Destination types.PlatformType
+	// the backend platforms the result is destined for, each is routed by
+	// name when one is set and otherwise by type
+	Destinations []health.PlatformTarget
 
 	// the exit code and result of stdout/stderr from running the health
 	// check command, used to (De)Serialize JSON
 	Data *health.ExecResult
 
+	// an action for the backends to take rather than a result to report,
+	// i.e. "stop-health" when the container of Data.ContainerID stopped
+	Action string
+
 	// retaining for future use of indicating process ending failures
 	// or service level errors severe enough to indicate a lower level
 	// action be taken.
 	Err error
 }
 
-// NewBackendMessage takes a health.HealthCheck, a types.PlatformType, and a
-// pointer to a health.ExecResult and returns a Message of type BackendMessage.
-func NewBackendMessage(hc health.HealthCheck, dest types.PlatformType, er *health.ExecResult) Message {
+// NewBackendMessage takes a health.HealthCheck, a slice of the targets the
+// result is to be delivered to, and a pointer to a health.ExecResult and
+// returns a Message of type BackendMessage.
+func NewBackendMessage(hc health.HealthCheck, dests []health.PlatformTarget, er *health.ExecResult) Message {
 	return BackendMessage{
 		CompletedCheck: hc,
-		Destination:    dest,
+		Destinations:   dests,
 		Data:           er,
 		Err:            nil,
 	}
 }
 
+// NewContainerStoppedMessage takes the ID of a container which has stopped and
+// returns a Message of type BackendMessage which informs the backends that the
+// checks for that container will no longer report.
+func NewContainerStoppedMessage(containerID string) Message {
+	return BackendMessage{
+		Action: "stop-health",
+		Data:   &health.ExecResult{ContainerID: containerID},
+	}
+}
+
+// Exit returns the exit code of the run of the check the message was built
+// for. The check itself holds the result of its latest run, which is a later
+// one by the time a queued, batched or spooled message is delivered.
+func (bm BackendMessage) Exit() int {
+	if bm.Data != nil {
+		return bm.Data.Exit
+	}
+	return bm.CompletedCheck.ExitCode()
+}
+
+// Passed reports whether the run of the check the message was built for
+// passed.
+func (bm BackendMessage) Passed() bool {
+	return bm.Exit() == 0
+}
+
+// Time returns when the check the message was built for ran, or the current
+// time should that not be known. A message replayed from a spool is sent as of
+// its run rather than as of the replay.
+func (bm BackendMessage) Time() time.Time {
+	if bm.Data != nil && !bm.Data.Time.IsZero() {
+		return bm.Data.Time
+	}
+	return time.Now()
+}
+
 // Type is the BackendMessage type implementation of the Message interface's
 // Type method and will always return a types.BackendMessage
 func (bm BackendMessage) Type() types.MessageType {
@@ -52,12 +95,23 @@ func (bm BackendMessage) Error() error {
 	return nil
 }
 
+// serializedBackendMessage is the JSON shape of a serialized BackendMessage.
+// It predates messages being routed to several named destinations and is kept
+// as it was so that consumers of the output are not broken.
+type serializedBackendMessage struct {
+	CompletedCheck health.HealthCheck
+	Destination    types.PlatformType
+	Data           *health.ExecResult
+	Err            error
+}
+
 // Serialize is the BackendMessage type implementation of the Message interface's
-// Serialize method. Serialize will take the results of a DockerHealthCheck and
-// return a slice of bytes and an error which will be nil upon success.
+// Serialize method. Serialize will take the result of the run of the check the
+// message was built for and return a slice of bytes and an error which will be
+// nil upon success.
 func (bm BackendMessage) Serialize() ([]byte, error) {
-	m := BackendMessage{
-		Data: bm.CompletedCheck.(*health.DockerHealthCheck).Result,
+	m := serializedBackendMessage{
+		Data: bm.Data,
 	}
 	return json.Marshal(m)
 }
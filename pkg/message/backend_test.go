@@ -0,0 +1,53 @@
+package msg
+
+import (
+	"github.com/ideal-co/ogre/pkg/health"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBackendMessage_Exit(t *testing.T) {
+	hc := &health.DockerHealthCheck{Name: "https_open"}
+	var msgs []BackendMessage
+	// every run overwrites the result held by the check
+	for exit := 0; exit < 3; exit++ {
+		res := &health.ExecResult{Exit: exit}
+		hc.Result = res
+		msgs = append(msgs, NewBackendMessage(hc, nil, res).(BackendMessage))
+	}
+	for exit, bm := range msgs {
+		assert.Equal(t, exit, bm.Exit())
+		assert.Equal(t, exit == 0, bm.Passed())
+	}
+}
+
+func TestBackendMessage_Time(t *testing.T) {
+	ran := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	hc := &health.DockerHealthCheck{Name: "https_open"}
+
+	bm := NewBackendMessage(hc, nil, &health.ExecResult{Time: ran}).(BackendMessage)
+	assert.Equal(t, ran, bm.Time())
+
+	// a result without the time of its run is as of now
+	bm = NewBackendMessage(hc, nil, &health.ExecResult{}).(BackendMessage)
+	assert.WithinDuration(t, time.Now(), bm.Time(), time.Second)
+}
+
+func TestBackendMessage_Serialize(t *testing.T) {
+	hc := &health.DockerHealthCheck{Name: "https_open", Result: &health.ExecResult{Exit: 2}}
+	bm := NewBackendMessage(hc, []health.PlatformTarget{{Name: "prod"}}, &health.ExecResult{Container: "/web", Exit: 1})
+
+	data, err := bm.Serialize()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"CompletedCheck": null,
+		"Destination": "",
+		"Data": {
+			"Container": "/web", "ContainerID": "", "Image": "", "Hostname": "",
+			"Exit": 1, "StdOut": "", "StdErr": "", "TimedOut": false,
+			"Duration": 0, "Time": "0001-01-01T00:00:00Z"
+		},
+		"Err": null
+	}`, string(data))
+}
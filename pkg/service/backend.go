@@ -1,16 +1,27 @@
 package srvc
 
 import (
+	"fmt"
 	"github.com/ideal-co/ogre/pkg/backend"
+	"github.com/ideal-co/ogre/pkg/health"
 	"github.com/ideal-co/ogre/pkg/log"
 	msg "github.com/ideal-co/ogre/pkg/message"
 	"github.com/ideal-co/ogre/pkg/types"
+	"sort"
 )
 
 // BackendService satisfies the Service interface and is responsible for routing
-// Messages on its 'in' channel to the various backend platforms
+// Messages on its 'in' channel to the various backend platforms. Each Platform
+// has its own queue and go routine so they are delivered to independently.
 type BackendService struct {
-	Platforms map[types.PlatformType]backend.Platform
+	// Platforms are keyed by the name of the backend, which is the type of the
+	// backend unless a name was given in its config.
+	Platforms map[string]backend.Platform
+	// Queues configure the queue of the Platform of the same name, Platforms
+	// without a QueueConfig use the defaults.
+	Queues map[string]QueueConfig
+
+	queues map[string]*platformQueue
 
 	ctx *Context
 	in  chan msg.Message
@@ -43,7 +54,8 @@ func (bes *BackendService) Type() types.ServiceType {
 // upon success.
 func NewBackendService(out, in, errChan chan msg.Message) (*BackendService, error) {
 	return &BackendService{
-		Platforms: make(map[types.PlatformType]backend.Platform),
+		Platforms: make(map[string]backend.Platform),
+		Queues:    make(map[string]QueueConfig),
 		ctx:       NewDefaultContext(),
 		in:        in,
 		out:       out,
@@ -51,25 +63,107 @@ func NewBackendService(out, in, errChan chan msg.Message) (*BackendService, erro
 	}, nil
 }
 
+// AddPlatform takes a name and a backend.Platform and stores the Platform under
+// that name so messages can be routed to it. An error is returned should the
+// name already be in use, as each backend must be uniquely addressable.
+func (bes *BackendService) AddPlatform(name string, p backend.Platform) error {
+	if _, ok := bes.Platforms[name]; ok {
+		return fmt.Errorf("backend name %s is used more than once, backends of the same type must be given unique names", name)
+	}
+	bes.Platforms[name] = p
+	return nil
+}
+
 // listen is kicked off from the Service interface Run method which will begin
-// an infinite loop
+// an infinite loop. Each message is queued for every one of its destinations.
 func (bes *BackendService) listen() {
+	bes.startQueues()
 	for {
 		select {
 		case <-bes.ctx.Done():
 			return
 		case m := <-bes.in:
 			bem := m.(msg.BackendMessage)
-			dest := bem.Destination
 			log.Daemon.WithField("service", bem.Type()).Tracef("backend listen got %+v", bem)
 
-			if be, ok := bes.Platforms[dest]; ok {
-				if err := be.Send(m); err != nil {
-					log.Daemon.Errorf("could not send message to %s: %s", dest, err)
-				}
+			if bem.Action == "stop-health" {
+				bes.containerStopped(bem.Data.ContainerID)
 				continue
 			}
-			log.Daemon.Errorf("no backend %s, ensure backend %s is running and able to accept data", dest, dest)
+			for _, dest := range bem.Destinations {
+				bes.deliver(dest, m)
+			}
+		}
+	}
+}
+
+// startQueues creates a queue for every Platform and starts delivering from
+// each of them until the service is stopped.
+func (bes *BackendService) startQueues() {
+	bes.queues = make(map[string]*platformQueue, len(bes.Platforms))
+	for name, be := range bes.Platforms {
+		q, err := newPlatformQueue(name, be, bes.Queues[name])
+		if err != nil {
+			log.Daemon.Errorf("could not open spool of backend %s, undelivered results will be lost: %s", name, err)
+			conf := bes.Queues[name]
+			conf.SpoolDir = ""
+			q, _ = newPlatformQueue(name, be, conf)
+		}
+		bes.queues[name] = q
+		go q.run(bes.ctx.Ctx)
+	}
+}
+
+// containerStopped informs every Platform which holds state per container
+// that the container with the ID passed has stopped. The action is queued
+// behind any results for the container which are still to be delivered.
+func (bes *BackendService) containerStopped(cid string) {
+	stop := msg.NewContainerStoppedMessage(cid).(msg.BackendMessage)
+	for name, be := range bes.Platforms {
+		if _, ok := be.(backend.ContainerStopper); ok {
+			bes.queues[name].push(bes.ctx.Ctx, stop)
 		}
 	}
 }
+
+// deliver queues a Message for the Platform of a single destination, logging
+// should there be no such Platform.
+func (bes *BackendService) deliver(dest health.PlatformTarget, m msg.Message) {
+	name, ok := bes.route(dest)
+	if !ok {
+		if len(dest.Name) > 0 {
+			log.Daemon.Errorf("no backend named %s, ensure a backend with that name is configured", dest.Name)
+			return
+		}
+		log.Daemon.Errorf("no backend %s, ensure backend %s is running and able to accept data", dest.Type, dest.Type)
+		return
+	}
+	bes.queues[name].push(bes.ctx.Ctx, m.(msg.BackendMessage))
+}
+
+// route returns the name of the Platform for a destination. Destinations which
+// carry a backend name are routed only by that name. Otherwise the destination
+// is routed by type, preferring the backend which was named after its type,
+// i.e. any unnamed backend, and then the first backend by name of the same type.
+func (bes *BackendService) route(dest health.PlatformTarget) (string, bool) {
+	if len(dest.Name) > 0 {
+		_, ok := bes.Platforms[dest.Name]
+		return dest.Name, ok
+	}
+	if _, ok := bes.Platforms[string(dest.Type)]; ok {
+		return string(dest.Type), true
+	}
+
+	names := make([]string, 0, len(bes.Platforms))
+	for name := range bes.Platforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if bes.Platforms[name].Type() == dest.Type {
+			return name, true
+		}
+	}
+
+	return "", false
+}
@@ -28,8 +28,23 @@ func (mchc MockCompletedHC) Passed() bool {
 }
 
 type MockPlatform struct {
-	Check    health.HealthCheck
 	Canceler context.CancelFunc
+	sent     chan health.HealthCheck
+}
+
+func newMockPlatform() *MockPlatform {
+	return &MockPlatform{Canceler: func() {}, sent: make(chan health.HealthCheck, 1)}
+}
+
+// received waits for the check of a message sent to the platform.
+func (mp *MockPlatform) received(t *testing.T) health.HealthCheck {
+	select {
+	case hc := <-mp.sent:
+		return hc
+	case <-time.After(time.Second):
+		t.Fatal("no message was sent to the platform")
+		return nil
+	}
 }
 
 func (mp *MockPlatform) Type() types.PlatformType {
@@ -39,17 +54,21 @@ func (mp *MockPlatform) Type() types.PlatformType {
 
 func (mp *MockPlatform) Send(m msg.Message) error {
 	defer mp.Canceler()
-	mp.Check = m.(msg.BackendMessage).CompletedCheck
+	select {
+	case mp.sent <- m.(msg.BackendMessage).CompletedCheck:
+	default:
+	}
 	return nil
 }
 
 func TestBackendService_listen(t *testing.T) {
 	testIO := []struct {
-		name string
-		ch   chan msg.Message
-		hc   MockCompletedHC
-		inp  backend.Platform
-		test func(ch chan msg.Message, args backend.Platform)
+		name    string
+		ch      chan msg.Message
+		hc      MockCompletedHC
+		backend string
+		inp     backend.Platform
+		test    func(ch chan msg.Message, args backend.Platform)
 	}{
 		{
 			name: "should have a default backend listening",
@@ -59,31 +78,89 @@ func TestBackendService_listen(t *testing.T) {
 				Pass:   true,
 			},
 			ch:  make(chan msg.Message),
-			inp: &MockPlatform{},
+			inp: newMockPlatform(),
 			test: func(ch chan msg.Message, args backend.Platform) {
 				bes, _ := NewBackendService(nil, ch, nil)
 				args.(*MockPlatform).Canceler = bes.ctx.Cancel
-				pMap := map[types.PlatformType]backend.Platform{
-					args.Type(): args,
+				pMap := map[string]backend.Platform{
+					string(args.Type()): args,
 				}
 				bes.Platforms = pMap
 				go bes.listen()
 			},
 		},
+		{
+			name: "should route to a backend by name",
+			hc: MockCompletedHC{
+				Result: "foo",
+				Exit:   1,
+				Pass:   false,
+			},
+			ch:      make(chan msg.Message),
+			backend: "prod-webhook",
+			inp:     newMockPlatform(),
+			test: func(ch chan msg.Message, args backend.Platform) {
+				bes, _ := NewBackendService(nil, ch, nil)
+				args.(*MockPlatform).Canceler = bes.ctx.Cancel
+				bes.Platforms = map[string]backend.Platform{
+					"staging-webhook": newMockPlatform(),
+					"prod-webhook":    args,
+				}
+				go bes.listen()
+			},
+		},
+		{
+			name: "should fall back to a backend of the same type when unnamed",
+			hc: MockCompletedHC{
+				Result: "foo",
+				Exit:   0,
+				Pass:   true,
+			},
+			ch:  make(chan msg.Message),
+			inp: newMockPlatform(),
+			test: func(ch chan msg.Message, args backend.Platform) {
+				bes, _ := NewBackendService(nil, ch, nil)
+				args.(*MockPlatform).Canceler = bes.ctx.Cancel
+				bes.Platforms = map[string]backend.Platform{
+					"prod-webhook": args,
+				}
+				go bes.listen()
+			},
+		},
 	}
 	for _, io := range testIO {
 		t.Run(io.name, func(t *testing.T) {
 			io.test(io.ch, io.inp)
 			res := &health.ExecResult{}
-			m := msg.NewBackendMessage(io.hc, io.inp.Type(), res)
+			dests := []health.PlatformTarget{{Type: io.inp.Type(), Name: io.backend}}
+			m := msg.NewBackendMessage(io.hc, dests, res)
 			io.ch <- m
-			// just enough time to avoid racing on the channel
-			time.Sleep(200 * time.Millisecond)
 
-			completed := io.inp.(*MockPlatform).Check
+			completed := io.inp.(*MockPlatform).received(t)
 			assert.Equal(t, completed.String(), io.hc.Result)
 			assert.Equal(t, completed.ExitCode(), io.hc.Exit)
 			assert.Equal(t, completed.Passed(), io.hc.Pass)
 		})
 	}
 }
+
+func TestBackendService_listenFanOut(t *testing.T) {
+	ch := make(chan msg.Message)
+	bes, _ := NewBackendService(nil, ch, nil)
+	statsd := newMockPlatform()
+	prom := newMockPlatform()
+	bes.Platforms = map[string]backend.Platform{
+		"statsd":     statsd,
+		"prometheus": prom,
+	}
+	go bes.listen()
+	defer bes.ctx.Cancel()
+
+	hc := MockCompletedHC{Result: "foo", Exit: 2}
+	dests := []health.PlatformTarget{{Name: "statsd"}, {Name: "prometheus"}}
+	ch <- msg.NewBackendMessage(hc, dests, &health.ExecResult{})
+
+	for _, mp := range []*MockPlatform{statsd, prom} {
+		assert.Equal(t, mp.received(t).ExitCode(), hc.Exit)
+	}
+}
@@ -3,6 +3,7 @@ package srvc
 import (
 	"bytes"
 	"context"
+	"fmt"
 	dockerTypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
@@ -12,11 +13,25 @@ import (
 	"github.com/ideal-co/ogre/pkg/log"
 	msg "github.com/ideal-co/ogre/pkg/message"
 	internalTypes "github.com/ideal-co/ogre/pkg/types"
+	"io"
 	"io/ioutil"
+	"net"
 	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 )
 
+const (
+	// killExecTimeout bounds the inspection of an exec instance which timed
+	// out to find the process to kill.
+	killExecTimeout = 5 * time.Second
+	// killOutputDelay is how long the output of a killed check is read for
+	// before it is closed.
+	killOutputDelay = time.Second
+)
+
 // DockerAPIClient is an interface which wraps a subset of a number of the
 // Docker API interfaces. By limiting our client to only the interfaces we
 // use, we are able to reduce code footprint and more easily test.
@@ -107,6 +122,13 @@ func NewDockerService(out, in, errChan chan msg.Message) (*DockerService, error)
 		return nil, err
 	}
 
+	return NewDockerServiceWithClient(dockerClient, out, in, errChan)
+}
+
+// NewDockerServiceWithClient is NewDockerService for a DockerAPIClient other
+// than the one established from the environment.
+func NewDockerServiceWithClient(dockerClient DockerAPIClient, out, in, errChan chan msg.Message) (*DockerService, error) {
+	var err error
 	ds := &DockerService{
 		Client:        dockerClient,
 		RunningChecks: make(map[string]context.CancelFunc),
@@ -310,10 +332,17 @@ func (ds *DockerService) startChecking(c *Container) {
 
 // stopContainerChecking takes a string representing a container ID and stops
 // a particular containers health checks by means of the associated context's
-// cancel function.
+// cancel function. The backends are then told the container has stopped.
 func (ds *DockerService) stopContainerChecking(cid string) {
 	if cancel, ok := ds.RunningChecks[cid]; ok {
 		cancel()
+		delete(ds.RunningChecks, cid)
+		// let the backends clean up anything they hold for the container,
+		// the daemon may itself be blocked routing the next docker message
+		// to this service so the send must not hold up the listen loop
+		go func() {
+			ds.out <- msg.NewContainerStoppedMessage(cid)
+		}()
 	}
 }
 
@@ -349,68 +378,175 @@ func (ds *DockerService) startCheckLoop(c *Container, chk *health.DockerHealthCh
 			tick.Stop()
 			return
 		case <-tick.C:
-			if chk.Destination == "ex" {
-				result, err := ds.execExternalCheck(chk)
-				if err != nil {
-					log.Daemon.WithField("service", internalTypes.DockerService).Errorf("check %s could not be run: %s", chk.Name, err)
-					continue
-				}
+			start := time.Now()
+			var result *health.ExecResult
+			var err error
+			// a check which has not finished by its timeout is killed
+			ctx, cancel := context.WithTimeout(c.ctx.Ctx, chk.Timeout)
+			switch {
+			case chk.Probe != nil:
+				result = chk.Probe.Probe(ctx, probeTarget(c.Info))
+			case chk.Destination == "ex":
 				log.Daemon.WithField("service", internalTypes.DockerService).Tracef("EXTERN CHECK: %+v", chk)
-				result.Container = c.Name
-				result.Hostname = c.Info.Config.Hostname
-				chk.Result = result
-				ds.out <- msg.NewBackendMessage(chk, chk.Formatter.Platform.Target, result)
-			} else {
-				result, err := ds.execInternalCheck(c.ctx.Ctx, c.ID, chk.Cmd.Args)
-				if err != nil {
-					log.Daemon.WithField("service", internalTypes.DockerService).Errorf("check %s could not be run: %s", chk.Name, err)
-					continue
+				result, err = ds.execExternalCheck(ctx, chk)
+			default:
+				result, err = ds.execInternalCheck(ctx, c.ID, chk.RawCmd, chk.Privileged)
+			}
+			cancel()
+			if result != nil && result.TimedOut {
+				log.Daemon.WithField("service", internalTypes.DockerService).Warnf("check %s of container %s timed out", chk.Name, c.Name)
+				// a probe describes what it was waiting on itself
+				if chk.Probe == nil {
+					result.StdErr += fmt.Sprintf("check timed out after %s and was killed\n", chk.Timeout)
 				}
-				result.Container = c.Name
-				result.Hostname = c.Info.Config.Hostname
-				chk.Result = result
-				ds.out <- msg.NewBackendMessage(chk, chk.Formatter.Platform.Target, result)
 			}
+			if err != nil {
+				log.Daemon.WithField("service", internalTypes.DockerService).Errorf("check %s could not be run: %s", chk.Name, err)
+				continue
+			}
+			result.Container = c.Name
+			result.ContainerID = c.ID
+			result.Image = c.Info.Config.Image
+			result.Hostname = c.Info.Config.Hostname
+			result.Duration = time.Since(start)
+			result.Time = start
+			chk.Result = result
+			ds.out <- msg.NewBackendMessage(chk, chk.Formatter.Platform.Targets, result)
 		}
 	}
 }
 
-func (ds *DockerService) execExternalCheck(chk *health.DockerHealthCheck) (*health.ExecResult, error) {
-	var result health.ExecResult
-	// make a copy of the command to reset after exec
-	var copyCmd exec.Cmd
-	copyCmd = *chk.Cmd
-	defer func() {
-		chk.Cmd = &copyCmd
-	}()
+// probeTarget returns the addresses a probe is run against from the inspected
+// container. The address on the default bridge network is preferred, then the
+// address on the first of its other networks by name. Containers using the
+// network of the host are reached on the loopback address.
+func probeTarget(info dockerTypes.ContainerJSON) health.ProbeTarget {
+	var target health.ProbeTarget
+	if info.Config != nil {
+		target.Hostname = info.Config.Hostname
+	}
+	if info.NetworkSettings != nil {
+		target.Ports = publishedPorts(info.NetworkSettings)
+	}
+	if info.HostConfig != nil && info.HostConfig.NetworkMode.IsHost() {
+		target.ContainerIP = "127.0.0.1"
+		return target
+	}
+	if info.NetworkSettings == nil {
+		return target
+	}
+	if len(info.NetworkSettings.IPAddress) > 0 {
+		target.ContainerIP = info.NetworkSettings.IPAddress
+		return target
+	}
+	names := make([]string, 0, len(info.NetworkSettings.Networks))
+	for name := range info.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ep := info.NetworkSettings.Networks[name]; ep != nil && len(ep.IPAddress) > 0 {
+			target.ContainerIP = ep.IPAddress
+			break
+		}
+	}
+	return target
+}
 
-	var outBuf, errBuf bytes.Buffer
-	chk.Cmd.Stdout = &outBuf
-	chk.Cmd.Stderr = &errBuf
+// publishedPorts returns the address on the host each published port of the
+// container is reached on, keyed by the port of the container, i.e. '5432/tcp'.
+// A port bound to all interfaces of the host is reached on the loopback address.
+func publishedPorts(settings *dockerTypes.NetworkSettings) map[string]string {
+	ports := make(map[string]string)
+	for port, bindings := range settings.Ports {
+		if len(bindings) == 0 {
+			continue
+		}
+		ip := bindings[0].HostIP
+		if len(ip) == 0 || ip == "0.0.0.0" || ip == "::" {
+			ip = "127.0.0.1"
+		}
+		ports[string(port)] = net.JoinHostPort(ip, bindings[0].HostPort)
+	}
+	return ports
+}
+
+// execExternalCheck takes a context.Context bounding the run of a check and
+// the DockerHealthCheck to run, returning an ExecResult and an error, the
+// latter of which will be nil when the command ran whatever its exit. The
+// command is run on the host in a process group of its own so that, should the
+// context reach its deadline, the command and anything it started are killed
+// and a timed out result is returned.
+func (ds *DockerService) execExternalCheck(ctx context.Context, chk *health.DockerHealthCheck) (*health.ExecResult, error) {
+	var result health.ExecResult
+	cmd := exec.Command(chk.RawCmd[0], chk.RawCmd[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	err := chk.Cmd.Start()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
-
-	err = chk.Cmd.Wait()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return nil, err
 	}
-
-	stdout, err := ioutil.ReadAll(&outBuf)
-	if err != nil {
+	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
 
-	stderr, err := ioutil.ReadAll(&errBuf)
-	if err != nil {
+	// the output is read until the command and anything it started have
+	// closed it, which is when the command is done
+	var outBuf, errBuf bytes.Buffer
+	var copies sync.WaitGroup
+	copies.Add(2)
+	go func() {
+		defer copies.Done()
+		io.Copy(&outBuf, stdout)
+	}()
+	go func() {
+		defer copies.Done()
+		io.Copy(&errBuf, stderr)
+	}()
+	copied := make(chan struct{})
+	go func() {
+		copies.Wait()
+		close(copied)
+	}()
+
+	timedOut := false
+	select {
+	case <-copied:
+	case <-ctx.Done():
+		timedOut = true
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			log.Daemon.WithField("service", internalTypes.DockerService).Warnf("could not kill check %s: %s", chk.Name, err)
+		}
+		// anything which left the process group may hold the output open
+		// still, closing it bounds the wait for the command
+		select {
+		case <-copied:
+		case <-time.After(killOutputDelay):
+			stdout.Close()
+			stderr.Close()
+			<-copied
+		}
+	}
+
+	err = cmd.Wait()
+	if timedOut {
+		if ctx.Err() != context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+		return timedOutResult(outBuf.String(), errBuf.String()), nil
+	}
+	// a command exiting non-zero is a failed check, not an error
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
 		return nil, err
 	}
 
-	result.Exit = chk.Cmd.ProcessState.ExitCode()
-	result.StdOut = string(stdout)
-	result.StdErr = string(stderr)
+	result.Exit = cmd.ProcessState.ExitCode()
+	result.StdOut = outBuf.String()
+	result.StdErr = errBuf.String()
 
 	return &result, nil
 }
@@ -423,11 +559,14 @@ func (ds *DockerService) execExternalCheck(chk *health.DockerHealthCheck) (*heal
 // DockerHealthCheck will be executed inside of the container and the result of
 // that command (exit code, stdout, stderr) will be passed to the ExecResult
 // and stored on the DockerHealthCheck struct for reporting to the backend.
-func (ds *DockerService) execInternalCheck(ctx context.Context, cid string, cmd []string) (*health.ExecResult, error) {
+// The command is only given extended privileges when privileged is true.
+// Should the context reach its deadline before the command exits, the command
+// is killed and a timed out result is returned.
+func (ds *DockerService) execInternalCheck(ctx context.Context, cid string, cmd []string, privileged bool) (*health.ExecResult, error) {
 	var result health.ExecResult
 	execConf := dockerTypes.ExecConfig{
 		User:         "root",
-		Privileged:   true,
+		Privileged:   privileged,
 		AttachStderr: true,
 		AttachStdout: true,
 		Env:          nil,
@@ -450,8 +589,27 @@ func (ds *DockerService) execInternalCheck(ctx context.Context, cid string, cmd
 
 	// use docker api lib to trim prepending bytes from message
 	var outBuf, errBuf bytes.Buffer
-	if _, e := stdcopy.StdCopy(&outBuf, &errBuf, hijack.Reader); e != nil {
-		log.Daemon.Errorf("error copying check output: %s", e)
+	copied := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(&outBuf, &errBuf, hijack.Reader)
+		copied <- err
+	}()
+
+	select {
+	case e := <-copied:
+		if e != nil {
+			log.Daemon.Errorf("error copying check output: %s", e)
+		}
+	case <-ctx.Done():
+		// closing the connection ends the copy, the command itself is left
+		// running in the container until it is killed
+		hijack.Close()
+		<-copied
+		if ctx.Err() != context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+		ds.killExec(exec.ID)
+		return timedOutResult(outBuf.String(), errBuf.String()), nil
 	}
 
 	stdout, err := ioutil.ReadAll(&outBuf)
@@ -476,3 +634,33 @@ func (ds *DockerService) execInternalCheck(ctx context.Context, cid string, cmd
 
 	return &result, nil
 }
+
+// killExec kills the process of an exec instance which is still running. The
+// Docker API has no means of stopping an exec, so the process is killed by the
+// pid it has on the host.
+func (ds *DockerService) killExec(execID string) {
+	ctx, cancel := context.WithTimeout(ds.ctx.Ctx, killExecTimeout)
+	defer cancel()
+	res, err := ds.Client.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		log.Daemon.WithField("service", internalTypes.DockerService).Warnf("could not inspect exec %s to kill it: %s", execID, err)
+		return
+	}
+	if !res.Running || res.Pid <= 0 {
+		return
+	}
+	if err := syscall.Kill(res.Pid, syscall.SIGKILL); err != nil {
+		log.Daemon.WithField("service", internalTypes.DockerService).Warnf("could not kill exec %s: %s", execID, err)
+	}
+}
+
+// timedOutResult returns the ExecResult of a check killed for running past its
+// timeout, holding whatever the check wrote before it was killed.
+func timedOutResult(stdout, stderr string) *health.ExecResult {
+	return &health.ExecResult{
+		Exit:     health.ExitTimedOut,
+		StdOut:   stdout,
+		StdErr:   stderr,
+		TimedOut: true,
+	}
+}
@@ -5,9 +5,13 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/ideal-co/ogre/pkg/health"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"testing"
+	"time"
 )
 
 var runningID = "09cc8f08b9397f1175058661a16becf417f140da001c738bd44617f42e631f78"
@@ -322,7 +326,7 @@ func TestExecInternalCheck(t *testing.T) {
 			},
 			test: func(ds *DockerService, args map[string]interface{}, cmd []string) (health.ExecResult, error) {
 				ds.Client = NewMockClient(args)
-				return ds.execInternalCheck(context.Background(), runningID, cmd)
+				return ds.execInternalCheck(context.Background(), runningID, cmd, false)
 			},
 			exp: health.ExecResult{
 				Exit:   0,
@@ -342,3 +346,122 @@ func TestExecInternalCheck(t *testing.T) {
 	}
 }
 */
+
+func TestProbeTarget(t *testing.T) {
+	testIO := []struct {
+		name  string
+		info  types.ContainerJSON
+		expIP string
+	}{
+		{
+			name: "should use the address on the default bridge",
+			info: types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{HostConfig: &container.HostConfig{NetworkMode: "default"}},
+				NetworkSettings: &types.NetworkSettings{
+					DefaultNetworkSettings: types.DefaultNetworkSettings{IPAddress: "172.17.0.3"},
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.3"},
+					},
+				},
+			},
+			expIP: "172.17.0.3",
+		},
+		{
+			name: "should use the first user defined network by name",
+			info: types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{HostConfig: &container.HostConfig{NetworkMode: "backend"}},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"frontend": {IPAddress: "10.0.2.4"},
+						"backend":  {IPAddress: "10.0.1.4"},
+					},
+				},
+			},
+			expIP: "10.0.1.4",
+		},
+		{
+			name: "should use the loopback address on the host network",
+			info: types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{HostConfig: &container.HostConfig{NetworkMode: "host"}},
+				NetworkSettings:   &types.NetworkSettings{},
+			},
+			expIP: "127.0.0.1",
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			assert.Equal(t, io.expIP, probeTarget(io.info).ContainerIP)
+		})
+	}
+}
+
+func TestPublishedPorts(t *testing.T) {
+	settings := &types.NetworkSettings{
+		NetworkSettingsBase: types.NetworkSettingsBase{
+			Ports: nat.PortMap{
+				"5432/tcp": {{HostIP: "0.0.0.0", HostPort: "49153"}},
+				"53/udp":   {{HostIP: "10.0.0.5", HostPort: "5353"}},
+				"8080/tcp": {{HostIP: "::", HostPort: "8080"}},
+				"9090/tcp": nil,
+			},
+		},
+	}
+	assert.Equal(t, map[string]string{
+		"5432/tcp": "127.0.0.1:49153",
+		"53/udp":   "10.0.0.5:5353",
+		"8080/tcp": "127.0.0.1:8080",
+	}, publishedPorts(settings))
+}
+
+func TestDockerService_ExecExternalCheck(t *testing.T) {
+	testIO := []struct {
+		name        string
+		cmd         []string
+		expExit     int
+		expTimedOut bool
+		expStdOut   string
+	}{
+		{
+			name:      "should return the result of a passing check",
+			cmd:       []string{"sh", "-c", "echo ok"},
+			expExit:   0,
+			expStdOut: "ok\n",
+		},
+		{
+			name:    "should return the result of a failing check",
+			cmd:     []string{"sh", "-c", "echo down >&2; exit 3"},
+			expExit: 3,
+		},
+		{
+			name:        "should kill a check and everything it started on timeout",
+			cmd:         []string{"sh", "-c", "echo started; sleep 10 & wait"},
+			expExit:     health.ExitTimedOut,
+			expTimedOut: true,
+			expStdOut:   "started\n",
+		},
+		{
+			name:        "should not wait on what left the process group after a timeout",
+			cmd:         []string{"sh", "-c", "setsid sleep 10 & echo started; wait"},
+			expExit:     health.ExitTimedOut,
+			expTimedOut: true,
+			expStdOut:   "started\n",
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			ds := &DockerService{}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			res, err := ds.execExternalCheck(ctx, &health.DockerHealthCheck{Name: "check", RawCmd: io.cmd})
+			assert.Nil(t, err)
+			assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+			assert.Equal(t, io.expExit, res.Exit)
+			assert.Equal(t, io.expTimedOut, res.TimedOut)
+			if len(io.expStdOut) > 0 {
+				assert.Equal(t, io.expStdOut, res.StdOut)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package srvc
+
+import (
+	"context"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/backend"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"sync"
+	"time"
+)
+
+const (
+	// DropOldest discards the oldest queued message to make room for a new
+	// one when the queue of a Platform is full.
+	DropOldest = "drop-oldest"
+	// DropNewest discards the new message when the queue of a Platform is full.
+	DropNewest = "drop-newest"
+	// Block waits for room in the queue of a Platform, stalling delivery to
+	// every other Platform until there is.
+	Block = "block"
+
+	defaultQueueSize = 100
+	defaultBatchWait = time.Second
+)
+
+// QueueConfig configures the queue of messages waiting to be delivered to a
+// single Platform.
+type QueueConfig struct {
+	// Size is the number of messages which may wait for delivery, defaulting
+	// to 100.
+	Size int
+	// BatchSize is the most messages sent at once to a Platform which
+	// satisfies the backend.BatchClient interface. Batching is disabled when
+	// it is 1 or less.
+	BatchSize int
+	// BatchWait is the longest a message waits for a batch to fill before the
+	// batch is sent anyway, defaulting to 1s.
+	BatchWait time.Duration
+	// DropPolicy is one of DropOldest (default), DropNewest or Block and
+	// decides what happens to messages when the queue is full.
+	DropPolicy string
+	// SpoolDir is the directory messages which could not be delivered are
+	// written to, to be delivered once the Platform recovers. Nothing is
+	// spooled when it is empty.
+	SpoolDir string
+	// SpoolMaxBytes and SpoolMaxAge cap the spool, discarding the oldest
+	// messages once it is over either. A spool is unbounded when both are 0.
+	SpoolMaxBytes int64
+	SpoolMaxAge   time.Duration
+}
+
+// Validate returns an error should the QueueConfig have an unknown drop policy
+// or negative values.
+func (qc QueueConfig) Validate() error {
+	switch qc.DropPolicy {
+	case "", DropOldest, DropNewest, Block:
+	default:
+		return fmt.Errorf("drop_policy must be %s, %s or %s, got %s", DropOldest, DropNewest, Block, qc.DropPolicy)
+	}
+	if qc.Size < 0 || qc.BatchSize < 0 || qc.BatchWait < 0 {
+		return fmt.Errorf("queue_size, batch_size and batch_wait cannot be negative")
+	}
+	if qc.SpoolMaxBytes < 0 || qc.SpoolMaxAge < 0 {
+		return fmt.Errorf("spool_max_bytes and spool_max_age cannot be negative")
+	}
+	return nil
+}
+
+// platformQueue holds the messages for a single Platform and delivers them on
+// its own go routine, so a Platform which is slow to send does not hold up
+// delivery to the others.
+type platformQueue struct {
+	name     string
+	platform backend.Platform
+	conf     QueueConfig
+	// spool is nil unless a spool directory is configured
+	spool *spool
+
+	// items are the queued messages oldest first, they are a slice rather
+	// than a channel so the oldest result can be dropped from behind an
+	// action without changing the order of the rest
+	items []msg.BackendMessage
+	mu    sync.Mutex
+	// ready is signalled when a message is queued and room when one is taken
+	ready chan struct{}
+	room  chan struct{}
+}
+
+// newPlatformQueue returns a pointer to a platformQueue for the Platform with
+// the defaults applied to any of the QueueConfig which was not set, or an
+// error should the spool not be opened.
+func newPlatformQueue(name string, p backend.Platform, conf QueueConfig) (*platformQueue, error) {
+	if conf.Size <= 0 {
+		conf.Size = defaultQueueSize
+	}
+	if conf.BatchWait <= 0 {
+		conf.BatchWait = defaultBatchWait
+	}
+	if len(conf.DropPolicy) == 0 {
+		conf.DropPolicy = DropOldest
+	}
+	q := &platformQueue{
+		name:     name,
+		platform: p,
+		conf:     conf,
+		ready:    make(chan struct{}, 1),
+		room:     make(chan struct{}, 1),
+	}
+	if len(conf.SpoolDir) > 0 {
+		sp, err := newSpool(conf.SpoolDir, conf.SpoolMaxBytes, conf.SpoolMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		q.spool = sp
+	}
+	return q, nil
+}
+
+// push queues a message for delivery, applying the drop policy should the
+// queue be full. Actions are never dropped so a Platform always learns of the
+// containers which stopped, and they keep their place among the results.
+func (q *platformQueue) push(ctx context.Context, bem msg.BackendMessage) {
+	for {
+		q.mu.Lock()
+		if len(q.items) < q.conf.Size {
+			q.items = append(q.items, bem)
+			q.mu.Unlock()
+			signal(q.ready)
+			return
+		}
+
+		if q.conf.DropPolicy != Block && len(bem.Action) == 0 {
+			dropped := bem
+			if q.conf.DropPolicy == DropOldest {
+				// make room by discarding the oldest result, a queue holding
+				// nothing but actions drops the new result instead
+				for i, old := range q.items {
+					if len(old.Action) == 0 {
+						dropped = old
+						q.items = append(append(q.items[:i:i], q.items[i+1:]...), bem)
+						break
+					}
+				}
+			}
+			q.mu.Unlock()
+			log.Daemon.Warnf("queue for backend %s is full, dropping result of %s", q.name, dropped.CompletedCheck)
+			return
+		}
+		q.mu.Unlock()
+
+		// wait for the worker to take a message
+		select {
+		case <-q.room:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pop takes the oldest queued message, reporting false when there is none.
+// The queue stays ready while there are messages left.
+func (q *platformQueue) pop() (msg.BackendMessage, bool) {
+	q.mu.Lock()
+	if len(q.items) == 0 {
+		q.mu.Unlock()
+		return msg.BackendMessage{}, false
+	}
+	bem := q.items[0]
+	q.items[0] = msg.BackendMessage{}
+	q.items = q.items[1:]
+	more := len(q.items) > 0
+	q.mu.Unlock()
+
+	signal(q.room)
+	if more {
+		signal(q.ready)
+	}
+	return bem, true
+}
+
+// signal wakes whoever waits on a channel with a buffer of one without ever
+// blocking, a signal which is already pending is enough.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued messages until the context is done, batching them for
+// Platforms which satisfy the backend.BatchClient interface. Should there be a
+// spool, the messages in it are replayed periodically.
+func (q *platformQueue) run(ctx context.Context) {
+	// a nil channel never fires so there is no replay without a spool
+	var replay <-chan time.Time
+	if q.spool != nil {
+		ticker := time.NewTicker(spoolReplayInterval)
+		defer ticker.Stop()
+		replay = ticker.C
+	}
+
+	bc, batching := q.platform.(backend.BatchClient)
+	if !batching || q.conf.BatchSize <= 1 {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-replay:
+				q.replay()
+			case <-q.ready:
+				if bem, ok := q.pop(); ok {
+					q.deliver(bem)
+				}
+			}
+		}
+	}
+
+	var batch []msg.Message
+	timer := time.NewTimer(q.conf.BatchWait)
+	timer.Stop()
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		defer func() { batch = nil }()
+		// keep the order of anything already spooled, it is delivered with
+		// the spool once the Platform recovers
+		if q.spool != nil && !q.spool.empty() {
+			q.spoolAll(batch)
+			return
+		}
+		if err := bc.SendBatch(batch); err != nil {
+			log.Daemon.Errorf("could not send batch of %d messages to %s: %s", len(batch), q.name, err)
+			q.spoolAll(batch)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-replay:
+			q.replay()
+		case <-timer.C:
+			flush()
+		case <-q.ready:
+			bem, ok := q.pop()
+			if !ok {
+				continue
+			}
+			if len(bem.Action) > 0 {
+				// results queued before the action must be delivered first,
+				// the timer only runs while there is a batch waiting
+				if len(batch) > 0 && !timer.Stop() {
+					<-timer.C
+				}
+				flush()
+				q.deliver(bem)
+				continue
+			}
+			if len(batch) == 0 {
+				timer.Reset(q.conf.BatchWait)
+			}
+			batch = append(batch, bem)
+			if len(batch) >= q.conf.BatchSize {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				flush()
+			}
+		}
+	}
+}
+
+// deliver sends a single message, or carries out its action, on the Platform.
+func (q *platformQueue) deliver(bem msg.BackendMessage) {
+	if bem.Action == "stop-health" {
+		if cs, ok := q.platform.(backend.ContainerStopper); ok {
+			cs.ContainerStopped(bem.Data.ContainerID)
+		}
+		return
+	}
+	// keep the order of anything already spooled, it is delivered with the
+	// spool once the Platform recovers
+	if q.spool != nil && !q.spool.empty() {
+		q.spoolAll([]msg.Message{bem})
+		return
+	}
+	if err := q.platform.Send(bem); err != nil {
+		log.Daemon.Errorf("could not send message to %s: %s", q.name, err)
+		q.spoolAll([]msg.Message{bem})
+	}
+}
+
+// spoolAll writes messages to the spool, should there be one, to be delivered
+// once the Platform recovers.
+func (q *platformQueue) spoolAll(ms []msg.Message) {
+	if q.spool == nil {
+		return
+	}
+	for _, m := range ms {
+		if err := q.spool.add(m.(msg.BackendMessage)); err != nil {
+			log.Daemon.Errorf("could not spool message for %s: %s", q.name, err)
+		}
+	}
+}
+
+// replay delivers any spooled messages to the Platform.
+func (q *platformQueue) replay() {
+	if q.spool == nil || q.spool.empty() {
+		return
+	}
+	if n := q.spool.replay(q.platform); n > 0 {
+		log.Daemon.Infof("delivered %d spooled messages to %s", n, q.name)
+	}
+}
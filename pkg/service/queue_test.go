@@ -0,0 +1,189 @@
+package srvc
+
+import (
+	"context"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type MockBatchPlatform struct {
+	Batches [][]msg.Message
+	mu      sync.Mutex
+}
+
+func (mbp *MockBatchPlatform) Type() types.PlatformType {
+	return types.PlatformType("mock")
+}
+
+func (mbp *MockBatchPlatform) Send(m msg.Message) error {
+	return mbp.SendBatch([]msg.Message{m})
+}
+
+func (mbp *MockBatchPlatform) SendBatch(ms []msg.Message) error {
+	mbp.mu.Lock()
+	defer mbp.mu.Unlock()
+	mbp.Batches = append(mbp.Batches, ms)
+	return nil
+}
+
+func (mbp *MockBatchPlatform) batches() [][]msg.Message {
+	mbp.mu.Lock()
+	defer mbp.mu.Unlock()
+	return mbp.Batches
+}
+
+// queued takes every message waiting in the queue.
+func queued(q *platformQueue) []msg.BackendMessage {
+	var bems []msg.BackendMessage
+	for {
+		bem, ok := q.pop()
+		if !ok {
+			return bems
+		}
+		bems = append(bems, bem)
+	}
+}
+
+func TestPlatformQueue_push(t *testing.T) {
+	testIO := []struct {
+		name   string
+		policy string
+		pushed []int
+		exp    []int
+	}{
+		{
+			name:   "should drop the oldest result when full",
+			policy: DropOldest,
+			pushed: []int{1, 2, 3},
+			exp:    []int{2, 3},
+		},
+		{
+			name:   "should drop the newest result when full",
+			policy: DropNewest,
+			pushed: []int{1, 2, 3},
+			exp:    []int{1, 2},
+		},
+		{
+			name:   "should keep every result when there is room",
+			policy: DropNewest,
+			pushed: []int{1},
+			exp:    []int{1},
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			q, _ := newPlatformQueue("mock", &MockBatchPlatform{}, QueueConfig{Size: 2, DropPolicy: io.policy})
+			for _, exit := range io.pushed {
+				hc := MockCompletedHC{Exit: exit}
+				q.push(context.Background(), msg.NewBackendMessage(hc, nil, &health.ExecResult{Exit: exit}).(msg.BackendMessage))
+			}
+
+			var got []int
+			for _, bem := range queued(q) {
+				got = append(got, bem.Exit())
+			}
+			assert.Equal(t, io.exp, got)
+		})
+	}
+}
+
+func TestPlatformQueue_pushFullOfActions(t *testing.T) {
+	q, _ := newPlatformQueue("mock", &MockBatchPlatform{}, QueueConfig{Size: 2, DropPolicy: DropOldest})
+	for i := 0; i < 2; i++ {
+		q.push(context.Background(), msg.NewContainerStoppedMessage("abc123").(msg.BackendMessage))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.push(context.Background(), msg.NewBackendMessage(MockCompletedHC{}, nil, &health.ExecResult{}).(msg.BackendMessage))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push did not return when the queue held nothing but actions")
+	}
+
+	var actions int
+	for _, bem := range queued(q) {
+		assert.NotEmpty(t, bem.Action)
+		actions++
+	}
+	assert.Equal(t, 2, actions)
+}
+
+func TestPlatformQueue_pushKeepsActionOrder(t *testing.T) {
+	result := func(exit int) msg.BackendMessage {
+		return msg.NewBackendMessage(MockCompletedHC{Exit: exit}, nil, &health.ExecResult{Exit: exit}).(msg.BackendMessage)
+	}
+	q, _ := newPlatformQueue("mock", &MockBatchPlatform{}, QueueConfig{Size: 3, DropPolicy: DropOldest})
+	q.push(context.Background(), msg.NewContainerStoppedMessage("abc123").(msg.BackendMessage))
+	for exit := 1; exit <= 4; exit++ {
+		q.push(context.Background(), result(exit))
+	}
+
+	// the oldest result is dropped from behind the action, which stays ahead
+	// of the results which came after it
+	var got []string
+	for _, bem := range queued(q) {
+		if len(bem.Action) > 0 {
+			got = append(got, bem.Action)
+			continue
+		}
+		got = append(got, fmt.Sprint(bem.Exit()))
+	}
+	assert.Equal(t, []string{"stop-health", "3", "4"}, got)
+}
+
+func TestPlatformQueue_pushBlock(t *testing.T) {
+	q, _ := newPlatformQueue("mock", &MockBatchPlatform{}, QueueConfig{Size: 1, DropPolicy: Block})
+	q.push(context.Background(), msg.NewBackendMessage(MockCompletedHC{Exit: 1}, nil, &health.ExecResult{Exit: 1}).(msg.BackendMessage))
+
+	done := make(chan struct{})
+	go func() {
+		q.push(context.Background(), msg.NewBackendMessage(MockCompletedHC{Exit: 2}, nil, &health.ExecResult{Exit: 2}).(msg.BackendMessage))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("push did not wait for room in the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bem, _ := q.pop()
+	assert.Equal(t, 1, bem.Exit())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push did not return once there was room")
+	}
+	bem, _ = q.pop()
+	assert.Equal(t, 2, bem.Exit())
+}
+
+func TestPlatformQueue_runBatch(t *testing.T) {
+	mbp := &MockBatchPlatform{}
+	q, _ := newPlatformQueue("mock", mbp, QueueConfig{BatchSize: 2, BatchWait: 100 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.run(ctx)
+
+	for exit := 0; exit < 3; exit++ {
+		hc := MockCompletedHC{Exit: exit}
+		q.push(ctx, msg.NewBackendMessage(hc, nil, &health.ExecResult{Exit: exit}).(msg.BackendMessage))
+	}
+	// long enough for the last result to be sent once the batch wait is up
+	time.Sleep(300 * time.Millisecond)
+
+	batches := mbp.batches()
+	if assert.Len(t, batches, 2) {
+		assert.Len(t, batches[0], 2)
+		assert.Len(t, batches[1], 1)
+	}
+}
@@ -0,0 +1,236 @@
+package srvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/backend"
+	"github.com/ideal-co/ogre/pkg/health"
+	"github.com/ideal-co/ogre/pkg/log"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// spoolReplayInterval is how often a spool with records tries to deliver
+	// them to its Platform.
+	spoolReplayInterval = 10 * time.Second
+	// spoolExt is the extension of the file of each record in a spool.
+	spoolExt = ".json"
+	// spoolTmpExt is appended to the path of a record while it is written.
+	spoolTmpExt = ".tmp"
+)
+
+// spool persists the messages which a Platform failed to deliver, one file per
+// message, so they can be delivered in order once the Platform recovers, even
+// should ogred be restarted in the meantime. The records of a spool are only
+// accessed from the go routine of its platformQueue.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	// records are ordered oldest first by sequence number
+	records []spoolEntry
+	size    int64
+	seq     uint64
+}
+
+// spoolEntry is a record which is held on disk.
+type spoolEntry struct {
+	path    string
+	size    int64
+	written time.Time
+}
+
+// spoolRecord is what is written for each message, enough to rebuild the
+// message as it was sent to the Platform.
+type spoolRecord struct {
+	Check        string
+	Formatter    *health.DockerFormatter `json:",omitempty"`
+	Destinations []health.PlatformTarget
+	Data         *health.ExecResult
+}
+
+// newSpool returns a pointer to a spool in the directory passed, creating the
+// directory should it not exist and picking up any records left from a
+// previous run. A maxBytes or maxAge of zero leaves the spool unbounded.
+func newSpool(dir string, maxBytes int64, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %s", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool directory: %s", err)
+	}
+
+	sp := &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+	for _, f := range files {
+		// a record whose write was cut short by a crash was never added
+		if !f.IsDir() && strings.HasSuffix(f.Name(), spoolExt+spoolTmpExt) {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				log.Daemon.Errorf("could not remove partial spool record %s: %s", f.Name(), err)
+			}
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolExt), 10, 64)
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolExt) || err != nil {
+			continue
+		}
+		sp.records = append(sp.records, spoolEntry{
+			path:    filepath.Join(dir, f.Name()),
+			size:    f.Size(),
+			written: f.ModTime(),
+		})
+		sp.size += f.Size()
+		if seq > sp.seq {
+			sp.seq = seq
+		}
+	}
+	// the names are zero padded so they sort in the order they were written
+	sort.Slice(sp.records, func(i, j int) bool {
+		return sp.records[i].path < sp.records[j].path
+	})
+
+	return sp, nil
+}
+
+// empty reports whether there are no records waiting to be delivered.
+func (sp *spool) empty() bool {
+	return len(sp.records) == 0
+}
+
+// add writes a message to the spool, discarding the oldest records should the
+// spool be over its caps.
+func (sp *spool) add(bem msg.BackendMessage) error {
+	rec := spoolRecord{
+		Check:        bem.CompletedCheck.String(),
+		Destinations: bem.Destinations,
+		Data:         bem.Data,
+	}
+	if dhc, ok := bem.CompletedCheck.(*health.DockerHealthCheck); ok {
+		rec.Formatter = dhc.Formatter
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("could not serialize spool record: %s", err)
+	}
+
+	sp.seq++
+	path := filepath.Join(sp.dir, fmt.Sprintf("%020d%s", sp.seq, spoolExt))
+	// write then rename so a crash never leaves a partial record behind
+	tmp := path + spoolTmpExt
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("could not write spool record: %s", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not write spool record: %s", err)
+	}
+
+	sp.records = append(sp.records, spoolEntry{path: path, size: int64(len(data)), written: time.Now()})
+	sp.size += int64(len(data))
+	sp.enforceCaps()
+
+	return nil
+}
+
+// replay delivers the records to the Platform oldest first, stopping at the
+// first which fails so that the order is kept. It returns the number of
+// records which were delivered.
+func (sp *spool) replay(p backend.Platform) int {
+	sp.enforceCaps()
+
+	delivered := 0
+	for !sp.empty() {
+		entry := sp.records[0]
+		bem, err := sp.read(entry.path)
+		if err != nil {
+			// a record which cannot be read will never be delivered
+			log.Daemon.Errorf("discarding spool record %s: %s", entry.path, err)
+			sp.remove()
+			continue
+		}
+		if err := p.Send(bem); err != nil {
+			log.Daemon.Debugf("could not replay spool record %s: %s", entry.path, err)
+			break
+		}
+		sp.remove()
+		delivered++
+	}
+
+	return delivered
+}
+
+// read rebuilds the message of the record at the path passed.
+func (sp *spool) read(path string) (msg.BackendMessage, error) {
+	var bem msg.BackendMessage
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return bem, err
+	}
+	var rec spoolRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return bem, err
+	}
+	if rec.Data == nil {
+		rec.Data = &health.ExecResult{}
+	}
+
+	hc := &health.DockerHealthCheck{
+		Name:      rec.Check,
+		Formatter: rec.Formatter,
+		Result:    rec.Data,
+	}
+	return msg.NewBackendMessage(hc, rec.Destinations, rec.Data).(msg.BackendMessage), nil
+}
+
+// remove deletes the oldest record.
+func (sp *spool) remove() {
+	entry := sp.records[0]
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.Daemon.Errorf("could not remove spool record %s: %s", entry.path, err)
+	}
+	sp.records = sp.records[1:]
+	sp.size -= entry.size
+}
+
+// enforceCaps discards the oldest records while the spool is larger than its
+// size cap or they are older than its age cap.
+func (sp *spool) enforceCaps() {
+	dropped := 0
+	for !sp.empty() {
+		entry := sp.records[0]
+		tooBig := sp.maxBytes > 0 && sp.size > sp.maxBytes
+		tooOld := sp.maxAge > 0 && time.Since(entry.written) > sp.maxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		sp.remove()
+		dropped++
+	}
+	if dropped > 0 {
+		log.Daemon.Warnf("discarded %d records from spool %s which were over its size or age", dropped, sp.dir)
+	}
+}
+
+// writeFileSync writes data to a new file and syncs it to disk.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,149 @@
+package srvc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ideal-co/ogre/pkg/backend"
+	"github.com/ideal-co/ogre/pkg/health"
+	msg "github.com/ideal-co/ogre/pkg/message"
+	"github.com/ideal-co/ogre/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type MockFlakyPlatform struct {
+	Down bool
+	Sent []int
+}
+
+func (mfp *MockFlakyPlatform) Type() types.PlatformType {
+	return types.PlatformType("mock")
+}
+
+func (mfp *MockFlakyPlatform) Send(m msg.Message) error {
+	if mfp.Down {
+		return errors.New("backend is down")
+	}
+	mfp.Sent = append(mfp.Sent, m.(msg.BackendMessage).Exit())
+	return nil
+}
+
+func TestSpool(t *testing.T) {
+	testIO := []struct {
+		name     string
+		maxBytes int64
+		maxAge   time.Duration
+		exp      []int
+	}{
+		{
+			name: "should replay every record in order",
+			exp:  []int{0, 1, 2},
+		},
+		{
+			name:     "should discard the oldest records over the size cap",
+			maxBytes: 1,
+			exp:      nil,
+		},
+		{
+			name:   "should discard records over the age cap",
+			maxAge: time.Nanosecond,
+			exp:    nil,
+		},
+	}
+	for _, io := range testIO {
+		t.Run(io.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ogre-spool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			sp, err := newSpool(dir, io.maxBytes, io.maxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for exit := 0; exit < 3; exit++ {
+				res := &health.ExecResult{Container: "/foo", Exit: exit}
+				hc := &health.DockerHealthCheck{Name: "bar", Result: res}
+				assert.NoError(t, sp.add(msg.NewBackendMessage(hc, nil, res).(msg.BackendMessage)))
+			}
+
+			// the records must survive a restart
+			sp, err = newSpool(dir, io.maxBytes, io.maxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mfp := &MockFlakyPlatform{Down: true}
+			assert.Equal(t, 0, sp.replay(mfp))
+
+			mfp.Down = false
+			sp.replay(mfp)
+			assert.Equal(t, io.exp, mfp.Sent)
+			assert.True(t, sp.empty())
+		})
+	}
+}
+
+func TestSpool_replayTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogre-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p, err := backend.NewGraphiteBackend(conn.LocalAddr().String(), "ogre", "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &health.ExecResult{Container: "/foo", Exit: 1, Time: time.Unix(1591026304, 0)}
+	hc := &health.DockerHealthCheck{Name: "bar", Result: res}
+	assert.NoError(t, sp.add(msg.NewBackendMessage(hc, nil, res).(msg.BackendMessage)))
+	assert.Equal(t, 1, sp.replay(p))
+
+	// the replayed point is as of the run of the check, not of the replay
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ogre.foo.bar 1 1591026304\n", string(buf[:n]))
+}
+
+func TestNewSpool_partialRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogre-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// as left by a crash between writing a record and renaming it
+	partial := filepath.Join(dir, fmt.Sprintf("%020d%s%s", 1, spoolExt, spoolTmpExt))
+	if err := ioutil.WriteFile(partial, []byte(`{"Check":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, sp.empty())
+	assert.Equal(t, int64(0), sp.size)
+	_, err = os.Stat(partial)
+	assert.True(t, os.IsNotExist(err), "partial record was not removed: %v", err)
+}
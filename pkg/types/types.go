@@ -9,13 +9,21 @@ import "errors"
 type PlatformType string
 
 const (
-	PrometheusBackend PlatformType = "prometheus"
-	StatsdBackend     PlatformType = "statsd"
-	CollectdBackend   PlatformType = "collectd"
-	HTTPBackend       PlatformType = "http"
-	GrafanaBackend    PlatformType = "grafana"
-	GraphiteBackend   PlatformType = "graphite"
-	DefaultBackend    PlatformType = "log"
+	PrometheusBackend   PlatformType = "prometheus"
+	StatsdBackend       PlatformType = "statsd"
+	CollectdBackend     PlatformType = "collectd"
+	HTTPBackend         PlatformType = "http"
+	GrafanaBackend      PlatformType = "grafana"
+	GraphiteBackend     PlatformType = "graphite"
+	InfluxBackend       PlatformType = "influx"
+	OTLPBackend         PlatformType = "otlp"
+	SyslogBackend       PlatformType = "syslog"
+	AlertmanagerBackend PlatformType = "alertmanager"
+	FileBackend         PlatformType = "file"
+	NATSBackend         PlatformType = "nats"
+	MQTTBackend         PlatformType = "mqtt"
+	ExecBackend         PlatformType = "exec"
+	DefaultBackend      PlatformType = "log"
 )
 
 // MessageType is a string which is used in the constants of this package to